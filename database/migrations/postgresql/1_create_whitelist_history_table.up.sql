@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS whitelist_history (
+    id BIGSERIAL PRIMARY KEY,
+    public_key TEXT NOT NULL,
+    change TEXT NOT NULL, -- added, removed or updated
+    changed_at TIMESTAMPTZ NOT NULL,
+    operator TEXT,
+    tier TEXT,
+    enrollment_start TIMESTAMPTZ,
+    enrollment_end TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_whitelist_history_public_key ON whitelist_history (public_key, changed_at);
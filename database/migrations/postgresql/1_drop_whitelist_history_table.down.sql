@@ -0,0 +1 @@
+DROP TABLE IF EXISTS whitelist_history;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS submission_attempts (
+    submitter TEXT NOT NULL,
+    attempted_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_submission_attempts_submitter ON submission_attempts (submitter, attempted_at);
+CREATE INDEX IF NOT EXISTS idx_submission_attempts_attempted_at ON submission_attempts (attempted_at);
@@ -0,0 +1,2 @@
+-- normalized client address, remote_addr keeps the forwarding header as received
+ALTER TABLE IF EXISTS submissions ADD COLUMN IF NOT EXISTS client_ip TEXT;
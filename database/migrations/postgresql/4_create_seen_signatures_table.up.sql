@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS seen_signatures (
+    submitter TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (submitter, signature)
+);
+CREATE INDEX IF NOT EXISTS idx_seen_signatures_expires_at ON seen_signatures (expires_at);
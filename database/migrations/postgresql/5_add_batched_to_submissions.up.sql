@@ -0,0 +1,2 @@
+-- set for submissions sent in /v1/submit/batch, which may be stored long after created_at
+ALTER TABLE IF EXISTS submissions ADD COLUMN IF NOT EXISTS batched BOOLEAN;
@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS submissions DROP COLUMN IF EXISTS batched;
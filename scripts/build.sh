@@ -8,17 +8,26 @@ fi
 
 ref_signer="$PWD/external/c-reference-signer"
 
+if [[ "$1" == "docker" ]]; then
+  DOCKER_TARGET=${DOCKER_TARGET:-puresigner}
+fi
+
 mkdir -p "$OUT"/{headers,bin}
-rm -f "$OUT"/libmina_signer.so # Otherwise re-building without clean causes permissions issue
-if [[ "$LIB_MINA_SIGNER" == "" ]]; then
-  # No nix
-  cp -R "$ref_signer" "$OUT"
-  make -C "$OUT/c-reference-signer" clean libmina_signer.so
-  cp "$OUT/c-reference-signer/libmina_signer.so" "$OUT"
+if [[ "$PURE_SIGNER" != "" || ( "$1" == "docker" && "$DOCKER_TARGET" == "puresigner" ) ]]; then
+  # Signatures are verified in Go, libmina_signer isn't needed
+  GO_TAGS="-tags=puresigner"
 else
-  cp "$LIB_MINA_SIGNER" "$OUT"/libmina_signer.so
+  rm -f "$OUT"/libmina_signer.so # Otherwise re-building without clean causes permissions issue
+  if [[ "$LIB_MINA_SIGNER" == "" ]]; then
+    # No nix
+    cp -R "$ref_signer" "$OUT"
+    make -C "$OUT/c-reference-signer" clean libmina_signer.so
+    cp "$OUT/c-reference-signer/libmina_signer.so" "$OUT"
+  else
+    cp "$LIB_MINA_SIGNER" "$OUT"/libmina_signer.so
+  fi
+  cp "$ref_signer"/*.h "$OUT/headers"
 fi
-cp "$ref_signer"/*.h "$OUT/headers"
 
 case "$1" in
   db-migrate-up)
@@ -31,7 +40,7 @@ case "$1" in
     ;;
   test)
     cd src/delegation_backend
-    LD_LIBRARY_PATH="$OUT" $GO test
+    LD_LIBRARY_PATH="$OUT" $GO test $GO_TAGS
     ;;
   integration-test)
     cd src/integration_tests
@@ -44,12 +53,16 @@ case "$1" in
     fi
     # set image name to 673156464838.dkr.ecr.us-west-2.amazonaws.com/uptime-service-backend if IMAGE_NAME is not set
     IMAGE_NAME=${IMAGE_NAME:-uptime-service-backend}
-    docker build -t "$IMAGE_NAME:$TAG" -f dockerfiles/Dockerfile-delegation-backend .
+    docker build --target "$DOCKER_TARGET" -t "$IMAGE_NAME:$TAG" -f dockerfiles/Dockerfile-delegation-backend .
     ;;
   "")
     cd src/cmd/delegation_backend
-    $GO build -o "$OUT/bin/delegation_backend"
-    echo "to run use cmd: LD_LIBRARY_PATH=result ./result/bin/delegation_backend"
+    $GO build $GO_TAGS -o "$OUT/bin/delegation_backend"
+    if [[ "$PURE_SIGNER" != "" ]]; then
+      echo "to run use cmd: ./result/bin/delegation_backend"
+    else
+      echo "to run use cmd: LD_LIBRARY_PATH=result ./result/bin/delegation_backend"
+    fi
     ;;
   *)
     echo "unknown command $1"
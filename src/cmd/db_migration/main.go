@@ -8,6 +8,7 @@ import (
 )
 
 const DATABASE_MIGRATION_DIR = "../../../database/migrations"
+const POSTGRESQL_MIGRATION_DIR = DATABASE_MIGRATION_DIR + "/postgresql"
 
 func main() {
 	// Setup logging
@@ -26,23 +27,41 @@ func main() {
 		log.Fatal("Missing required command: 'up' or 'down'")
 	}
 
+	command := os.Args[1]
+	if command != "up" && command != "down" {
+		log.Fatal("Invalid command. Use 'up' or 'down'")
+	}
+	if config.AwsKeyspaces == nil && config.PostgreSQL == nil {
+		log.Fatalf("No Aws Keyspaces or PostgreSQL backend configured! Make sure you have loaded CONFIG_FILE environment variable with the path to the config file including aws_keyspaces or postgresql configuration!")
+	}
+
 	if config.AwsKeyspaces != nil {
 		log.Infof("storage backend: Aws Keyspaces")
-		switch os.Args[1] {
-		case "up":
-			err := dg.MigrationUp(config.AwsKeyspaces, DATABASE_MIGRATION_DIR)
-			if err != nil {
-				log.Fatalf("Migration up failed: %v", err)
-			}
-		case "down":
-			err := dg.MigrationDown(config.AwsKeyspaces, DATABASE_MIGRATION_DIR)
-			if err != nil {
-				log.Fatalf("Migration down failed: %v", err)
-			}
-		default:
-			log.Fatal("Invalid command. Use 'up' or 'down'")
+		var err error
+		if command == "up" {
+			err = dg.MigrationUp(config.AwsKeyspaces, DATABASE_MIGRATION_DIR)
+		} else {
+			err = dg.MigrationDown(config.AwsKeyspaces, DATABASE_MIGRATION_DIR)
+		}
+		if err != nil {
+			log.Fatalf("Migration %s failed: %v", command, err)
+		}
+	}
+
+	if config.PostgreSQL != nil {
+		log.Infof("storage backend: PostgreSQL")
+		db, err := dg.NewPostgreSQL(config.PostgreSQL)
+		if err != nil {
+			log.Fatalf("Error connecting to PostgreSQL: %v", err)
+		}
+		defer db.Close()
+		if command == "up" {
+			err = dg.PostgreSQLMigrationUp(db, POSTGRESQL_MIGRATION_DIR)
+		} else {
+			err = dg.PostgreSQLMigrationDown(db, POSTGRESQL_MIGRATION_DIR)
+		}
+		if err != nil {
+			log.Fatalf("Migration %s failed: %v", command, err)
 		}
-	} else {
-		log.Fatalf("No Aws Keyspaces backend configured! Make sure you have loaded CONFIG_FILE environment variable with the path to the config file including aws_keyspaces configuration!")
 	}
 }
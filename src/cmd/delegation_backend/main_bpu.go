@@ -3,15 +3,14 @@ package main
 import (
 	. "block_producers_uptime/delegation_backend"
 	"context"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	logging "github.com/ipfs/go-log/v2"
-	"google.golang.org/api/option"
-	sheets "google.golang.org/api/sheets/v4"
 )
 
 func main() {
@@ -30,132 +29,191 @@ func main() {
 	ctx := context.Background()
 	appCfg := LoadEnv(log)
 	app := new(App)
-	app.IsReady = false
 	app.Log = log
-	awsctx := AwsContext{}
-	kc := KeyspaceContext{}
-	pctx := PostgreSQLContext{}
+	healthCheckTimeout := DEFAULT_HEALTH_CHECK_TIMEOUT
+	if appCfg.HealthCheckTimeout > 0 {
+		healthCheckTimeout = time.Duration(appCfg.HealthCheckTimeout) * time.Second
+	}
+	readiness := NewReadiness(app.IsReady.Load, healthCheckTimeout)
 	app.VerifySignatureDisabled = appCfg.VerifySignatureDisabled
 	if app.VerifySignatureDisabled {
 		log.Warnf("Signature verification is disabled, it is not recommended to run the delegation backend in this mode!")
 	}
 	app.NetworkId = NetworkId(appCfg.NetworkName)
-
-	// Storage backend setup
-	if appCfg.Aws != nil {
-		log.Infof("storage backend: AWS S3")
-		awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(appCfg.Aws.Region))
-		if err != nil {
-			log.Fatalf("Error loading AWS configuration: %v", err)
-		}
-		client := s3.NewFromConfig(awsCfg)
-		awsctx = AwsContext{Client: client, BucketName: aws.String(GetAWSBucketName(appCfg)), Prefix: appCfg.NetworkName, Context: ctx, Log: log}
-
+	if appCfg.SignatureCacheSize >= 0 {
+		app.SignatureCache = NewSignatureCache(appCfg.SignatureCacheSize)
 	}
 
-	if appCfg.AwsKeyspaces != nil {
-		log.Infof("storage backend: AWS Keyspaces")
-		session, err := InitializeKeyspaceSession(appCfg.AwsKeyspaces)
-		if err != nil {
-			log.Fatalf("Error initializing Keyspace session: %v", err)
-		}
-		defer session.Close()
-
-		kc = KeyspaceContext{
-			Session:  session,
-			Keyspace: appCfg.AwsKeyspaces.Keyspace,
-			Context:  ctx,
-			Log:      log,
-		}
-
+	// Storage backend setup
+	storages, err := NewStorages(ctx, appCfg, log)
+	if err != nil {
+		log.Fatalf("Error initializing storage backends: %v", err)
 	}
-
-	if appCfg.LocalFileSystem != nil {
-		log.Infof("storage backend: Local File System")
+	if len(storages) == 0 {
+		log.Fatal("No storage backend configured!")
 	}
-
-	if appCfg.PostgreSQL != nil {
-		log.Infof("storage backend: PostgreSQL")
-		db, err := NewPostgreSQL(appCfg.PostgreSQL)
+	if appCfg.Spool != nil {
+		// Submissions are acknowledged once spooled, backends receive them asynchronously
+		spool, err := NewSpool(appCfg.Spool, storages, log)
 		if err != nil {
-			log.Fatalf("Error initializing PostgreSQL: %v", err)
+			log.Fatalf("Error initializing spool: %v", err)
 		}
-		defer db.Close()
-
-		pctx = PostgreSQLContext{
-			DB:  db,
-			Log: log,
+		spool.Start()
+		app.Storage = spool
+		// Backends being down only delays draining of the spool
+		readiness.Add(HealthComponent{Name: spool.Name(), Critical: true, Check: spool.HealthCheck})
+		for _, s := range storages {
+			readiness.Add(HealthComponent{Name: s.Name(), Critical: false, Check: s.HealthCheck})
 		}
-	}
-
-	app.Save = func(objs ObjectsToSave) {
-		if appCfg.Aws != nil {
-			awsctx.S3Save(objs)
+		log.Infof("Submissions are spooled in %s", appCfg.Spool.Directory)
+		if appCfg.SavePipeline != nil {
+			log.Warnf("Asynchronous save pipeline is ignored when the spool is enabled")
 		}
-		if appCfg.AwsKeyspaces != nil {
-			kc.KeyspaceSave(objs)
+	} else {
+		if appCfg.SavePipeline != nil {
+			for i, s := range storages {
+				storages[i] = NewAsyncStorage(s, appCfg.SavePipeline.Workers, appCfg.SavePipeline.QueueSize, log)
+			}
+			log.Infof("Asynchronous save pipeline enabled with %d workers per storage backend", appCfg.SavePipeline.Workers)
 		}
-		if appCfg.PostgreSQL != nil {
-			pctx.PostgreSQLSave(objs)
+		storage, err := NewMultiStorage(log, appCfg.SavePolicy, appCfg.SaveQuorum, storages...)
+		if err != nil {
+			log.Fatalf("Invalid save policy configuration: %v", err)
 		}
-		if appCfg.LocalFileSystem != nil {
-			LocalFileSystemSave(objs, appCfg.LocalFileSystem.Path, log)
+		app.Storage = storage
+		for _, s := range storages {
+			readiness.Add(HealthComponent{Name: s.Name(), Critical: true, Check: s.HealthCheck})
 		}
 	}
 
-	if appCfg.Aws == nil && appCfg.LocalFileSystem == nil && appCfg.AwsKeyspaces == nil {
-		log.Fatal("No storage backend configured!")
-	}
-
 	// App other configurations
 	app.Now = func() time.Time { return time.Now() }
 	requestsPerPkHourly := SetRequestsPerPkHourly(log)
-	app.SubmitCounter = NewAttemptCounter(requestsPerPkHourly)
+	app.SubmitCounter, err = NewRateLimiter(appCfg, PostgreSQLDB(storages), requestsPerPkHourly, log)
+	if err != nil {
+		log.Fatalf("Error initializing rate limiter: %v", err)
+	}
 	log.Infof("Max requests per pk hourly: %v", requestsPerPkHourly)
+	switch limiter := app.SubmitCounter.(type) {
+	case *AttemptCounter:
+		go limiter.Run(ctx, ATTEMPT_COUNTER_SWEEP_INTERVAL)
+	case *PostgreSQLRateLimiter:
+		log.Infof("Rate limit is shared by replicas through PostgreSQL")
+		go limiter.Run(ctx, RATE_LIMITER_SWEEP_INTERVAL)
+	}
+	app.MemoryBudget = NewMemoryBudget(appCfg.SubmitMemoryBudget)
+	app.BodyReadTimeout = SubmitBodyReadTimeout(appCfg.SubmitBodyReadTimeout)
+	app.CreatedAtMaxAge = CreatedAtMaxAge(appCfg.MaxCreatedAtAge)
+	app.BatchCreatedAtMaxAge = BatchCreatedAtMaxAge(appCfg.MaxBatchCreatedAtAge)
+	app.ReplayCache, err = NewReplayCache(appCfg, PostgreSQLDB(storages), log)
+	if err != nil {
+		log.Fatalf("Error initializing replay cache: %v", err)
+	}
+	go app.ReplayCache.Run(ctx, REPLAY_CACHE_SWEEP_INTERVAL)
+	app.RequestLimiter = NewRequestLimiter(appCfg.RequestLimits)
+	app.RequestLimiter.Run(ctx, TOKEN_BUCKET_SWEEP_INTERVAL)
+	app.ClientIPs, err = NewClientIPResolver(appCfg.TrustedProxies, appCfg.ForwardedHeader)
+	if err != nil {
+		log.Fatalf("Error parsing trusted proxies: %v", err)
+	}
+	app.Blocklist, err = NewBlocklist(appCfg.BlocklistFile, app.Now)
+	if err != nil {
+		log.Fatalf("Error loading blocklist: %v", err)
+	}
 
 	// HTTP handlers setup
 	http.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
 		_, _ = rw.Write([]byte("delegation backend service"))
 	})
-	http.Handle("/v1/submit", app.NewSubmitH())
+	http.Handle("/v1/submit", InstrumentHandler("/v1/submit", app.NewSubmitH()))
+	http.Handle("/v2/submit", InstrumentHandler("/v2/submit", app.NewSubmitV2H()))
+	http.Handle("/v1/submit/batch", InstrumentHandler("/v1/submit/batch", app.NewSubmitBatchH()))
 
-	// Health check endpoint
-	http.HandleFunc("/health", HealthHandler(func() bool {
-		return app.IsReady
-	}))
+	// Metrics endpoint
+	if err := RegisterMetrics(app); err != nil {
+		log.Fatalf("Error registering metrics: %v", err)
+	}
+	http.Handle("/metrics", MetricsHandler())
+
+	// Health check endpoints
+	http.HandleFunc("/health", HealthHandler(app.IsReady.Load))
+	http.HandleFunc("/health/live", LivenessHandler())
+	http.HandleFunc("/health/ready", readiness.ReadinessHandler())
+
+	// Admin endpoints
+	if appCfg.AdminToken != "" {
+		http.Handle("/admin/blocklist", AdminAuth(appCfg.AdminToken, BlocklistAdminHandler(app.Blocklist)))
+	} else {
+		log.Infof("Admin endpoints are disabled, ADMIN_TOKEN isn't set")
+	}
 
-	// Sheets service and whitelist loop
+	// Whitelist source and refresh loop
 	app.WhitelistDisabled = appCfg.DelegationWhitelistDisabled
 	if app.WhitelistDisabled {
 		log.Infof("Delegation whitelist is disabled")
 	} else {
-		sheetsService, err2 := sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
-		if err2 != nil {
-			log.Fatalf("Error creating Sheets service: %v", err2)
-		}
-		initWl, err := RetrieveWhitelist(sheetsService, log, appCfg, 1)
+		wlSource, err := NewWhitelistSource(ctx, appCfg, log)
 		if err != nil {
-			log.Fatalf("Failed to initialize whitelist: %v", err)
+			log.Fatalf("Error creating whitelist source: %v", err)
 		}
+		defer wlSource.Close()
+		guard := NewWhitelistGuard(appCfg.WhitelistMaxShrinkPercent, appCfg.WhitelistMinSize)
+		snapshot := NewWhitelistSnapshot(appCfg.WhitelistSnapshotFile, appCfg.WhitelistSnapshotMaxAge)
 		wlMvar := new(WhitelistMVar)
-		wlMvar.Replace(&initWl)
+		refreshInterval := SetWhitelistRefreshInterval(log)
+		refresher := &WhitelistRefresher{
+			Source:    wlSource,
+			Whitelist: wlMvar,
+			Interval:  refreshInterval,
+			Guard:     guard,
+			History:   NewWhitelistHistory(storages),
+			Snapshot:  snapshot,
+			Log:       log,
+		}
+		// A whitelist out of the snapshot is as old as the snapshot, so that
+		// readiness reflects it until it's refreshed out of the source
+		if err := refresher.Init(ctx); err != nil {
+			log.Fatal(err)
+		}
 		app.Whitelist = wlMvar
-		log.Infof("Delegation whitelist is enabled")
-		go func() {
-			for {
-				time.Sleep(SetWhitelistRefreshInterval(log))
-				wl, err := RetrieveWhitelist(sheetsService, log, appCfg, 10)
-				if err != nil {
-					log.Errorf("Failed to refresh delegation whitelist, using previous one, error: %v", err)
-				} else {
-					wlMvar.Replace(&wl)
-					log.Infof("Delegation whitelist refreshed, number of BPs: %v", len(wl))
-				}
-			}
-		}()
+		log.Infof("Delegation whitelist is enabled, loaded from %s", wlSource.Name())
+		readiness.Add(HealthComponent{Name: "whitelist", Critical: true, Check: WhitelistHealthCheck(wlMvar, refreshInterval, app.Now)})
+		// Refused refreshes keep the previous whitelist in use, so they don't affect readiness
+		readiness.Add(HealthComponent{Name: "whitelist_guard", Critical: false, Check: WhitelistGuardHealthCheck(wlMvar)})
+		go refresher.Run(ctx)
+
+		if appCfg.AdminToken != "" {
+			http.Handle("/admin/whitelist", AdminAuth(appCfg.AdminToken, WhitelistAdminHandler(wlMvar)))
+			http.Handle("/admin/whitelist/refresh", AdminAuth(appCfg.AdminToken, WhitelistRefreshAdminHandler(refresher)))
+		}
 	}
 
-	// Start server
-	app.IsReady = true
-	log.Fatal(http.ListenAndServe(DELEGATION_BACKEND_LISTEN_TO, nil))
+	// Start server, it's stopped gracefully on SIGINT or SIGTERM
+	shutdownCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	drainTimeout := DEFAULT_SHUTDOWN_DRAIN_TIMEOUT
+	if appCfg.ShutdownDrainTimeout > 0 {
+		drainTimeout = appCfg.ShutdownDrainTimeout
+	}
+	srv, err := NewServer(shutdownCtx, appCfg.Server, http.DefaultServeMux, log)
+	if err != nil {
+		log.Fatalf("Error configuring server: %v", err)
+	}
+	listenAddress := appCfg.Server.Address()
+	ln, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", listenAddress, err)
+	}
+	log.Infof("Listening on %s, TLS enabled: %v", listenAddress, srv.TLSConfig != nil)
+	serveErr := Serve(shutdownCtx, srv, ln, app,
+		time.Duration(appCfg.ShutdownDelay)*time.Second, time.Duration(drainTimeout)*time.Second)
+
+	// Flush pending saves and release storage connections
+	if err := app.Storage.Close(); err != nil {
+		log.Errorf("Error closing storage: %v", err)
+	}
+	if serveErr != nil {
+		log.Fatalf("Server error: %v", serveErr)
+	}
+	log.Infof("Delegation backend stopped")
 }
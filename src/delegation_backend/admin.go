@@ -0,0 +1,186 @@
+package delegation_backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminAuth only lets through requests with the admin token
+// in the Authorization header, as a bearer token.
+func AdminAuth(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+type WhitelistAdminEntry struct {
+	PublicKey       string     `json:"public_key"`
+	Operator        string     `json:"operator,omitempty"`
+	Tier            string     `json:"tier,omitempty"`
+	EnrollmentStart *time.Time `json:"enrollment_start,omitempty"`
+	EnrollmentEnd   *time.Time `json:"enrollment_end,omitempty"`
+	ChangedAt       time.Time  `json:"changed_at"`
+}
+
+type WhitelistAdminResponse struct {
+	RefreshedAt time.Time             `json:"refreshed_at"`
+	Size        int                   `json:"size"`
+	Entries     []WhitelistAdminEntry `json:"entries"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// WhitelistAdminHandler lists the current whitelist with times its entries last changed.
+// Listing can be narrowed down to a single key with the public_key query parameter.
+func WhitelistAdminHandler(wlMvar *WhitelistMVar) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wl, changedAt, refreshedAt := wlMvar.snapshot()
+		resp := WhitelistAdminResponse{RefreshedAt: refreshedAt, Size: len(wl), Entries: []WhitelistAdminEntry{}}
+		filter := r.URL.Query().Get("public_key")
+		for pk, entry := range wl {
+			pkStr := pk.String()
+			if filter != "" && filter != pkStr {
+				continue
+			}
+			resp.Entries = append(resp.Entries, WhitelistAdminEntry{
+				PublicKey:       pkStr,
+				Operator:        entry.Operator,
+				Tier:            entry.Tier,
+				EnrollmentStart: optionalTime(entry.EnrollmentStart),
+				EnrollmentEnd:   optionalTime(entry.EnrollmentEnd),
+				ChangedAt:       changedAt[pk],
+			})
+		}
+		if filter != "" && len(resp.Entries) == 0 {
+			http.Error(rw, "Public key is not whitelisted", http.StatusNotFound)
+			return
+		}
+		sort.Slice(resp.Entries, func(i, j int) bool {
+			return resp.Entries[i].PublicKey < resp.Entries[j].PublicKey
+		})
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(resp)
+	}
+}
+
+type WhitelistRefreshAdminResponse struct {
+	Size    int `json:"size"`
+	Changes int `json:"changes"`
+}
+
+// WhitelistRefreshAdminHandler refreshes the whitelist out of its source on POST.
+// With force=true the shrink check of the guard is skipped, so that a legitimate
+// large shrink refused by the guard can be deliberately accepted.
+func WhitelistRefreshAdminHandler(refresher *WhitelistRefresher) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var wl Whitelist
+		var changes []WhitelistChange
+		var err error
+		if r.URL.Query().Get("force") == "true" {
+			wl, changes, err = refresher.ForceRefresh(r.Context())
+		} else {
+			wl, changes, err = refresher.refresh(r.Context(), refresher.Guard, 1)
+		}
+		var guardErr *WhitelistGuardError
+		if errors.As(err, &guardErr) {
+			http.Error(rw, "Whitelist refused: "+err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(rw, "Error loading whitelist: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(WhitelistRefreshAdminResponse{Size: len(wl), Changes: len(changes)})
+	}
+}
+
+func writeBlocklistError(rw http.ResponseWriter, err error) {
+	if errors.Is(err, ErrInvalidBlockEntry) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+	} else {
+		http.Error(rw, "Error persisting blocklist: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+type blockRequest struct {
+	BlockEntry
+	// TTL in seconds, an alternative to ExpiresAt
+	TTL int `json:"ttl,omitempty"`
+}
+
+// BlocklistAdminHandler manages the blocklist: GET lists active entries, POST adds
+// an entry (kind, value, reason and either expires_at or ttl in seconds) and
+// DELETE removes the entry identified by kind and value query parameters.
+func BlocklistAdminHandler(b *Blocklist) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			rw.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(rw).Encode(b.List())
+		case http.MethodPost:
+			var req blockRequest
+			if err := json.NewDecoder(io.LimitReader(r.Body, MAX_ADMIN_REQUEST_SIZE)).Decode(&req); err != nil {
+				http.Error(rw, "Error decoding blocklist entry: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if req.TTL < 0 || req.TTL > 0 && req.ExpiresAt != nil {
+				http.Error(rw, "Either a positive ttl or expires_at should be provided", http.StatusBadRequest)
+				return
+			}
+			if req.TTL > 0 {
+				expiresAt := b.now().Add(time.Duration(req.TTL) * time.Second)
+				req.ExpiresAt = &expiresAt
+			}
+			entry, err := b.Add(req.BlockEntry)
+			if err != nil {
+				writeBlocklistError(rw, err)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusCreated)
+			json.NewEncoder(rw).Encode(entry)
+		case http.MethodDelete:
+			removed, err := b.Remove(r.URL.Query().Get("kind"), r.URL.Query().Get("value"))
+			if err != nil {
+				writeBlocklistError(rw, err)
+				return
+			}
+			if !removed {
+				http.Error(rw, "Blocklist entry not found", http.StatusNotFound)
+				return
+			}
+			rw.WriteHeader(http.StatusNoContent)
+		default:
+			rw.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package delegation_backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestAdminAuth(t *testing.T) {
+	h := AdminAuth("secret", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	for header, code := range map[string]int{"": 401, "Bearer wrong": 401, "secret": 401, "Bearer secret": 200} {
+		req := httptest.NewRequest("GET", "/admin/whitelist", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("Authorization %q: expected %d, got %d", header, code, rec.Code)
+		}
+	}
+}
+
+func TestWhitelistAdminHandler(t *testing.T) {
+	wlMvar := new(WhitelistMVar)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	start := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	wlMvar.Update(&Whitelist{mustPk(t, PK1): {}}, t0)
+	wlMvar.Update(&Whitelist{mustPk(t, PK1): {}, mustPk(t, PK2): {Operator: "op", EnrollmentStart: start}}, t0.Add(time.Hour))
+	h := WhitelistAdminHandler(wlMvar)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/whitelist", nil))
+	var resp WhitelistAdminResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Size != 2 || len(resp.Entries) != 2 || !resp.RefreshedAt.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/whitelist?public_key="+PK2, nil))
+	resp = WhitelistAdminResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Entries) != 1 {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	e := resp.Entries[0]
+	if e.Operator != "op" || e.EnrollmentStart == nil || !e.EnrollmentStart.Equal(start) ||
+		e.EnrollmentEnd != nil || !e.ChangedAt.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/whitelist?public_key="+PK3, nil))
+	if rec.Code != 404 {
+		t.Fatalf("expected 404 for key not whitelisted, got %d", rec.Code)
+	}
+}
+
+func TestWhitelistRefreshAdminHandler(t *testing.T) {
+	src := &staticWhitelistSource{wl: testWhitelistOfSize(10)}
+	wlMvar := new(WhitelistMVar)
+	refresher := &WhitelistRefresher{
+		Source:    src,
+		Whitelist: wlMvar,
+		Guard:     NewWhitelistGuard(50, 1),
+		Log:       logging.Logger("delegation backend test"),
+	}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := WhitelistRefreshAdminHandler(refresher)
+	src.wl = testWhitelistKeeping(*wlMvar.ReadWhitelist(), 2, 0)
+	for _, c := range []struct {
+		target string
+		code   int
+	}{{"/admin/whitelist/refresh", 409}, {"/admin/whitelist/refresh?force=true", 200}} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", c.target, nil))
+		if rec.Code != c.code {
+			t.Fatalf("%s: expected %d, got %d", c.target, c.code, rec.Code)
+		}
+	}
+	if len(*wlMvar.ReadWhitelist()) != 2 || wlMvar.Rejection() != nil {
+		t.Fatal("expected forced refresh to apply the shrunk whitelist")
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/whitelist/refresh", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be refused, got %d", rec.Code)
+	}
+}
+
+func TestBlocklistAdminHandler(t *testing.T) {
+	tm := &timeMock{time: time.Now()}
+	b, _ := NewBlocklist("", tm.Now)
+	h := BlocklistAdminHandler(b)
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := request("POST", "/admin/blocklist", `{"kind": "cidr", "value": "10.0.0.1", "reason": "abuse", "ttl": 60}`)
+	var entry BlockEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entry); rec.Code != 201 || err != nil {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body)
+	}
+	if entry.Value != "10.0.0.1/32" || entry.ExpiresAt == nil || !entry.ExpiresAt.Equal(tm.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	for _, invalid := range []string{`{"kind": "cidr", "value": "x"}`, `not json`, `{"kind": "peer_id", "value": "p", "ttl": 60, "expires_at": "2030-01-01T00:00:00Z"}`} {
+		if rec := request("POST", "/admin/blocklist", invalid); rec.Code != 400 {
+			t.Errorf("expected %s to be rejected, got %d", invalid, rec.Code)
+		}
+	}
+
+	rec = request("GET", "/admin/blocklist", "")
+	var entries []BlockEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil || len(entries) != 1 {
+		t.Fatalf("unexpected listing: %s", rec.Body)
+	}
+
+	if rec := request("DELETE", "/admin/blocklist?kind=cidr&value=10.0.0.1/32", ""); rec.Code != 204 {
+		t.Fatalf("unexpected response to removal: %d %s", rec.Code, rec.Body)
+	}
+	if rec := request("DELETE", "/admin/blocklist?kind=cidr&value=10.0.0.1/32", ""); rec.Code != 404 {
+		t.Fatalf("expected missing entry, got %d", rec.Code)
+	}
+	if rec := request("PUT", "/admin/blocklist", ""); rec.Code != 405 {
+		t.Fatalf("expected method not allowed, got %d", rec.Code)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"strconv"
+	"strings"
 
 	logging "github.com/ipfs/go-log/v2"
 )
@@ -42,10 +43,11 @@ func LoadEnv(log logging.EventLogger) AppConfig {
 		verifySignatureDisabled := boolEnvChecked("VERIFY_SIGNATURE_DISABLED", log)
 
 		delegationWhitelistDisabled := boolEnvChecked("DELEGATION_WHITELIST_DISABLED", log)
+		whitelistSource := os.Getenv("DELEGATION_WHITELIST_SOURCE")
 		var gsheetId, delegationWhitelistList, delegationWhitelistColumn string
-		if delegationWhitelistDisabled {
-			// If delegation whitelist is disabled, we don't need to load related environment variables
-			// just loading them from env in case they are set, but they won't be used
+		if delegationWhitelistDisabled || (whitelistSource != "" && whitelistSource != WhitelistSourceSheets) {
+			// If delegation whitelist is disabled or isn't loaded from Google Sheets, we don't need to load
+			// related environment variables, just loading them from env in case they are set, but they won't be used
 			gsheetId = os.Getenv("CONFIG_GSHEET_ID")
 			delegationWhitelistList = os.Getenv("DELEGATION_WHITELIST_LIST")
 			delegationWhitelistColumn = os.Getenv("DELEGATION_WHITELIST_COLUMN")
@@ -57,6 +59,17 @@ func LoadEnv(log logging.EventLogger) AppConfig {
 			delegationWhitelistColumn = getEnvChecked("DELEGATION_WHITELIST_COLUMN", log)
 		}
 
+		if whitelistSource != "" {
+			config.WhitelistSource = &WhitelistSourceConfig{
+				Type:    whitelistSource,
+				Path:    os.Getenv("DELEGATION_WHITELIST_FILE"),
+				URL:     os.Getenv("DELEGATION_WHITELIST_URL"),
+				MaxSize: intEnvChecked("DELEGATION_WHITELIST_MAX_SIZE", log),
+				Table:   os.Getenv("DELEGATION_WHITELIST_TABLE"),
+				Column:  os.Getenv("DELEGATION_WHITELIST_TABLE_COLUMN"),
+			}
+		}
+
 		// AWS configurations
 		if bucketNameSuffix := os.Getenv("AWS_BUCKET_NAME_SUFFIX"); bucketNameSuffix != "" {
 			// accessKeyId, secretAccessKey are not mandatory for production set up
@@ -150,11 +163,120 @@ func LoadEnv(log logging.EventLogger) AppConfig {
 			}
 		}
 
+		// Spool configurations
+		if spoolDirectory := os.Getenv("SPOOL_DIRECTORY"); spoolDirectory != "" {
+			config.Spool = &SpoolConfig{Directory: spoolDirectory}
+			if segmentSize := os.Getenv("SPOOL_SEGMENT_SIZE"); segmentSize != "" {
+				size, err := strconv.ParseInt(segmentSize, 10, 64)
+				if err != nil {
+					log.Fatalf("Error parsing SPOOL_SEGMENT_SIZE: %v", err)
+				}
+				config.Spool.SegmentSize = size
+			}
+			if retryInterval := os.Getenv("SPOOL_RETRY_INTERVAL"); retryInterval != "" {
+				seconds, err := strconv.Atoi(retryInterval)
+				if err != nil {
+					log.Fatalf("Error parsing SPOOL_RETRY_INTERVAL: %v", err)
+				}
+				config.Spool.RetryInterval = seconds
+			}
+			config.Spool.MaxAttempts = intEnvChecked("SPOOL_MAX_ATTEMPTS", log)
+		}
+
+		// Asynchronous save pipeline
+		if saveWorkers := os.Getenv("SAVE_WORKERS"); saveWorkers != "" {
+			workers, err := strconv.Atoi(saveWorkers)
+			if err != nil {
+				log.Fatalf("Error parsing SAVE_WORKERS: %v", err)
+			}
+			config.SavePipeline = &SavePipelineConfig{Workers: workers}
+			if saveQueueSize := os.Getenv("SAVE_QUEUE_SIZE"); saveQueueSize != "" {
+				queueSize, err := strconv.Atoi(saveQueueSize)
+				if err != nil {
+					log.Fatalf("Error parsing SAVE_QUEUE_SIZE: %v", err)
+				}
+				config.SavePipeline.QueueSize = queueSize
+			}
+		}
+
+		// Storage save policy
+		config.SavePolicy = SavePolicy(os.Getenv("SAVE_POLICY"))
+		if saveQuorum := os.Getenv("SAVE_QUORUM"); saveQuorum != "" {
+			quorum, err := strconv.Atoi(saveQuorum)
+			if err != nil {
+				log.Fatalf("Error parsing SAVE_QUORUM: %v", err)
+			}
+			config.SaveQuorum = quorum
+		}
+
+		// Graceful shutdown
+		if shutdownDelay := os.Getenv("SHUTDOWN_DELAY"); shutdownDelay != "" {
+			seconds, err := strconv.Atoi(shutdownDelay)
+			if err != nil {
+				log.Fatalf("Error parsing SHUTDOWN_DELAY: %v", err)
+			}
+			config.ShutdownDelay = seconds
+		}
+		if drainTimeout := os.Getenv("SHUTDOWN_DRAIN_TIMEOUT"); drainTimeout != "" {
+			seconds, err := strconv.Atoi(drainTimeout)
+			if err != nil {
+				log.Fatalf("Error parsing SHUTDOWN_DRAIN_TIMEOUT: %v", err)
+			}
+			config.ShutdownDrainTimeout = seconds
+		}
+		config.HealthCheckTimeout = intEnvChecked("HEALTH_CHECK_TIMEOUT", log)
+
+		config.SignatureCacheSize = intEnvChecked("SIGNATURE_CACHE_SIZE", log)
+		config.RateLimiter = os.Getenv("RATE_LIMITER")
+		config.AttemptCounterMaxKeys = intEnvChecked("ATTEMPT_COUNTER_MAX_KEYS", log)
+		requestLimits := RequestLimitsConfig{
+			GlobalPerSecond: intEnvChecked("REQUESTS_PER_SECOND", log),
+			GlobalBurst:     intEnvChecked("REQUESTS_BURST", log),
+			IPPerMinute:     intEnvChecked("REQUESTS_PER_IP_MINUTE", log),
+			IPBurst:         intEnvChecked("REQUESTS_PER_IP_BURST", log),
+			PeerPerMinute:   intEnvChecked("REQUESTS_PER_PEER_MINUTE", log),
+			PeerBurst:       intEnvChecked("REQUESTS_PER_PEER_BURST", log),
+			MaxKeys:         intEnvChecked("REQUEST_LIMITER_MAX_KEYS", log),
+		}
+		if requestLimits != (RequestLimitsConfig{}) {
+			config.RequestLimits = &requestLimits
+		}
+		if trustedProxies := os.Getenv("TRUSTED_PROXIES"); trustedProxies != "" {
+			config.TrustedProxies = strings.Split(trustedProxies, ",")
+		}
+		config.ForwardedHeader = boolEnvChecked("FORWARDED_HEADER", log)
+		config.MaxCreatedAtAge = intEnvChecked("MAX_CREATED_AT_AGE", log)
+		config.MaxBatchCreatedAtAge = intEnvChecked("MAX_BATCH_CREATED_AT_AGE", log)
+		config.ReplayCache = os.Getenv("REPLAY_CACHE")
+		config.SubmitMemoryBudget = intEnvChecked("SUBMIT_MEMORY_BUDGET", log)
+		config.SubmitBodyReadTimeout = intEnvChecked("SUBMIT_BODY_READ_TIMEOUT", log)
+
+		// Admin endpoints are only served if the token is set
+		config.AdminToken = os.Getenv("ADMIN_TOKEN")
+		config.BlocklistFile = os.Getenv("BLOCKLIST_FILE")
+
+		// HTTP server
+		config.Server = &ServerConfig{
+			ListenAddress:     os.Getenv("LISTEN_ADDRESS"),
+			TLSCertFile:       os.Getenv("TLS_CERT_FILE"),
+			TLSKeyFile:        os.Getenv("TLS_KEY_FILE"),
+			TLSClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+			ReadHeaderTimeout: intEnvChecked("SERVER_READ_HEADER_TIMEOUT", log),
+			ReadTimeout:       intEnvChecked("SERVER_READ_TIMEOUT", log),
+			WriteTimeout:      intEnvChecked("SERVER_WRITE_TIMEOUT", log),
+			IdleTimeout:       intEnvChecked("SERVER_IDLE_TIMEOUT", log),
+		}
+
 		config.NetworkName = networkName
 		config.GsheetId = gsheetId
 		config.DelegationWhitelistList = delegationWhitelistList
 		config.DelegationWhitelistColumn = delegationWhitelistColumn
 		config.DelegationWhitelistDisabled = delegationWhitelistDisabled
+		config.DelegationWhitelistMetadata = boolEnvChecked("DELEGATION_WHITELIST_METADATA", log)
+		config.WhitelistMaxShrinkPercent = intEnvChecked("DELEGATION_WHITELIST_MAX_SHRINK_PERCENT", log)
+		config.WhitelistMinSize = intEnvChecked("DELEGATION_WHITELIST_MIN_SIZE", log)
+		config.WhitelistSnapshotFile = os.Getenv("DELEGATION_WHITELIST_SNAPSHOT_FILE")
+		config.WhitelistSnapshotMaxAge = intEnvChecked("DELEGATION_WHITELIST_SNAPSHOT_MAX_AGE", log)
 		config.VerifySignatureDisabled = verifySignatureDisabled
 	}
 
@@ -184,6 +306,19 @@ func boolEnvChecked(variable string, log logging.EventLogger) bool {
 	}
 }
 
+// intEnvChecked returns 0 if the variable isn't set.
+func intEnvChecked(variable string, log logging.EventLogger) int {
+	value := os.Getenv(variable)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Error parsing %s: %v", variable, err)
+	}
+	return i
+}
+
 type AwsConfig struct {
 	AccountId        string `json:"account_id"`
 	BucketNameSuffix string `json:"bucket_name_suffix"`
@@ -220,15 +355,90 @@ type PostgreSQLConfig struct {
 	SSLMode  string `json:"sslmode"`
 }
 
+type SpoolConfig struct {
+	Directory     string `json:"directory"`
+	SegmentSize   int64  `json:"segment_size,omitempty"`   // bytes
+	RetryInterval int    `json:"retry_interval,omitempty"` // seconds
+	MaxAttempts   int    `json:"max_attempts,omitempty"`   // per record while the backend is healthy, negative means no limit
+}
+
+type SavePipelineConfig struct {
+	Workers   int `json:"workers"`              // per storage backend
+	QueueSize int `json:"queue_size,omitempty"` // per storage backend
+}
+
+type WhitelistSourceConfig struct {
+	Type    string `json:"type"`           // sheets (default), file, http or postgresql
+	Path    string `json:"path,omitempty"` // CSV or JSON file
+	URL     string `json:"url,omitempty"`
+	MaxSize int    `json:"max_size,omitempty"` // MB, largest response of the http source
+	Table   string `json:"table,omitempty"`
+	Column  string `json:"column,omitempty"`
+	// Connection to the database holding the whitelist table,
+	// the PostgreSQL storage connection is used if not set
+	PostgreSQL *PostgreSQLConfig `json:"postgresql,omitempty"`
+}
+
+type ServerConfig struct {
+	ListenAddress     string `json:"listen_address,omitempty"`
+	TLSCertFile       string `json:"tls_cert_file,omitempty"`
+	TLSKeyFile        string `json:"tls_key_file,omitempty"`
+	TLSClientCAFile   string `json:"tls_client_ca_file,omitempty"`
+	ReadHeaderTimeout int    `json:"read_header_timeout,omitempty"` // seconds
+	ReadTimeout       int    `json:"read_timeout,omitempty"`        // seconds
+	WriteTimeout      int    `json:"write_timeout,omitempty"`       // seconds
+	IdleTimeout       int    `json:"idle_timeout,omitempty"`        // seconds
+}
+
+// Limits are disabled if not positive, bursts default to the rates
+type RequestLimitsConfig struct {
+	GlobalPerSecond int `json:"global_per_second,omitempty"`
+	GlobalBurst     int `json:"global_burst,omitempty"`
+	IPPerMinute     int `json:"ip_per_minute,omitempty"`
+	IPBurst         int `json:"ip_burst,omitempty"`
+	PeerPerMinute   int `json:"peer_per_minute,omitempty"`
+	PeerBurst       int `json:"peer_burst,omitempty"`
+	// Number of client addresses and peer ids tracked by each limiter,
+	// 0 means DEFAULT_TOKEN_BUCKET_MAX_KEYS and negative no limit
+	MaxKeys int `json:"max_keys,omitempty"`
+}
+
 type AppConfig struct {
 	NetworkName                 string                 `json:"network_name"`
 	GsheetId                    string                 `json:"gsheet_id"`
 	DelegationWhitelistList     string                 `json:"delegation_whitelist_list"`
 	DelegationWhitelistColumn   string                 `json:"delegation_whitelist_column"`
 	DelegationWhitelistDisabled bool                   `json:"delegation_whitelist_disabled,omitempty"`
+	DelegationWhitelistMetadata bool                   `json:"delegation_whitelist_metadata,omitempty"` // read enrollment window, operator and tier columns following the key column
+	WhitelistSource             *WhitelistSourceConfig `json:"whitelist_source,omitempty"`
+	WhitelistMaxShrinkPercent   int                    `json:"whitelist_max_shrink_percent,omitempty"` // negative disables the check
+	WhitelistMinSize            int                    `json:"whitelist_min_size,omitempty"`
+	WhitelistSnapshotFile       string                 `json:"whitelist_snapshot_file,omitempty"`
+	WhitelistSnapshotMaxAge     int                    `json:"whitelist_snapshot_max_age,omitempty"` // minutes, negative means no limit
 	VerifySignatureDisabled     bool                   `json:"verify_signature_disabled,omitempty"`
 	Aws                         *AwsConfig             `json:"aws,omitempty"`
 	AwsKeyspaces                *AwsKeyspacesConfig    `json:"aws_keyspaces,omitempty"`
 	LocalFileSystem             *LocalFileSystemConfig `json:"filesystem,omitempty"`
 	PostgreSQL                  *PostgreSQLConfig      `json:"postgresql,omitempty"`
+	Spool                       *SpoolConfig           `json:"spool,omitempty"`
+	SavePipeline                *SavePipelineConfig    `json:"save_pipeline,omitempty"`
+	SavePolicy                  SavePolicy             `json:"save_policy,omitempty"`
+	SaveQuorum                  int                    `json:"save_quorum,omitempty"`
+	ShutdownDelay               int                    `json:"shutdown_delay,omitempty"`         // seconds
+	ShutdownDrainTimeout        int                    `json:"shutdown_drain_timeout,omitempty"` // seconds
+	HealthCheckTimeout          int                    `json:"health_check_timeout,omitempty"`   // seconds
+	Server                      *ServerConfig          `json:"server,omitempty"`
+	SignatureCacheSize          int                    `json:"signature_cache_size,omitempty"`
+	RateLimiter                 string                 `json:"rate_limiter,omitempty"`             // memory (default) or postgresql
+	AttemptCounterMaxKeys       int                    `json:"attempt_counter_max_keys,omitempty"` // negative means no limit
+	RequestLimits               *RequestLimitsConfig   `json:"request_limits,omitempty"`
+	TrustedProxies              []string               `json:"trusted_proxies,omitempty"`          // addresses or CIDR ranges
+	ForwardedHeader             bool                   `json:"forwarded_header,omitempty"`         // read client addresses from Forwarded rather than X-Forwarded-For
+	MaxCreatedAtAge             int                    `json:"max_created_at_age,omitempty"`       // seconds, negative disables the check
+	MaxBatchCreatedAtAge        int                    `json:"max_batch_created_at_age,omitempty"` // seconds, of submissions sent in a batch
+	ReplayCache                 string                 `json:"replay_cache,omitempty"`             // memory (default) or postgresql
+	SubmitMemoryBudget          int                    `json:"submit_memory_budget,omitempty"`     // MB, negative disables the budget
+	SubmitBodyReadTimeout       int                    `json:"submit_body_read_timeout,omitempty"` // seconds, negative disables the deadline
+	AdminToken                  string                 `json:"admin_token,omitempty"`
+	BlocklistFile               string                 `json:"blocklist_file,omitempty"`
 }
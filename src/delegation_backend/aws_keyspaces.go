@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -116,6 +117,10 @@ type KeyspaceContext struct {
 	Keyspace string
 	Context  context.Context
 	Log      *logging.ZapEventLogger
+	// ClientIPColumn is set if the submissions table has the client_ip column
+	ClientIPColumn bool
+	// BatchedColumn is set if the submissions table has the batched column
+	BatchedColumn bool
 }
 
 // calculateShard returns the shard number for a given submission time.
@@ -159,53 +164,118 @@ func (kc *KeyspaceContext) insertSubmission(submission *Submission) error {
 }
 
 func (kc *KeyspaceContext) insertSubmissionWithoutRawBlock(submission *Submission) error {
-	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	values := []interface{}{
-		submission.SubmittedAtDate,
-		calculateShard(submission.SubmittedAt),
-		submission.SubmittedAt,
-		submission.Submitter,
-		submission.RemoteAddr,
-		submission.PeerId,
-		submission.SnarkWork,
-		submission.BlockHash,
-		submission.CreatedAt,
-		submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha,
-	}
-	return kc.Session.Query(query, values...).Exec()
+	return kc.insertSubmissionColumns(submission, false)
 }
 
 func (kc *KeyspaceContext) insertSubmissionWithRawBlock(submission *Submission) error {
-	query := "INSERT INTO " + kc.Keyspace + ".submissions (submitted_at_date, shard, submitted_at, submitter, remote_addr, peer_id, snark_work, block_hash, created_at, graphql_control_port, built_with_commit_sha, raw_block) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
-	values := []interface{}{
-		submission.SubmittedAtDate,
-		calculateShard(submission.SubmittedAt),
-		submission.SubmittedAt,
-		submission.Submitter,
-		submission.RemoteAddr,
-		submission.PeerId,
-		submission.SnarkWork,
-		submission.BlockHash,
-		submission.CreatedAt,
-		submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha,
-		submission.RawBlock,
+	return kc.insertSubmissionColumns(submission, true)
+}
+
+func (kc *KeyspaceContext) insertSubmissionColumns(submission *Submission, rawBlock bool) error {
+	columns, values := submissionColumns(submission, kc.ClientIPColumn, kc.BatchedColumn)
+	columns = append(columns, "shard", "snark_work")
+	values = append(values, calculateShard(submission.SubmittedAt), submission.SnarkWork)
+	if rawBlock {
+		columns = append(columns, "raw_block")
+		values = append(values, submission.RawBlock)
 	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := "INSERT INTO " + kc.Keyspace + ".submissions (" + strings.Join(columns, ", ") + ") VALUES (" + placeholders + ")"
 	return kc.Session.Query(query, values...).Exec()
 }
 
+// hasSubmissionsColumn checks whether column was added to the submissions table by migrations.
+func (kc *KeyspaceContext) hasSubmissionsColumn(column string) (bool, error) {
+	err := kc.Session.Query(`SELECT column_name FROM system_schema.columns
+		WHERE keyspace_name = ? AND table_name = 'submissions' AND column_name = ?`, kc.Keyspace, column).Scan(&column)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // KeyspaceSave saves the provided objects into Amazon Keyspaces.
-func (kc *KeyspaceContext) KeyspaceSave(objs ObjectsToSave) {
+func (kc *KeyspaceContext) KeyspaceSave(objs ObjectsToSave) error {
 	submissionToSave, err := objectToSaveToSubmission(objs, kc.Log)
 	if err != nil {
 		kc.Log.Errorf("KeyspaceSave: Error preparing submission for saving: %v", err)
-		return
+		return err
 	}
 	kc.Log.Infof("KeyspaceSave: Saving submission for block: %v, submitter: %v, submitted_at: %v", submissionToSave.BlockHash, submissionToSave.Submitter, submissionToSave.SubmittedAt)
 	if err := kc.insertSubmission(submissionToSave); err != nil {
 		kc.Log.Errorf("KeyspaceSave: Error saving submission to Keyspaces: %v", err)
+		return err
+	}
+	return nil
+}
+
+// NewKeyspaceStorage creates the AWS Keyspaces storage backend if it is configured.
+func NewKeyspaceStorage(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (Storage, error) {
+	if appCfg.AwsKeyspaces == nil {
+		return nil, nil
+	}
+	session, err := InitializeKeyspaceSession(appCfg.AwsKeyspaces)
+	if err != nil {
+		return nil, err
+	}
+	kc := &KeyspaceContext{
+		Session:  session,
+		Keyspace: appCfg.AwsKeyspaces.Keyspace,
+		Context:  ctx,
+		Log:      log,
+	}
+	kc.ClientIPColumn, err = kc.hasSubmissionsColumn("client_ip")
+	if err == nil {
+		kc.BatchedColumn, err = kc.hasSubmissionsColumn("batched")
+	}
+	if err != nil {
+		session.Close()
+		return nil, fmt.Errorf("error checking columns of submissions: %w", err)
+	}
+	if !kc.ClientIPColumn {
+		log.Warnf("AWS Keyspaces submissions table has no client_ip column, client addresses are only stored in remote_addr until database migrations are run")
 	}
+	if !kc.BatchedColumn {
+		log.Warnf("AWS Keyspaces submissions table has no batched column, submissions sent in a batch can only be told by created_at until database migrations are run")
+	}
+	return kc, nil
+}
+
+func (kc *KeyspaceContext) Name() string {
+	return "aws_keyspaces"
+}
+
+func (kc *KeyspaceContext) Save(objs ObjectsToSave) error {
+	return kc.KeyspaceSave(objs)
+}
+
+// Exists checks whether the submission with the given path is stored.
+// Blocks are stored as part of submissions, so block paths are never reported as existing.
+func (kc *KeyspaceContext) Exists(path string) (bool, error) {
+	if !strings.HasPrefix(path, "submissions/") {
+		return false, nil
+	}
+	submission, err := parseSubmissionPath(path)
+	if err != nil {
+		return false, err
+	}
+	query := "SELECT submitter FROM " + kc.Keyspace + ".submissions WHERE submitted_at_date = ? AND shard = ? AND submitted_at = ? AND submitter = ?"
+	var submitter string
+	err = kc.Session.Query(query, submission.SubmittedAtDate, calculateShard(submission.SubmittedAt), submission.SubmittedAt, submission.Submitter).
+		WithContext(kc.Context).Scan(&submitter)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (kc *KeyspaceContext) HealthCheck() error {
+	return kc.Session.Query("SELECT now() FROM system.local").WithContext(kc.Context).Exec()
+}
+
+func (kc *KeyspaceContext) Close() error {
+	kc.Session.Close()
+	return nil
 }
 
 func createSchemaMigrationsTableIfNotExists(session *gocql.Session, keyspace string) error {
@@ -319,3 +389,14 @@ func MigrationDown(config *AwsKeyspacesConfig, migrationPath string) error {
 
 	return ExponentialBackoff(operation, maxRetries, initialBackoff)
 }
+
+// KeyspacesSession returns the session of the AWS Keyspaces storage backend
+// among storages, so that other components share it, or nil if there's none.
+func KeyspacesSession(storages []Storage) *KeyspaceContext {
+	for _, s := range storages {
+		if s, ok := unwrapStorage(s).(*KeyspaceContext); ok {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type AwsContext struct {
+	Client     *s3.Client
+	BucketName *string
+	Prefix     string
+	Context    context.Context
+	Log        *logging.ZapEventLogger
+}
+
+// NewAwsS3Storage creates the AWS S3 storage backend if it is configured.
+func NewAwsS3Storage(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (Storage, error) {
+	if appCfg.Aws == nil {
+		return nil, nil
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(appCfg.Aws.Region))
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS configuration: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg)
+	return &AwsContext{Client: client, BucketName: aws.String(GetAWSBucketName(appCfg)), Prefix: appCfg.NetworkName, Context: ctx, Log: log}, nil
+}
+
+func (ctx *AwsContext) fullKey(path string) *string {
+	return aws.String(ctx.Prefix + "/" + path)
+}
+
+func (ctx *AwsContext) S3Save(objs ObjectsToSave) error {
+	var errs []error
+	for path, bs := range objs {
+		if strings.HasPrefix(path, "blocks/") {
+			exists, err := ctx.Exists(path)
+			if err != nil {
+				ctx.Log.Warnf("S3Save: Error when checking if block exists, but will continue with block save: %s, error: %v", path, err)
+			}
+			if exists {
+				//block already exists, skipping
+				continue
+			}
+		}
+
+		ctx.Log.Infof("S3Save: saving %s", path)
+		_, err := ctx.Client.PutObject(ctx.Context, &s3.PutObjectInput{
+			Bucket:     ctx.BucketName,
+			Key:        ctx.fullKey(path),
+			Body:       bytes.NewReader(bs),
+			ContentMD5: nil,
+		})
+		if err != nil {
+			ctx.Log.Warnf("S3Save: Error while saving %s: %v", path, err)
+			errs = append(errs, fmt.Errorf("error saving %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ctx *AwsContext) Name() string {
+	return "aws_s3"
+}
+
+func (ctx *AwsContext) Save(objs ObjectsToSave) error {
+	return ctx.S3Save(objs)
+}
+
+func (ctx *AwsContext) Exists(path string) (bool, error) {
+	_, err := ctx.Client.HeadObject(ctx.Context, &s3.HeadObjectInput{
+		Bucket: ctx.BucketName,
+		Key:    ctx.fullKey(path),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if strings.Contains(err.Error(), "NotFound") {
+		return false, nil
+	}
+	return false, err
+}
+
+func (ctx *AwsContext) HealthCheck() error {
+	_, err := ctx.Client.HeadBucket(ctx.Context, &s3.HeadBucketInput{
+		Bucket: ctx.BucketName,
+	})
+	return err
+}
+
+func (ctx *AwsContext) Close() error {
+	return nil
+}
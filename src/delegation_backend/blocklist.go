@@ -0,0 +1,268 @@
+package delegation_backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of blocklist entries
+const (
+	BlockKindSubmitter = "submitter"
+	BlockKindPeerId    = "peer_id"
+	BlockKindCIDR      = "cidr"
+)
+
+// ErrInvalidBlockEntry is wrapped by errors about malformed blocklist entries.
+var ErrInvalidBlockEntry = errors.New("invalid blocklist entry")
+
+// BlockEntry blocks submissions by submitter key, peer id or client IP range.
+type BlockEntry struct {
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is nil for permanent entries
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (e *BlockEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// normalize validates the value and brings it to a canonical form,
+// so that the same key, peer or range always maps to the same entry.
+func (e *BlockEntry) normalize() error {
+	value := strings.TrimSpace(e.Value)
+	switch e.Kind {
+	case BlockKindSubmitter:
+		var pk Pk
+		if err := StringToPk(&pk, value); err != nil {
+			return fmt.Errorf("%w: invalid submitter public key: %v", ErrInvalidBlockEntry, err)
+		}
+		e.Value = pk.String()
+	case BlockKindPeerId:
+		if value == "" {
+			return fmt.Errorf("%w: peer id should not be empty", ErrInvalidBlockEntry)
+		}
+		e.Value = value
+	case BlockKindCIDR:
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			// a single address is blocked as a full-length prefix
+			addr, addrErr := netip.ParseAddr(value)
+			if addrErr != nil {
+				return fmt.Errorf("%w: invalid CIDR: %v", ErrInvalidBlockEntry, err)
+			}
+			addr = addr.Unmap()
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		e.Value = prefix.Masked().String()
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidBlockEntry, e.Kind)
+	}
+	return nil
+}
+
+// Blocklist holds blocked submitters, peers and IP ranges, optionally
+// persisted to a file. A nil *Blocklist blocks nothing.
+type Blocklist struct {
+	mutex   sync.RWMutex
+	entries map[string]*BlockEntry // by kind and value
+	// prefixes are kept apart to avoid parsing them on every check
+	prefixes map[netip.Prefix]*BlockEntry
+	path     string
+	now      nowFunc
+}
+
+func blockEntryKey(kind, value string) string {
+	return kind + "/" + value
+}
+
+// NewBlocklist creates a blocklist persisted to path (unless it is empty),
+// loading entries saved there before.
+func NewBlocklist(path string, now nowFunc) (*Blocklist, error) {
+	b := &Blocklist{
+		entries:  make(map[string]*BlockEntry),
+		prefixes: make(map[netip.Prefix]*BlockEntry),
+		path:     path,
+		now:      now,
+	}
+	if path == "" {
+		return b, nil
+	}
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading blocklist: %w", err)
+	}
+	var entries []*BlockEntry
+	if err := json.Unmarshal(bs, &entries); err != nil {
+		return nil, fmt.Errorf("malformed blocklist %s: %w", path, err)
+	}
+	for _, e := range entries {
+		if err := e.normalize(); err != nil {
+			return nil, fmt.Errorf("malformed blocklist %s: %w", path, err)
+		}
+		b.put(e)
+	}
+	return b, nil
+}
+
+func (b *Blocklist) put(e *BlockEntry) {
+	b.entries[blockEntryKey(e.Kind, e.Value)] = e
+	if e.Kind == BlockKindCIDR {
+		b.prefixes[netip.MustParsePrefix(e.Value)] = e
+	}
+}
+
+func (b *Blocklist) delete(e *BlockEntry) {
+	delete(b.entries, blockEntryKey(e.Kind, e.Value))
+	if e.Kind == BlockKindCIDR {
+		delete(b.prefixes, netip.MustParsePrefix(e.Value))
+	}
+}
+
+// purgeExpired is called with the write lock held.
+func (b *Blocklist) purgeExpired(now time.Time) {
+	for _, e := range b.entries {
+		if e.expired(now) {
+			b.delete(e)
+		}
+	}
+}
+
+// save writes entries to the file, it is called with the write lock held.
+func (b *Blocklist) save() error {
+	if b.path == "" {
+		return nil
+	}
+	entries := b.sorted()
+	bs, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func (b *Blocklist) sorted() []BlockEntry {
+	entries := make([]BlockEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return blockEntryKey(entries[i].Kind, entries[i].Value) < blockEntryKey(entries[j].Kind, entries[j].Value)
+	})
+	return entries
+}
+
+// Add blocks the entry, replacing an existing entry for the same value.
+// CreatedAt is set to the current time.
+func (b *Blocklist) Add(e BlockEntry) (BlockEntry, error) {
+	if err := e.normalize(); err != nil {
+		return e, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
+	e.CreatedAt = now
+	if e.expired(now) {
+		return e, fmt.Errorf("%w: already expired", ErrInvalidBlockEntry)
+	}
+	b.purgeExpired(now)
+	b.put(&e)
+	return e, b.save()
+}
+
+// Remove unblocks the value, reporting whether it was blocked.
+func (b *Blocklist) Remove(kind, value string) (bool, error) {
+	e := BlockEntry{Kind: kind, Value: value}
+	if err := e.normalize(); err != nil {
+		return false, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	existing, ok := b.entries[blockEntryKey(e.Kind, e.Value)]
+	if ok {
+		b.delete(existing)
+	}
+	b.purgeExpired(b.now())
+	return ok && !existing.expired(b.now()), b.save()
+}
+
+// List returns entries which haven't expired yet.
+func (b *Blocklist) List() []BlockEntry {
+	if b == nil {
+		return nil
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := b.now()
+	entries := b.sorted()
+	active := entries[:0]
+	for _, e := range entries {
+		if !e.expired(now) {
+			active = append(active, e)
+		}
+	}
+	return active
+}
+
+// Len returns the number of entries, including expired ones not purged yet.
+func (b *Blocklist) Len() int {
+	if b == nil {
+		return 0
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.entries)
+}
+
+func (b *Blocklist) lookup(kind, value string) *BlockEntry {
+	if b == nil {
+		return nil
+	}
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if e := b.entries[blockEntryKey(kind, value)]; e != nil && !e.expired(b.now()) {
+		return e
+	}
+	return nil
+}
+
+// CheckSubmission returns the entry blocking the submitter or peer, if any.
+func (b *Blocklist) CheckSubmission(submitter Pk, peerId string) *BlockEntry {
+	if e := b.lookup(BlockKindSubmitter, submitter.String()); e != nil {
+		return e
+	}
+	return b.lookup(BlockKindPeerId, peerId)
+}
+
+// CheckIP returns the entry blocking the address, if any.
+func (b *Blocklist) CheckIP(addr netip.Addr) *BlockEntry {
+	if b == nil || !addr.IsValid() {
+		return nil
+	}
+	addr = addr.Unmap()
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	now := b.now()
+	for prefix, e := range b.prefixes {
+		if prefix.Contains(addr) && !e.expired(now) {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package delegation_backend
+
+import (
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.json")
+	tm := &timeMock{time: time.Now()}
+	b, err := NewBlocklist(path, tm.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := tm.Now().Add(time.Hour)
+	for _, e := range []BlockEntry{
+		{Kind: BlockKindSubmitter, Value: " " + PK1 + " ", Reason: "abuse"},
+		{Kind: BlockKindPeerId, Value: "12D3KooWPeer", ExpiresAt: &expiresAt},
+		{Kind: BlockKindCIDR, Value: "10.1.2.3/16"},
+		{Kind: BlockKindCIDR, Value: "2001:db8::1"},
+	} {
+		if _, err := b.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, invalid := range []BlockEntry{
+		{Kind: BlockKindSubmitter, Value: "not a key"},
+		{Kind: BlockKindPeerId},
+		{Kind: BlockKindCIDR, Value: "10.0.0.0/33"},
+		{Kind: "country", Value: "XX"},
+	} {
+		if _, err := b.Add(invalid); !errors.Is(err, ErrInvalidBlockEntry) {
+			t.Errorf("expected %+v to be invalid, got %v", invalid, err)
+		}
+	}
+
+	if e := b.CheckSubmission(mustPk(t, PK1), "other"); e == nil || e.Reason != "abuse" {
+		t.Fatalf("expected submitter to be blocked, got %+v", e)
+	}
+	if b.CheckSubmission(mustPk(t, PK2), "12D3KooWPeer") == nil {
+		t.Fatal("expected peer to be blocked")
+	}
+	if b.CheckSubmission(mustPk(t, PK2), "other") != nil {
+		t.Fatal("unexpected block")
+	}
+	for addr, blocked := range map[string]bool{"10.1.200.1": true, "::ffff:10.1.0.1": true, "10.2.0.1": false, "2001:db8::1": true, "2001:db8::2": false} {
+		if (b.CheckIP(netip.MustParseAddr(addr)) != nil) != blocked {
+			t.Errorf("expected %s blocked: %v", addr, blocked)
+		}
+	}
+
+	// Entries are persisted, expired ones are ignored
+	tm.Advance(2 * time.Hour)
+	if b.CheckSubmission(mustPk(t, PK2), "12D3KooWPeer") != nil {
+		t.Fatal("expected peer block to expire")
+	}
+	b2, err := NewBlocklist(path, tm.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := b2.List(); len(entries) != 3 {
+		t.Fatalf("unexpected entries after reload: %+v", entries)
+	}
+	removed, err := b2.Remove(BlockKindCIDR, "10.1.0.0/16")
+	if err != nil || !removed {
+		t.Fatalf("expected CIDR to be removed: %v", err)
+	}
+	if removed, _ := b2.Remove(BlockKindCIDR, "10.1.0.0/16"); removed {
+		t.Fatal("expected second removal to report missing entry")
+	}
+	if b2.CheckIP(netip.MustParseAddr("10.1.0.1")) != nil {
+		t.Fatal("expected address to be unblocked")
+	}
+	if b2.Len() != 2 {
+		t.Fatalf("expected expired entry to be purged, got %d entries", b2.Len())
+	}
+
+	var nilBlocklist *Blocklist
+	if nilBlocklist.CheckSubmission(mustPk(t, PK1), "") != nil || nilBlocklist.CheckIP(netip.MustParseAddr("10.1.0.1")) != nil {
+		t.Fatal("nil blocklist shouldn't block")
+	}
+}
@@ -0,0 +1,155 @@
+package delegation_backend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientIPResolver finds the address of the client which sent a request,
+// looking through X-Forwarded-For (or Forwarded) entries added by trusted proxies.
+type ClientIPResolver struct {
+	trustedProxies []netip.Prefix
+	useForwarded   bool
+}
+
+// NewClientIPResolver accepts addresses and CIDR ranges of trusted proxies.
+// Without trusted proxies, forwarded entries are ignored, as anyone can send
+// them. If useForwarded is set, entries are read from the Forwarded header
+// (RFC 7239) when the request has one.
+func NewClientIPResolver(trustedProxies []string, useForwarded bool) (*ClientIPResolver, error) {
+	c := &ClientIPResolver{useForwarded: useForwarded}
+	for _, p := range trustedProxies {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(p)
+			if err2 != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", p, err)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		c.trustedProxies = append(c.trustedProxies, prefix.Masked())
+	}
+	return c, nil
+}
+
+func (c *ClientIPResolver) trusted(addr netip.Addr) bool {
+	for _, p := range c.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// hops returns addresses the request was forwarded for, in the order
+// proxies added them. Entries which aren't addresses are kept as the zero Addr.
+func (c *ClientIPResolver) hops(r *http.Request) []netip.Addr {
+	var hops []netip.Addr
+	if forwarded := r.Header.Values("Forwarded"); c != nil && c.useForwarded && len(forwarded) > 0 {
+		for _, v := range forwarded {
+			for _, element := range strings.Split(v, ",") {
+				hops = append(hops, parseForwardedFor(element))
+			}
+		}
+		return hops
+	}
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, parseClientAddr(hop))
+		}
+	}
+	return hops
+}
+
+// parseForwardedFor returns the address of the for parameter of an element
+// of the Forwarded header, such as `for=192.0.2.60;proto=http` or
+// `for="[2001:db8::1]:4711"`. Obfuscated identifiers and "unknown" yield the zero Addr.
+func parseForwardedFor(element string) netip.Addr {
+	for _, pair := range strings.Split(element, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || !strings.EqualFold(name, "for") {
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		if strings.HasPrefix(value, "[") {
+			end := strings.Index(value, "]")
+			if end < 0 {
+				return netip.Addr{}
+			}
+			return parseClientAddr(value[1:end])
+		}
+		if h, _, err := net.SplitHostPort(value); err == nil {
+			value = h
+		}
+		return parseClientAddr(value)
+	}
+	return netip.Addr{}
+}
+
+// ClientIP returns the address of the client. It's the remote address
+// unless it's a trusted proxy, in which case forwarded entries are walked
+// from the last one, skipping trusted proxies.
+// The zero Addr is returned if the address can't be parsed.
+func (c *ClientIPResolver) ClientIP(r *http.Request) netip.Addr {
+	remote := parseClientAddr(r.RemoteAddr)
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		remote = parseClientAddr(h)
+	}
+	if c == nil || !remote.IsValid() || !c.trusted(remote) {
+		return remote
+	}
+	hops := c.hops(r)
+	addr := remote
+	for i := len(hops) - 1; i >= 0 && c.trusted(addr); i-- {
+		hop := hops[i]
+		if !hop.IsValid() {
+			// Entries before a malformed one can't be trusted either
+			break
+		}
+		addr = hop
+	}
+	return addr
+}
+
+func parseClientAddr(s string) netip.Addr {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// RawRemoteAddr returns the header the client address is read from as
+// received, or the address of the connection if there's none.
+// It's stored along with the client address.
+func (c *ClientIPResolver) RawRemoteAddr(r *http.Request) string {
+	if forwarded := r.Header.Values("Forwarded"); c != nil && c.useForwarded && len(forwarded) > 0 {
+		return strings.Join(forwarded, ", ")
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		return strings.Join(xff, ", ")
+	}
+	return r.RemoteAddr
+}
+
+// NormalizeRemoteAddr extracts the client address out of remote_addr stored
+// before client_ip was, taking the last X-Forwarded-For entry and dropping
+// the port. Returns an empty string if there's no address.
+func NormalizeRemoteAddr(remoteAddr string) string {
+	hops := strings.Split(remoteAddr, ",")
+	host := strings.TrimSpace(hops[len(hops)-1])
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if addr := parseClientAddr(host); addr.IsValid() {
+		return addr.String()
+	}
+	return ""
+}
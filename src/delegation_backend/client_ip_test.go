@@ -0,0 +1,119 @@
+package delegation_backend
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestClientIPWithoutTrustedProxies(t *testing.T) {
+	defaultResolver, err := NewClientIPResolver(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwardedResolver, err := NewClientIPResolver(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Forwarding headers can be sent by anyone, so they're ignored
+	for _, resolver := range []*ClientIPResolver{nil, defaultResolver, forwardedResolver} {
+		req := httptest.NewRequest("POST", v1Submit, nil)
+		if addr := resolver.ClientIP(req); addr != netip.MustParseAddr("192.0.2.1") {
+			t.Fatalf("unexpected address without X-Forwarded-For: %v", addr)
+		}
+		req.Header.Add("X-Forwarded-For", "203.0.113.1, 198.51.100.7")
+		req.Header.Add("Forwarded", "for=198.51.100.8")
+		if addr := resolver.ClientIP(req); addr != netip.MustParseAddr("192.0.2.1") {
+			t.Fatalf("expected forwarding headers to be ignored, got %v", addr)
+		}
+	}
+}
+
+func TestClientIPWithTrustedProxies(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"192.0.2.0/24", "10.0.0.1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remoteAddr string
+		xff        []string
+		expected   string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"203.0.113.1, 198.51.100.7"}, "198.51.100.7"},
+		{"192.0.2.1:1234", []string{"198.51.100.7, 10.0.0.1"}, "198.51.100.7"},
+		{"192.0.2.1:1234", []string{"198.51.100.7", "10.0.0.1"}, "198.51.100.7"},
+		// Entries sent by a client which isn't a trusted proxy are ignored
+		{"203.0.113.9:1234", []string{"198.51.100.7"}, "203.0.113.9"},
+		// All entries are trusted proxies
+		{"192.0.2.1:1234", []string{"10.0.0.1, 192.0.2.2"}, "10.0.0.1"},
+		// Entries before a malformed one aren't trusted
+		{"192.0.2.1:1234", []string{"198.51.100.7, unknown"}, "192.0.2.1"},
+		{"[::ffff:192.0.2.1]:1234", []string{"198.51.100.7"}, "198.51.100.7"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", v1Submit, nil)
+		req.RemoteAddr = test.remoteAddr
+		for _, v := range test.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if addr := resolver.ClientIP(req); addr != netip.MustParseAddr(test.expected) {
+			t.Errorf("expected %s for %s with %v, got %v", test.expected, test.remoteAddr, test.xff, addr)
+		}
+	}
+}
+
+func TestInvalidTrustedProxy(t *testing.T) {
+	if _, err := NewClientIPResolver([]string{"10.0.0.0/8", "proxy"}, false); err == nil {
+		t.Fatal("expected invalid trusted proxy to be rejected")
+	}
+}
+
+func TestClientIPWithForwarded(t *testing.T) {
+	resolver, err := NewClientIPResolver([]string{"192.0.2.0/24"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		forwarded []string
+		expected  string
+	}{
+		{[]string{"for=198.51.100.7"}, "198.51.100.7"},
+		{[]string{`for="198.51.100.7:4711";proto=https`}, "198.51.100.7"},
+		{[]string{`For="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{[]string{"for=203.0.113.1, for=198.51.100.7;by=192.0.2.2", "for=192.0.2.3"}, "198.51.100.7"},
+		// Obfuscated identifiers aren't addresses, the trusted proxy is the client then
+		{[]string{"for=_hidden"}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", v1Submit, nil)
+		for _, v := range test.forwarded {
+			req.Header.Add("Forwarded", v)
+		}
+		// Ignored in favour of Forwarded
+		req.Header.Add("X-Forwarded-For", "203.0.113.9")
+		if addr := resolver.ClientIP(req); addr != netip.MustParseAddr(test.expected) {
+			t.Errorf("expected %s for %v, got %v", test.expected, test.forwarded, addr)
+		}
+		if raw := resolver.RawRemoteAddr(req); raw != strings.Join(test.forwarded, ", ") {
+			t.Errorf("unexpected raw remote address: %s", raw)
+		}
+	}
+}
+
+func TestNormalizeRemoteAddr(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1:1234":              "192.0.2.1",
+		"[2001:db8::1]:1234":          "2001:db8::1",
+		"203.0.113.1, 198.51.100.7":   "198.51.100.7",
+		"203.0.113.1,::ffff:10.0.0.1": "10.0.0.1",
+		"":                            "",
+		"unknown":                     "",
+	}
+	for remoteAddr, expected := range tests {
+		if addr := NormalizeRemoteAddr(remoteAddr); addr != expected {
+			t.Errorf("expected %q for %q, got %q", expected, remoteAddr, addr)
+		}
+	}
+}
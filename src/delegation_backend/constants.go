@@ -9,9 +9,23 @@ import (
 )
 
 const MAX_SUBMIT_PAYLOAD_SIZE = 50000000 // max payload size in bytes
+const MAX_SUBMIT_BATCH_SIZE = 100        // max number of submissions in a batch
 const DELEGATION_BACKEND_LISTEN_TO = ":8080"
 const TIME_DIFF_DELTA time.Duration = -5 * 60 * 1000000000 // -5m
 const WHITELIST_REFRESH_INTERVAL = 10 * 60 * 1000000000    // 10m
+const SAVE_RETRY_AFTER = "60"                              // seconds, sent when a submission couldn't be stored
+const DEFAULT_HEALTH_CHECK_TIMEOUT = 5 * time.Second
+const DEFAULT_SHUTDOWN_DRAIN_TIMEOUT = 30 // seconds given to in-flight requests on shutdown
+const WHITELIST_MAX_MISSED_REFRESHES = 3  // whitelist is considered stale after that many refresh intervals
+const MAX_ADMIN_REQUEST_SIZE = 1 << 20    // max size of admin API request body in bytes
+
+// Server timeouts used unless configured otherwise, reading
+// a body of MAX_SUBMIT_PAYLOAD_SIZE should fit into them
+const DEFAULT_SERVER_READ_HEADER_TIMEOUT = 10 * time.Second
+const DEFAULT_SERVER_READ_TIMEOUT = 120 * time.Second
+const DEFAULT_SERVER_WRITE_TIMEOUT = 150 * time.Second
+const DEFAULT_SERVER_IDLE_TIMEOUT = 120 * time.Second
+const TLS_CERT_RELOAD_INTERVAL = 30 * time.Second
 
 var PK_PREFIX = [...]byte{1, 1}
 var SIG_PREFIX = [...]byte{1}
@@ -0,0 +1,95 @@
+package delegation_backend
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed submissions may be decompressed to at most that many times
+// their size (and MAX_SUBMIT_PAYLOAD_SIZE), which is well above the ratio
+// of base64-encoded blocks, so that a small request can't inflate to
+// a large one (a zip bomb)
+const MAX_COMPRESSION_RATIO = 20
+
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+var errDecodedTooLarge = errors.New("decoded request is too large")
+
+// requestEncoding returns the Content-Encoding in h, "" if it isn't compressed.
+func requestEncoding(h http.Header) string {
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Encoding")))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// decodedSizeLimit returns the maximum size of a body of contentLength
+// bytes once decoded according to encoding.
+func decodedSizeLimit(encoding string, contentLength int64) int64 {
+	if encoding == "" {
+		return contentLength
+	}
+	limit := contentLength * MAX_COMPRESSION_RATIO
+	if limit > MAX_SUBMIT_PAYLOAD_SIZE {
+		limit = MAX_SUBMIT_PAYLOAD_SIZE
+	}
+	return limit
+}
+
+// newContentDecoder returns a reader of body decoded according to encoding,
+// failing with errDecodedTooLarge once more than limit bytes are decoded.
+// Returns errUnsupportedEncoding for encodings other than gzip and zstd.
+func newContentDecoder(encoding string, body io.Reader, limit int64) (io.ReadCloser, error) {
+	var decoder io.ReadCloser
+	switch encoding {
+	case "":
+		decoder = io.NopCloser(body)
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		decoder = gz
+	case "zstd":
+		zr, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			// Bounds the window of the stream
+			zstd.WithDecoderMaxMemory(uint64(limit)))
+		if err != nil {
+			return nil, err
+		}
+		decoder = zr.IOReadCloser()
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	return &sizeLimitedReader{ReadCloser: decoder, remaining: limit}, nil
+}
+
+// sizeLimitedReader fails with errDecodedTooLarge, rather than
+// returning io.EOF as io.LimitReader does, once the limit is exceeded.
+type sizeLimitedReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), errDecodedTooLarge
+	}
+	// zstd refuses frames declaring a size or window above the limit upfront
+	if errors.Is(err, zstd.ErrDecoderSizeExceeded) || errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		err = errDecodedTooLarge
+	}
+	return n, err
+}
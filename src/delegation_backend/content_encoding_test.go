@@ -0,0 +1,113 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipBody(body []byte, t *testing.T) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstdBody(body []byte, t *testing.T) []byte {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(body, nil)
+}
+
+func (sh *SubmitH) testEncodedRequest(body []byte, encoding string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", v1Submit, bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", encoding)
+	sh.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestCompressedSubmission(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	compress := map[string]func([]byte, *testing.T) []byte{
+		"gzip": gzipBody,
+		"zstd": zstdBody,
+	}
+	for encoding, f := range compress {
+		objs, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+		if rep := sh.testEncodedRequest(f(body, t), encoding); rep.Code != 200 {
+			t.Fatalf("unexpected failure of %s submission: %v", encoding, rep)
+		}
+		if len(*objs) != 2 {
+			t.Fatalf("expected %s submission to be saved, got %d objects", encoding, len(*objs))
+		}
+		for _, o := range *objs {
+			if bytes.Equal(o, req.Data.Block.data) {
+				continue
+			}
+			var meta MetaToBeSaved
+			if err := json.Unmarshal(o, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.BlockHash != req.GetBlockDataHash() {
+				t.Fatalf("unexpected block hash of %s submission: %s", encoding, meta.BlockHash)
+			}
+		}
+	}
+}
+
+func TestCompressedSubmissionTooLarge(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	// Padding compresses far better than MAX_COMPRESSION_RATIO
+	bomb := append(bytes.Repeat([]byte(" "), MAX_COMPRESSION_RATIO*len(body)), body...)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	sh.app.MemoryBudget = NewMemoryBudget(0)
+	if rep := sh.testEncodedRequest(gzipBody(bomb, t), "gzip"); rep.Code != 413 {
+		t.Fatalf("expected gzip bomb to be refused, got %v", rep)
+	}
+	if rep := sh.testEncodedRequest(zstdBody(bomb, t), "zstd"); rep.Code != 413 {
+		t.Fatalf("expected zstd bomb to be refused, got %v", rep)
+	}
+	if used := sh.app.MemoryBudget.Used(); used != 0 {
+		t.Fatalf("memory reserved by the request wasn't released: %d", used)
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	if rep := sh.testEncodedRequest(body, "br"); rep.Code != 415 {
+		t.Fatalf("expected unsupported encoding to be refused, got %v", rep)
+	}
+	if rep := sh.testEncodedRequest(body, "gzip"); rep.Code != 400 {
+		t.Fatalf("expected body which isn't gzip to be refused, got %v", rep)
+	}
+}
+
+func TestDecodedSizeLimit(t *testing.T) {
+	if l := decodedSizeLimit("", 100); l != 100 {
+		t.Fatalf("unexpected limit of identity encoding: %d", l)
+	}
+	if l := decodedSizeLimit("gzip", 100); l != 100*MAX_COMPRESSION_RATIO {
+		t.Fatalf("unexpected limit of gzip encoding: %d", l)
+	}
+	if l := decodedSizeLimit("zstd", MAX_SUBMIT_PAYLOAD_SIZE); l != MAX_SUBMIT_PAYLOAD_SIZE {
+		t.Fatalf("limit should not exceed MAX_SUBMIT_PAYLOAD_SIZE: %d", l)
+	}
+}
@@ -106,6 +106,10 @@ func (d *Base64) UnmarshalJSON(b []byte) error {
 	return err
 }
 func (d *Base64) MarshalJSON() ([]byte, error) {
+	if d.json == nil {
+		// Decoded from /v2/submit request, which carries raw bytes
+		return json.Marshal(base64.StdEncoding.EncodeToString(d.data))
+	}
 	return d.json, nil
 }
 
@@ -133,10 +137,12 @@ type MetaToBeSaved struct {
 	PeerId             string  `json:"peer_id"`
 	SnarkWork          *Base64 `json:"snark_work,omitempty"`
 	RemoteAddr         string  `json:"remote_addr"`
-	Submitter          Pk      `json:"submitter"`  // is base58check-encoded submitter's public key
-	BlockHash          string  `json:"block_hash"` // is base58check-encoded hash of a block
+	ClientIP           string  `json:"client_ip,omitempty"` // normalized client address, see ClientIPResolver
+	Submitter          Pk      `json:"submitter"`           // is base58check-encoded submitter's public key
+	BlockHash          string  `json:"block_hash"`          // is base58check-encoded hash of a block
 	GraphqlControlPort int     `json:"graphql_control_port,omitempty"`
 	BuiltWithCommitSha string  `json:"built_with_commit_sha,omitempty"`
+	Batched            bool    `json:"batched,omitempty"` // sent in /v1/submit/batch, possibly long after created_at
 }
 
 type submitRequestData struct {
@@ -158,15 +164,30 @@ func (req submitRequest) GetBlockDataHash() string {
 	return base58.CheckEncode(blockHashBytes[:], BASE58CHECK_VERSION_BLOCK_HASH)
 }
 
+// The sign payload starts with the block, so that it can be
+// hashed while the block is decoded, see submitDecoder
+const SIGN_PAYLOAD_PREFIX = "{\"block\":"
+
 func (req submitRequestData) MakeSignPayload() ([]byte, error) {
+	tail, err := req.signPayloadTail()
+	if err != nil {
+		return nil, err
+	}
+	signPayload := new(BufferOrError)
+	signPayload.WriteString(SIGN_PAYLOAD_PREFIX)
+	signPayload.Write(req.Block.json)
+	signPayload.Write(tail)
+	return signPayload.Buf.Bytes(), signPayload.Err
+}
+
+// signPayloadTail returns the sign payload following the block.
+func (req submitRequestData) signPayloadTail() ([]byte, error) {
 	createdAtStr := req.CreatedAt.UTC().Format(time.RFC3339)
 	createdAtJson, err2 := json.Marshal(createdAtStr)
 	if err2 != nil {
 		return nil, err2
 	}
 	signPayload := new(BufferOrError)
-	signPayload.WriteString("{\"block\":")
-	signPayload.Write(req.Block.json)
 	signPayload.WriteString(",\"created_at\":")
 	signPayload.Write(createdAtJson)
 	signPayload.WriteString(",\"peer_id\":\"")
@@ -189,16 +210,27 @@ func (req submitRequestData) MakeSignPayload() ([]byte, error) {
 	return signPayload.Buf.Bytes(), signPayload.Err
 }
 
-func (req submitRequest) MakeMetaToBeSaved(remoteAddr string) ([]byte, error) {
+// ClientAddr returns the address of the client, derived from remote_addr
+// for submissions stored without client_ip.
+func (meta MetaToBeSaved) ClientAddr() string {
+	if meta.ClientIP != "" {
+		return meta.ClientIP
+	}
+	return NormalizeRemoteAddr(meta.RemoteAddr)
+}
+
+func (req submitRequest) MakeMetaToBeSaved(blockHash string, remoteAddr string, clientIP string, batched bool) ([]byte, error) {
 	meta := MetaToBeSaved{
 		CreatedAt:          req.Data.CreatedAt.Format(time.RFC3339),
 		PeerId:             req.Data.PeerId,
 		SnarkWork:          req.Data.SnarkWork,
 		RemoteAddr:         remoteAddr,
-		BlockHash:          req.GetBlockDataHash(),
+		ClientIP:           clientIP,
+		BlockHash:          blockHash,
 		Submitter:          req.Submitter,
 		GraphqlControlPort: req.Data.GraphqlControlPort,
 		BuiltWithCommitSha: req.Data.BuiltWithCommitSha,
+		Batched:            batched,
 	}
 
 	return json.Marshal(meta)
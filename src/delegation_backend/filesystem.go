@@ -0,0 +1,89 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type LocalFileSystemContext struct {
+	Directory string
+	Log       logging.StandardLogger
+}
+
+// NewLocalFileSystemStorage creates the local file system storage backend if it is configured.
+func NewLocalFileSystemStorage(_ context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (Storage, error) {
+	if appCfg.LocalFileSystem == nil {
+		return nil, nil
+	}
+	return &LocalFileSystemContext{Directory: appCfg.LocalFileSystem.Path, Log: log}, nil
+}
+
+func LocalFileSystemSave(objs ObjectsToSave, directory string, log logging.StandardLogger) error {
+	var errs []error
+	for path, bs := range objs {
+		fullPath := filepath.Join(directory, path)
+
+		// Check if file exists
+		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+			log.Warnf("LocalFileSystemSave: file already exists: %s", fullPath)
+			continue // skip to the next object
+		}
+
+		err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
+		if err != nil {
+			log.Errorf("LocalFileSystemSave: Error creating directories for %s: %v", fullPath, err)
+			errs = append(errs, fmt.Errorf("error creating directories for %s: %w", fullPath, err))
+			continue // skip to the next object
+		}
+		log.Infof("LocalFileSystemSave: saving %s", fullPath)
+		err = os.WriteFile(fullPath, bs, 0644)
+		if err != nil {
+			log.Warnf("Error writing to file %s: %v", fullPath, err)
+			errs = append(errs, fmt.Errorf("error writing to file %s: %w", fullPath, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ctx *LocalFileSystemContext) Name() string {
+	return "filesystem"
+}
+
+func (ctx *LocalFileSystemContext) Save(objs ObjectsToSave) error {
+	return LocalFileSystemSave(objs, ctx.Directory, ctx.Log)
+}
+
+func (ctx *LocalFileSystemContext) Exists(path string) (bool, error) {
+	_, err := os.Stat(filepath.Join(ctx.Directory, path))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (ctx *LocalFileSystemContext) HealthCheck() error {
+	info, err := os.Stat(ctx.Directory)
+	if os.IsNotExist(err) {
+		// Directory is created lazily on the first save
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", ctx.Directory)
+	}
+	return nil
+}
+
+func (ctx *LocalFileSystemContext) Close() error {
+	return nil
+}
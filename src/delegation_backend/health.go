@@ -1,8 +1,18 @@
 package delegation_backend
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthStatusOk          = "ok"
+	healthStatusUnavailable = "unavailable"
 )
 
 // HealthStatus represents the JSON response structure for the /health endpoint
@@ -15,10 +25,183 @@ func HealthHandler(isReady func() bool) http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		if isReady() {
 			rw.WriteHeader(http.StatusOK)
-			json.NewEncoder(rw).Encode(HealthStatus{Status: "ok"})
+			json.NewEncoder(rw).Encode(HealthStatus{Status: healthStatusOk})
+		} else {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(rw).Encode(HealthStatus{Status: healthStatusUnavailable})
+		}
+	}
+}
+
+// LivenessHandler handles the /health/live endpoint, it succeeds as long as
+// the process is able to serve requests.
+func LivenessHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		json.NewEncoder(rw).Encode(HealthStatus{Status: healthStatusOk})
+	}
+}
+
+// HealthComponent is a dependency checked to decide whether the service is ready.
+type HealthComponent struct {
+	Name string
+	// Critical components make the service unready when their check fails,
+	// failures of the other ones are only reported.
+	Critical bool
+	Check    func() error
+}
+
+// ComponentStatus is the outcome of the latest check of a component.
+type ComponentStatus struct {
+	Status        string     `json:"status"`
+	Critical      bool       `json:"critical"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorAt   *time.Time `json:"last_error_at,omitempty"`
+	LastCheckedAt *time.Time `json:"last_checked_at,omitempty"`
+}
+
+// ReadinessStatus represents the JSON response structure for the /health/ready endpoint
+type ReadinessStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+type componentState struct {
+	HealthComponent
+	mutex    sync.Mutex
+	status   ComponentStatus
+	inflight chan struct{}
+}
+
+// Readiness aggregates checks of the components the service depends on.
+type Readiness struct {
+	isReady    func() bool
+	timeout    time.Duration
+	mutex      sync.RWMutex
+	components []*componentState
+}
+
+// NewReadiness creates readiness checks gated by isReady (which reports
+// whether the service finished starting up and isn't shutting down).
+// Checks not finished within timeout are reported as failed.
+func NewReadiness(isReady func() bool, timeout time.Duration) *Readiness {
+	return &Readiness{isReady: isReady, timeout: timeout}
+}
+
+func (rd *Readiness) Add(c HealthComponent) {
+	rd.mutex.Lock()
+	defer rd.mutex.Unlock()
+	rd.components = append(rd.components, &componentState{
+		HealthComponent: c,
+		status:          ComponentStatus{Status: healthStatusUnavailable, Critical: c.Critical},
+	})
+}
+
+// start runs the check unless the previous one is still in progress,
+// returning a channel closed once the check completes.
+func (c *componentState) start() <-chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inflight != nil {
+		return c.inflight
+	}
+	done := make(chan struct{})
+	c.inflight = done
+	go func() {
+		err := c.Check()
+		c.mutex.Lock()
+		c.record(err)
+		c.inflight = nil
+		c.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// record updates the status, must be called with the mutex held.
+func (c *componentState) record(err error) {
+	now := time.Now()
+	c.status.LastCheckedAt = &now
+	if err == nil {
+		c.status.Status = healthStatusOk
+		return
+	}
+	c.status.Status = healthStatusUnavailable
+	c.status.LastError = err.Error()
+	c.status.LastErrorAt = &now
+}
+
+// Check runs all component checks in parallel and reports the result.
+func (rd *Readiness) Check(ctx context.Context) (ready bool, status ReadinessStatus) {
+	rd.mutex.RLock()
+	components := rd.components
+	rd.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+	dones := make([]<-chan struct{}, len(components))
+	for i, c := range components {
+		dones[i] = c.start()
+	}
+	ready = rd.isReady()
+	status.Components = make(map[string]ComponentStatus, len(components))
+	for i, c := range components {
+		select {
+		case <-dones[i]:
+		case <-ctx.Done():
+		}
+		c.mutex.Lock()
+		if c.inflight == dones[i] {
+			c.record(fmt.Errorf("health check timed out after %v", rd.timeout))
+		}
+		cs := c.status
+		c.mutex.Unlock()
+		if c.Critical && cs.Status != healthStatusOk {
+			ready = false
+		}
+		status.Components[c.Name] = cs
+	}
+	status.Status = healthStatusUnavailable
+	if ready {
+		status.Status = healthStatusOk
+	}
+	return
+}
+
+// ReadinessHandler handles the /health/ready endpoint, responding with
+// a breakdown of the component statuses.
+func (rd *Readiness) ReadinessHandler() http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		ready, status := rd.Check(r.Context())
+		rw.Header().Set("Content-Type", "application/json")
+		if ready {
+			rw.WriteHeader(http.StatusOK)
 		} else {
 			rw.WriteHeader(http.StatusServiceUnavailable)
-			json.NewEncoder(rw).Encode(HealthStatus{Status: "unavailable"})
 		}
+		json.NewEncoder(rw).Encode(status)
+	}
+}
+
+// WhitelistHealthCheck fails if no whitelist was loaded out of the source for
+// WHITELIST_MAX_MISSED_REFRESHES refresh intervals. Whitelists refused by
+// WhitelistGuard count as loaded, they are reported by WhitelistGuardHealthCheck.
+func WhitelistHealthCheck(wl *WhitelistMVar, refreshInterval time.Duration, now nowFunc) func() error {
+	return func() error {
+		loadedAt := wl.LastLoad()
+		if loadedAt.IsZero() {
+			return errors.New("whitelist was never loaded")
+		}
+		age := now().Sub(loadedAt)
+		if age > WHITELIST_MAX_MISSED_REFRESHES*refreshInterval {
+			return fmt.Errorf("whitelist was last loaded %v ago, refresh interval is %v", age.Truncate(time.Second), refreshInterval)
+		}
+		return nil
 	}
 }
+
+// WhitelistGuardHealthCheck fails while the latest loaded whitelist is
+// refused by WhitelistGuard and the previous one is kept in use.
+func WhitelistGuardHealthCheck(wl *WhitelistMVar) func() error {
+	return wl.Rejection
+}
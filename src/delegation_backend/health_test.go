@@ -1,9 +1,13 @@
 package delegation_backend
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Mock App structure with IsReady flag
@@ -79,3 +83,95 @@ func TestHealthEndpointTransition(t *testing.T) {
 	}
 
 }
+
+func TestLivenessEndpoint(t *testing.T) {
+	rr := httptest.NewRecorder()
+	LivenessHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/health/live", nil))
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func readinessRequest(t *testing.T, rd *Readiness) (int, ReadinessStatus) {
+	rr := httptest.NewRecorder()
+	rd.ReadinessHandler().ServeHTTP(rr, httptest.NewRequest("GET", "/health/ready", nil))
+	var status ReadinessStatus
+	if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode readiness response: %v", err)
+	}
+	return rr.Code, status
+}
+
+// TestReadinessComponents tests that only failures of critical components make the service unready.
+func TestReadinessComponents(t *testing.T) {
+	var ready atomic.Bool
+	ready.Store(true)
+	var dbDown atomic.Bool
+	dbDown.Store(true)
+	rd := NewReadiness(ready.Load, time.Second)
+	rd.Add(HealthComponent{Name: "postgresql", Critical: true, Check: func() error {
+		if dbDown.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}})
+	rd.Add(HealthComponent{Name: "aws_s3", Critical: false, Check: func() error { return errors.New("forbidden") }})
+
+	code, status := readinessRequest(t, rd)
+	if code != http.StatusServiceUnavailable || status.Status != "unavailable" {
+		t.Errorf("expected service to be unavailable, got %v %v", code, status.Status)
+	}
+	pg := status.Components["postgresql"]
+	if pg.Status != "unavailable" || pg.LastError != "connection refused" || pg.LastErrorAt == nil {
+		t.Errorf("unexpected postgresql status: %+v", pg)
+	}
+
+	dbDown.Store(false)
+	code, status = readinessRequest(t, rd)
+	if code != http.StatusOK || status.Status != "ok" {
+		t.Errorf("expected service to be ready, got %v %v", code, status.Status)
+	}
+	pg = status.Components["postgresql"]
+	if pg.Status != "ok" || pg.LastError != "connection refused" {
+		t.Errorf("expected last error to be kept after recovery: %+v", pg)
+	}
+	if s3 := status.Components["aws_s3"]; s3.Status != "unavailable" || s3.Critical {
+		t.Errorf("unexpected aws_s3 status: %+v", s3)
+	}
+
+	ready.Store(false)
+	if code, _ = readinessRequest(t, rd); code != http.StatusServiceUnavailable {
+		t.Errorf("expected service not to be ready while starting up, got %v", code)
+	}
+}
+
+func TestReadinessTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	rd := NewReadiness(func() bool { return true }, 10*time.Millisecond)
+	rd.Add(HealthComponent{Name: "aws_keyspaces", Critical: true, Check: func() error {
+		<-release
+		return nil
+	}})
+	code, status := readinessRequest(t, rd)
+	if code != http.StatusServiceUnavailable || status.Components["aws_keyspaces"].LastError == "" {
+		t.Errorf("expected hanging check to time out, got %v %+v", code, status)
+	}
+}
+
+func TestWhitelistHealthCheck(t *testing.T) {
+	wl := new(WhitelistMVar)
+	now := time.Now()
+	check := WhitelistHealthCheck(wl, time.Minute, func() time.Time { return now })
+	if check() == nil {
+		t.Error("expected whitelist which was never loaded to be unhealthy")
+	}
+	wl.Replace(&Whitelist{})
+	if err := check(); err != nil {
+		t.Errorf("expected fresh whitelist to be healthy: %v", err)
+	}
+	now = now.Add(WHITELIST_MAX_MISSED_REFRESHES*time.Minute + time.Second)
+	if check() == nil {
+		t.Error("expected stale whitelist to be unhealthy")
+	}
+}
@@ -0,0 +1,107 @@
+package delegation_backend
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const DEFAULT_SUBMIT_MEMORY_BUDGET = 256 // MB
+const MEMORY_BUDGET_RETRY_AFTER = "5"    // seconds, sent when a request doesn't fit into the budget
+const DEFAULT_SUBMIT_BODY_READ_TIMEOUT = 30 * time.Second
+
+var errMemoryBudget = errors.New("memory budget exhausted")
+
+// MemoryBudget caps the memory used by requests being decoded at once,
+// each of them reserving the bytes of its body as they're read, for the
+// time it's handled. A nil budget admits every request.
+type MemoryBudget struct {
+	mutex sync.Mutex
+	limit int64
+	used  int64
+}
+
+// NewMemoryBudget uses DEFAULT_SUBMIT_MEMORY_BUDGET if megabytes is 0 and
+// returns nil if it's negative. The budget admits at least one request of
+// MAX_SUBMIT_PAYLOAD_SIZE.
+func NewMemoryBudget(megabytes int) *MemoryBudget {
+	if megabytes < 0 {
+		return nil
+	}
+	if megabytes == 0 {
+		megabytes = DEFAULT_SUBMIT_MEMORY_BUDGET
+	}
+	limit := int64(megabytes) << 20
+	if limit < MAX_SUBMIT_PAYLOAD_SIZE {
+		limit = MAX_SUBMIT_PAYLOAD_SIZE
+	}
+	return &MemoryBudget{limit: limit}
+}
+
+// SubmitBodyReadTimeout is how long a submission's body may take to be read,
+// and so to hold its reservation while it's sent, DEFAULT_SUBMIT_BODY_READ_TIMEOUT
+// if seconds is 0, without a deadline besides the server's if it's negative.
+func SubmitBodyReadTimeout(seconds int) time.Duration {
+	return maxAge(seconds, DEFAULT_SUBMIT_BODY_READ_TIMEOUT)
+}
+
+// TryReserve reserves size bytes, returning false if they don't fit
+// into the budget. Reserved bytes are given back with Release.
+func (b *MemoryBudget) TryReserve(size int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.used+size > b.limit {
+		return false
+	}
+	b.used += size
+	return true
+}
+
+func (b *MemoryBudget) Release(size int64) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= size
+}
+
+// Used returns the number of bytes reserved.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used
+}
+
+// budgetReader reserves bytes read from r in budget as they arrive, so that a
+// request holds as much of the budget as it has sent rather than as much as
+// it declared. Reading fails with errMemoryBudget once a read doesn't fit.
+type budgetReader struct {
+	r        io.Reader
+	budget   *MemoryBudget
+	reserved int64
+}
+
+func (b *budgetReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if n > 0 {
+		if !b.budget.TryReserve(int64(n)) {
+			return 0, errMemoryBudget
+		}
+		b.reserved += int64(n)
+	}
+	return n, err
+}
+
+// release gives back the bytes reserved so far.
+func (b *budgetReader) release() {
+	b.budget.Release(b.reserved)
+	b.reserved = 0
+}
@@ -0,0 +1,285 @@
+package delegation_backend
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE = "delegation_backend"
+
+// Reasons for rejecting a submission, used as label values
+const (
+	rejectionLengthRequired      = "length_required"
+	rejectionPayloadTooLarge     = "payload_too_large"
+	rejectionUnsupportedEncoding = "unsupported_encoding"
+	rejectionMalformed           = "malformed"
+	rejectionMissingFields       = "missing_fields"
+	rejectionNotWhitelisted      = "not_whitelisted"
+	rejectionOutsideEnrollment   = "outside_enrollment"
+	rejectionBlocked             = "blocked"
+	rejectionFutureCreatedAt     = "future_created_at"
+	rejectionStaleCreatedAt      = "stale_created_at"
+	rejectionReplayed            = "replayed"
+	rejectionDuplicate           = "duplicate"
+	rejectionInvalidSignature    = "invalid_signature"
+	rejectionRateLimited         = "rate_limited"
+	rejectionIPRateLimited       = "ip_rate_limited"
+	rejectionPeerRateLimited     = "peer_rate_limited"
+	rejectionGlobalRateLimited   = "global_rate_limited"
+	rejectionStorageBusy         = "storage_busy"
+	rejectionMemoryBudget        = "memory_budget"
+	rejectionStorageFailure      = "storage_failure"
+	rejectionInternalError       = "internal_error"
+)
+
+const (
+	signatureCacheHit  = "hit"
+	signatureCacheMiss = "miss"
+)
+
+const (
+	httpHandlerLabel    = "handler"
+	rejectionLabel      = "reason"
+	storageBackendLabel = "backend"
+	cacheResultLabel    = "result"
+)
+
+var (
+	httpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by handler and response status code.",
+	}, []string{httpHandlerLabel, "code"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent handling HTTP requests by handler.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{httpHandlerLabel})
+
+	submissionRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "submission_rejections_total",
+		Help:      "Number of rejected submissions by reason.",
+	}, []string{rejectionLabel})
+
+	storageSaveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "storage_save_duration_seconds",
+		Help:      "Time spent saving a submission by storage backend.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{storageBackendLabel})
+
+	storageSaveErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "storage_save_errors_total",
+		Help:      "Number of failed submission saves by storage backend.",
+	}, []string{storageBackendLabel})
+
+	spoolDeadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "spool_dead_letters_total",
+		Help:      "Number of spooled submissions moved to dead letters after being refused by a storage backend.",
+	}, []string{storageBackendLabel})
+
+	signatureCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "signature_cache_lookups_total",
+		Help:      "Number of signature cache lookups by result (hit or miss).",
+	}, []string{cacheResultLabel})
+
+	attemptCounterEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "attempt_counter_evictions_total",
+		Help:      "Number of idle public keys no longer tracked by the rate limiter.",
+	})
+
+	attemptCounterFullTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "attempt_counter_full_total",
+		Help:      "Number of new keys refused because the rate limiter tracks the maximum number of keys, none of which can be evicted without losing attempts.",
+	})
+
+	tokenBucketEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "token_bucket_evictions_total",
+		Help:      "Number of client addresses and peer ids no longer limited to make room for new ones.",
+	})
+
+	tokenBucketFullTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "token_bucket_full_total",
+		Help:      "Number of requests of new client addresses and peer ids refused because the maximum number of them is limited, none of which can be dropped without resetting its limit.",
+	})
+
+	replayCacheErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "replay_cache_errors_total",
+		Help:      "Number of submissions let through because the shared replay cache failed.",
+	})
+
+	rateLimiterErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "rate_limiter_errors_total",
+		Help:      "Number of attempts let through because the shared rate limiter failed.",
+	})
+
+	whitelistSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_size",
+		Help:      "Number of public keys in the delegation whitelist.",
+	})
+
+	whitelistChangesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_changes_total",
+		Help:      "Number of public keys added to, removed from or updated in the delegation whitelist.",
+	}, []string{"change"})
+
+	whitelistRowsRejectedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_rows_rejected_total",
+		Help:      "Number of whitelist rows with a valid public key left out due to a malformed enrollment window.",
+	})
+
+	whitelistRefreshRejectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_refresh_rejections_total",
+		Help:      "Number of loaded whitelists refused by safety thresholds, by reason.",
+	}, []string{rejectionLabel})
+
+	whitelistRefreshRejected = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_refresh_rejected",
+		Help:      "Whether the last loaded whitelist was refused by safety thresholds (1) or applied (0).",
+	})
+
+	whitelistLastRefresh = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "whitelist_last_refresh_timestamp_seconds",
+		Help:      "Unix time of the last successful whitelist refresh.",
+	})
+)
+
+func recordRejection(reason string) {
+	submissionRejectionsTotal.WithLabelValues(reason).Inc()
+}
+
+// InstrumentHandler counts requests and measures their duration under the given handler name.
+func InstrumentHandler(name string, h http.Handler) http.Handler {
+	labels := prometheus.Labels{httpHandlerLabel: name}
+	return promhttp.InstrumentHandlerDuration(httpRequestDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(httpRequestsTotal.MustCurryWith(labels), h))
+}
+
+// MetricsHandler serves metrics in the Prometheus exposition format.
+func MetricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterMetrics registers metrics reading the state of the application:
+// size of the rate-limiting state, signature and replay caches and blocklist,
+// memory used by submissions, queue depths and spool lag.
+func RegisterMetrics(app *App) error {
+	var errs []error
+	if counter, ok := app.SubmitCounter.(*AttemptCounter); ok {
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "attempt_counter_keys",
+			Help:      "Number of public keys tracked by the rate limiter.",
+		}, func() float64 { return float64(counter.Size()) })))
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "attempt_counter_attempts",
+			Help:      "Number of attempts within the last hour tracked by the rate limiter.",
+		}, func() float64 { return float64(counter.Stats().Attempts) })))
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "attempt_counter_memory_bytes",
+			Help:      "Approximate memory used by the rate limiter to track keys and attempts.",
+		}, func() float64 { return float64(counter.Stats().MemoryBytes) })))
+	}
+	if cache, ok := app.ReplayCache.(*MemoryReplayCache); ok {
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "replay_cache_entries",
+			Help:      "Number of signatures of accepted submissions held by the replay cache.",
+		}, func() float64 { return float64(cache.Size()) })))
+	}
+	if app.MemoryBudget != nil {
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "submit_memory_budget_used_bytes",
+			Help:      "Memory reserved by submissions being decoded.",
+		}, func() float64 { return float64(app.MemoryBudget.Used()) })))
+	}
+	if app.SignatureCache != nil {
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "signature_cache_entries",
+			Help:      "Number of verified signatures in the cache.",
+		}, func() float64 { return float64(app.SignatureCache.Len()) })))
+	}
+	if app.Blocklist != nil {
+		errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "blocklist_entries",
+			Help:      "Number of blocked submitters, peers and IP ranges.",
+		}, func() float64 { return float64(app.Blocklist.Len()) })))
+	}
+	switch s := app.Storage.(type) {
+	case *MultiStorage:
+		for _, b := range s.Backends() {
+			if as, ok := b.(*AsyncStorage); ok {
+				errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+					Namespace:   METRICS_NAMESPACE,
+					Name:        "storage_queue_depth",
+					Help:        "Number of submissions waiting to be saved by storage backend.",
+					ConstLabels: prometheus.Labels{storageBackendLabel: as.Name()},
+				}, func() float64 { return float64(as.QueueDepth()) })))
+			}
+		}
+	case *Spool:
+		for _, b := range s.Backends() {
+			name := b.Name()
+			errs = append(errs, prometheus.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Namespace:   METRICS_NAMESPACE,
+				Name:        "spool_lag_segments",
+				Help:        "Number of spool segments a storage backend is behind by.",
+				ConstLabels: prometheus.Labels{storageBackendLabel: name},
+			}, func() float64 { return float64(s.Lag()[name]) })))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// instrumentedStorage records latency and errors of the wrapped backend.
+type instrumentedStorage struct {
+	Storage
+	duration prometheus.Observer
+	failures prometheus.Counter
+}
+
+func instrumentStorage(s Storage) Storage {
+	return &instrumentedStorage{
+		Storage:  s,
+		duration: storageSaveDuration.WithLabelValues(s.Name()),
+		failures: storageSaveErrorsTotal.WithLabelValues(s.Name()),
+	}
+}
+
+func (s *instrumentedStorage) Save(objs ObjectsToSave) error {
+	start := time.Now()
+	err := s.Storage.Save(objs)
+	s.duration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.failures.Inc()
+	}
+	return err
+}
@@ -0,0 +1,60 @@
+package delegation_backend
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRejectionMetric(t *testing.T) {
+	body := readTestFile("req-no-snark", t)
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	counter := submissionRejectionsTotal.WithLabelValues(rejectionNotWhitelisted)
+	before := testutil.ToFloat64(counter)
+	if rep := sh.testRequest(body); rep.Code != 401 {
+		t.Log(rep)
+		t.FailNow()
+	}
+	if after := testutil.ToFloat64(counter); after != before+1 {
+		t.Logf("Expected rejection to be counted, got %v -> %v", before, after)
+		t.FailNow()
+	}
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	h := InstrumentHandler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(418)
+	}))
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if n := testutil.ToFloat64(httpRequestsTotal.WithLabelValues("test", "418")); n != 3 {
+		t.Logf("Expected 3 requests counted, got %v", n)
+		t.FailNow()
+	}
+}
+
+func TestInstrumentedStorage(t *testing.T) {
+	backend := newTestStorage("metrics_test")
+	s := instrumentStorage(backend)
+	if err := s.Save(ObjectsToSave{"a": []byte("a")}); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	backend.setSaveErr(errors.New("unavailable"))
+	if err := s.Save(ObjectsToSave{"b": []byte("b")}); err == nil {
+		t.Log("Expected save error to be propagated")
+		t.FailNow()
+	}
+	if n := testutil.ToFloat64(storageSaveErrorsTotal.WithLabelValues("metrics_test")); n != 1 {
+		t.Logf("Expected 1 save error counted, got %v", n)
+		t.FailNow()
+	}
+	if n := testutil.CollectAndCount(storageSaveDuration, "delegation_backend_storage_save_duration_seconds"); n < 1 {
+		t.Log("Expected save duration to be observed")
+		t.FailNow()
+	}
+}
@@ -1,16 +1,31 @@
 package delegation_backend
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"strings"
 
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/postgres"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
 	logging "github.com/ipfs/go-log/v2"
 	_ "github.com/lib/pq"
 )
 
+// POSTGRESQL_MIGRATIONS_TABLE keeps the version of the tables the service
+// adds to the PostgreSQL database, apart from migrations of the rest of
+// the schema, which is managed along with uptime-service-validation.
+const POSTGRESQL_MIGRATIONS_TABLE = "delegation_backend_schema_migrations"
+
 type PostgreSQLContext struct {
 	DB  *sql.DB
 	Log *logging.ZapEventLogger
+	// ClientIPColumn is set if the submissions table has the client_ip column
+	ClientIPColumn bool
+	// BatchedColumn is set if the submissions table has the batched column
+	BatchedColumn bool
 }
 
 func NewPostgreSQL(cfg *PostgreSQLConfig) (*sql.DB, error) {
@@ -27,57 +42,55 @@ func NewPostgreSQL(cfg *PostgreSQLConfig) (*sql.DB, error) {
 }
 
 func (ctx *PostgreSQLContext) insertSubmission(submission *Submission) error {
+	columns, values := submissionColumns(submission, ctx.ClientIPColumn, ctx.BatchedColumn)
 	// if SnarkWork is empty, do not insert it into the database
-	if len(submission.SnarkWork) == 0 {
-		return ctx.insertSubmissionWithoutSnarkWork(submission)
-	}
-	return ctx.insertSubmissionWithSnarkWork(submission)
-}
-
-func (ctx *PostgreSQLContext) insertSubmissionWithoutSnarkWork(submission *Submission) error {
-	query := `INSERT INTO submissions 
-				(submitted_at_date, 
-				 submitted_at, 
-				 submitter, 
-				 created_at, 
-				 block_hash, 
-				 remote_addr, 
-				 peer_id, 
-				 graphql_control_port,
-				 built_with_commit_sha)
-			   VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
-	_, err := ctx.DB.Exec(query, submission.SubmittedAtDate, submission.SubmittedAt,
-		submission.Submitter, submission.CreatedAt, submission.BlockHash,
-		submission.RemoteAddr, submission.PeerId, submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha)
+	if len(submission.SnarkWork) > 0 {
+		columns = append(columns, "snark_work")
+		values = append(values, submission.SnarkWork)
+	}
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO submissions (%s) VALUES (%s)",
+		strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	_, err := ctx.DB.Exec(query, values...)
 	return err
 }
 
-func (ctx *PostgreSQLContext) insertSubmissionWithSnarkWork(submission *Submission) error {
-	query := `INSERT INTO submissions 
-				(submitted_at_date, 
-				submitted_at, 
-				submitter, 
-				created_at, 
-				block_hash, 
-				remote_addr, 
-				peer_id, 
-				graphql_control_port,
-				built_with_commit_sha,
-				snark_work) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	_, err := ctx.DB.Exec(query, submission.SubmittedAtDate, submission.SubmittedAt,
-		submission.Submitter, submission.CreatedAt, submission.BlockHash,
-		submission.RemoteAddr, submission.PeerId, submission.GraphqlControlPort,
-		submission.BuiltWithCommitSha, submission.SnarkWork)
-	return err
+// submissionColumns lists the columns of the submissions table common to
+// the database backends along with their values. client_ip and batched
+// are left out if the table doesn't have them yet.
+func submissionColumns(submission *Submission, clientIP bool, batched bool) ([]string, []interface{}) {
+	columns := []string{"submitted_at_date", "submitted_at", "submitter", "created_at", "block_hash",
+		"remote_addr", "peer_id", "graphql_control_port", "built_with_commit_sha"}
+	values := []interface{}{submission.SubmittedAtDate, submission.SubmittedAt, submission.Submitter,
+		submission.CreatedAt, submission.BlockHash, submission.RemoteAddr, submission.PeerId,
+		submission.GraphqlControlPort, submission.BuiltWithCommitSha}
+	if clientIP {
+		columns = append(columns, "client_ip")
+		values = append(values, submission.ClientIP)
+	}
+	if batched {
+		columns = append(columns, "batched")
+		values = append(values, submission.Batched)
+	}
+	return columns, values
 }
 
-func (ctx *PostgreSQLContext) PostgreSQLSave(objs ObjectsToSave) {
+// hasSubmissionsColumn checks whether column was added to the submissions table.
+func hasSubmissionsColumn(db *sql.DB, column string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'submissions' AND column_name = $1)`, column).Scan(&exists)
+	return exists, err
+}
+
+func (ctx *PostgreSQLContext) PostgreSQLSave(objs ObjectsToSave) error {
 	submissionToSave, err := objectToSaveToSubmission(objs, ctx.Log)
 	if err != nil {
 		ctx.Log.Errorf("PostgreSQLSave: Error preparing submission for saving: %v", err)
-		return
+		return err
 	}
 
 	if err := ctx.insertSubmission(submissionToSave); err != nil {
@@ -85,10 +98,119 @@ func (ctx *PostgreSQLContext) PostgreSQLSave(objs ObjectsToSave) {
 		// because it means that the submission is already in the database
 		if err.Error() == "pq: duplicate key value violates unique constraint \"uq_submissions_submitter_date\"" {
 			ctx.Log.Infof("PostgreSQLSave: Submission for submitter: %v at %v already exists", submissionToSave.Submitter, submissionToSave.SubmittedAt)
-			return
+			return nil
 		}
 		ctx.Log.Errorf("PostgreSQLSave: Error saving submission to PostgreSQL: %v", err)
-	} else {
-		ctx.Log.Infof("PostgreSQLSave: Successfully saved submission for submitter: %v at %v", submissionToSave.Submitter, submissionToSave.SubmittedAt)
+		return err
+	}
+	ctx.Log.Infof("PostgreSQLSave: Successfully saved submission for submitter: %v at %v", submissionToSave.Submitter, submissionToSave.SubmittedAt)
+	return nil
+}
+
+// NewPostgreSQLStorage creates the PostgreSQL storage backend if it is configured.
+func NewPostgreSQLStorage(_ context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (Storage, error) {
+	if appCfg.PostgreSQL == nil {
+		return nil, nil
+	}
+	db, err := NewPostgreSQL(appCfg.PostgreSQL)
+	if err != nil {
+		return nil, err
+	}
+	clientIP, err := hasSubmissionsColumn(db, "client_ip")
+	var batched bool
+	if err == nil {
+		batched, err = hasSubmissionsColumn(db, "batched")
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error checking columns of submissions: %w", err)
+	}
+	if !clientIP {
+		log.Warnf("PostgreSQL submissions table has no client_ip column, client addresses are only stored in remote_addr until database migrations are run")
+	}
+	if !batched {
+		log.Warnf("PostgreSQL submissions table has no batched column, submissions sent in a batch can only be told by created_at until database migrations are run")
+	}
+	return &PostgreSQLContext{DB: db, Log: log, ClientIPColumn: clientIP, BatchedColumn: batched}, nil
+}
+
+func (ctx *PostgreSQLContext) Name() string {
+	return "postgresql"
+}
+
+func (ctx *PostgreSQLContext) Save(objs ObjectsToSave) error {
+	return ctx.PostgreSQLSave(objs)
+}
+
+// Exists checks whether the submission with the given path is stored.
+// Raw blocks are not stored in PostgreSQL, so block paths are never reported as existing.
+func (ctx *PostgreSQLContext) Exists(path string) (bool, error) {
+	if !strings.HasPrefix(path, "submissions/") {
+		return false, nil
+	}
+	submission, err := parseSubmissionPath(path)
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	err = ctx.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM submissions WHERE submitter = $1 AND submitted_at = $2)`,
+		submission.Submitter, submission.SubmittedAt).Scan(&exists)
+	return exists, err
+}
+
+func (ctx *PostgreSQLContext) HealthCheck() error {
+	return ctx.DB.Ping()
+}
+
+func (ctx *PostgreSQLContext) Close() error {
+	return ctx.DB.Close()
+}
+
+// PostgreSQLMigrationUp applies all up migrations in migrationPath.
+func PostgreSQLMigrationUp(db *sql.DB, migrationPath string) error {
+	log.Print("Running PostgreSQL database migration Up...")
+	return runPostgreSQLMigration(db, migrationPath, func(m *migrate.Migrate) error {
+		return m.Up()
+	})
+}
+
+// PostgreSQLMigrationDown rolls back all migrations in migrationPath.
+func PostgreSQLMigrationDown(db *sql.DB, migrationPath string) error {
+	log.Print("Running PostgreSQL database migration Down...")
+	return runPostgreSQLMigration(db, migrationPath, func(m *migrate.Migrate) error {
+		return m.Down()
+	})
+}
+
+func runPostgreSQLMigration(db *sql.DB, migrationPath string, run func(m *migrate.Migrate) error) error {
+	ctx := context.Background()
+	// A connection of its own, as closing the driver would close db otherwise
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{MigrationsTable: POSTGRESQL_MIGRATIONS_TABLE})
+	if err != nil {
+		return fmt.Errorf("could not create PostgreSQL migration driver: %w", err)
+	}
+	m, err := migrate.NewWithDatabaseInstance(fmt.Sprintf("file://%s", migrationPath), "postgres", driver)
+	if err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if err := run(m); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("an error occurred while running migrations: %w", err)
+	}
+	return nil
+}
+
+// PostgreSQLDB returns the connection pool of the PostgreSQL storage backend
+// among storages, so that other components share it, or nil if there's none.
+func PostgreSQLDB(storages []Storage) *sql.DB {
+	for _, s := range storages {
+		if s, ok := unwrapStorage(s).(*PostgreSQLContext); ok {
+			return s.DB
+		}
 	}
+	return nil
 }
@@ -0,0 +1,172 @@
+package delegation_backend
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Rate limiter types, as configured in AppConfig
+const (
+	RateLimiterMemory     = "memory"
+	RateLimiterPostgreSQL = "postgresql"
+)
+
+const RATE_LIMITER_QUERY_TIMEOUT = 2 * time.Second
+const RATE_LIMITER_SWEEP_INTERVAL = 10 * time.Minute
+
+// RateLimiter limits the number of submissions of a public key within an hour.
+type RateLimiter interface {
+	// RecordAttempt records an attempt to submit and returns false
+	// if the amount of attempts per hour is exceeded.
+	RecordAttempt(pk Pk) bool
+	// RetryAfter returns the time until the next attempt of pk is allowed,
+	// or 0 if it isn't known.
+	RetryAfter(pk Pk) time.Duration
+	// ForgetAttempt drops the latest attempt of pk, so that a submission
+	// the service failed to store doesn't count against the limit.
+	ForgetAttempt(pk Pk)
+}
+
+// NewRateLimiter creates the rate limiter configured in appCfg, AttemptCounter
+// keeping attempts in memory of the process is used by default. The PostgreSQL
+// rate limiter shares db with the storage backend, see PostgreSQLDB.
+func NewRateLimiter(appCfg AppConfig, db *sql.DB, maxAttemptPerHour int, log *logging.ZapEventLogger) (RateLimiter, error) {
+	switch appCfg.RateLimiter {
+	case "", RateLimiterMemory:
+		return NewAttemptCounter(maxAttemptPerHour, appCfg.AttemptCounterMaxKeys), nil
+	case RateLimiterPostgreSQL:
+		if db == nil {
+			return nil, fmt.Errorf("%s rate limiter requires PostgreSQL to be configured", appCfg.RateLimiter)
+		}
+		return NewPostgreSQLRateLimiter(db, maxAttemptPerHour, log), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limiter: %s", appCfg.RateLimiter)
+	}
+}
+
+// PostgreSQLRateLimiter keeps a sliding window of attempts in the
+// submission_attempts table, so that the limit is shared by all replicas
+// of the service and survives restarts. Attempts of a submitter older than
+// an hour are deleted on its next attempt, and those of submitters which
+// stopped submitting by Run.
+type PostgreSQLRateLimiter struct {
+	DB         *sql.DB
+	maxAttempt int
+	log        *logging.ZapEventLogger
+	now        nowFunc
+}
+
+func NewPostgreSQLRateLimiter(db *sql.DB, maxAttemptPerHour int, log *logging.ZapEventLogger) *PostgreSQLRateLimiter {
+	return &PostgreSQLRateLimiter{
+		DB:         db,
+		maxAttempt: maxAttemptPerHour,
+		log:        log,
+		now:        func() time.Time { return time.Now() },
+	}
+}
+
+// RecordAttempt lets the attempt through if the database can't be reached,
+// rejecting every submission during a database outage would be worse
+// than a temporarily unenforced limit.
+func (l *PostgreSQLRateLimiter) RecordAttempt(pk Pk) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), RATE_LIMITER_QUERY_TIMEOUT)
+	defer cancel()
+	allowed, err := l.recordAttempt(ctx, pk)
+	if err != nil {
+		rateLimiterErrorsTotal.Inc()
+		l.log.Errorf("Error recording attempt of %s, allowing it: %v", pk, err)
+		return true
+	}
+	return allowed
+}
+
+func (l *PostgreSQLRateLimiter) recordAttempt(ctx context.Context, pk Pk) (bool, error) {
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	submitter := pk.String()
+	now := l.now()
+	// Serializes attempts of the submitter across replicas until the end of transaction
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, submitter); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM submission_attempts WHERE submitter = $1 AND attempted_at <= $2`,
+		submitter, now.Add(minusOneHour)); err != nil {
+		return false, err
+	}
+	var count int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM submission_attempts WHERE submitter = $1`,
+		submitter).Scan(&count); err != nil {
+		return false, err
+	}
+	if count >= l.maxAttempt {
+		return false, tx.Commit()
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO submission_attempts (submitter, attempted_at) VALUES ($1, $2)`,
+		submitter, now); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RetryAfter returns 0 if the database can't be reached.
+func (l *PostgreSQLRateLimiter) RetryAfter(pk Pk) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), RATE_LIMITER_QUERY_TIMEOUT)
+	defer cancel()
+	var oldest sql.NullTime
+	if err := l.DB.QueryRowContext(ctx, `SELECT MIN(attempted_at) FROM submission_attempts WHERE submitter = $1`,
+		pk.String()).Scan(&oldest); err != nil {
+		l.log.Debugf("Error querying attempts of %s: %v", pk, err)
+		return 0
+	}
+	if !oldest.Valid {
+		return 0
+	}
+	return oldest.Time.Sub(l.now().Add(minusOneHour))
+}
+
+// ForgetAttempt leaves the attempt recorded if the database can't be reached.
+func (l *PostgreSQLRateLimiter) ForgetAttempt(pk Pk) {
+	ctx, cancel := context.WithTimeout(context.Background(), RATE_LIMITER_QUERY_TIMEOUT)
+	defer cancel()
+	if _, err := l.DB.ExecContext(ctx, `DELETE FROM submission_attempts WHERE ctid IN
+			(SELECT ctid FROM submission_attempts WHERE submitter = $1 ORDER BY attempted_at DESC LIMIT 1)`,
+		pk.String()); err != nil {
+		rateLimiterErrorsTotal.Inc()
+		l.log.Errorf("Error forgetting attempt of %s: %v", pk, err)
+	}
+}
+
+// Sweep deletes attempts made more than an hour ago,
+// returning the number of them.
+func (l *PostgreSQLRateLimiter) Sweep(ctx context.Context) (int64, error) {
+	res, err := l.DB.ExecContext(ctx, `DELETE FROM submission_attempts WHERE attempted_at <= $1`, l.now().Add(minusOneHour))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Run sweeps old attempts every interval until ctx is cancelled.
+func (l *PostgreSQLRateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			queryCtx, cancel := context.WithTimeout(ctx, RATE_LIMITER_QUERY_TIMEOUT)
+			if _, err := l.Sweep(queryCtx); err != nil {
+				l.log.Warnf("Error deleting old attempts: %v", err)
+			}
+			cancel()
+		}
+	}
+}
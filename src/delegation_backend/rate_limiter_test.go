@@ -0,0 +1,29 @@
+package delegation_backend
+
+import (
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	for _, name := range []string{"", RateLimiterMemory} {
+		limiter, err := NewRateLimiter(AppConfig{RateLimiter: name}, nil, 1, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := limiter.(*AttemptCounter); !ok {
+			t.Fatalf("expected in-memory rate limiter for %q, got %T", name, limiter)
+		}
+		pk := mkPk()
+		if !limiter.RecordAttempt(pk) || limiter.RecordAttempt(pk) {
+			t.Fatal("expected limit of one attempt")
+		}
+	}
+	for _, cfg := range []AppConfig{{RateLimiter: RateLimiterPostgreSQL}, {RateLimiter: "redis"}} {
+		if _, err := NewRateLimiter(cfg, nil, 1, log); err == nil {
+			t.Errorf("expected %q rate limiter without configuration to be rejected", cfg.RateLimiter)
+		}
+	}
+}
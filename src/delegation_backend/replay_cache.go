@@ -0,0 +1,223 @@
+package delegation_backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Replay cache types, as configured in AppConfig
+const (
+	ReplayCacheMemory     = "memory"
+	ReplayCachePostgreSQL = "postgresql"
+)
+
+const DEFAULT_MAX_CREATED_AT_AGE = 10 * time.Minute
+const DEFAULT_MAX_BATCH_CREATED_AT_AGE = 6 * time.Hour
+const REPLAY_CACHE_SWEEP_INTERVAL = time.Minute
+
+// CreatedAtMaxAge converts the configured maximum age of created_at,
+// 0 means DEFAULT_MAX_CREATED_AT_AGE and negative disables the check.
+func CreatedAtMaxAge(seconds int) time.Duration {
+	return maxAge(seconds, DEFAULT_MAX_CREATED_AT_AGE)
+}
+
+// BatchCreatedAtMaxAge is CreatedAtMaxAge of submissions sent in a batch,
+// which may be buffered for longer, DEFAULT_MAX_BATCH_CREATED_AT_AGE by default.
+func BatchCreatedAtMaxAge(seconds int) time.Duration {
+	return maxAge(seconds, DEFAULT_MAX_BATCH_CREATED_AT_AGE)
+}
+
+func maxAge(seconds int, defaultAge time.Duration) time.Duration {
+	switch {
+	case seconds == 0:
+		return defaultAge
+	case seconds < 0:
+		return 0
+	default:
+		return time.Duration(seconds) * time.Second
+	}
+}
+
+// ReplayCache remembers signatures of accepted submissions, so that
+// a captured request can't be stored again while its created_at is recent enough.
+// Once it isn't, the submission is rejected as stale instead.
+type ReplayCache interface {
+	// Record returns false if the signature of submitter was recorded
+	// before and hasn't expired yet, otherwise records it until expiresAt.
+	Record(submitter Pk, sig Sig, expiresAt time.Time) bool
+	// Forget drops the signature, so that a submission which was recorded
+	// but couldn't be accepted can be sent again.
+	Forget(submitter Pk, sig Sig)
+	// Run drops expired signatures every interval until ctx is cancelled.
+	Run(ctx context.Context, interval time.Duration)
+}
+
+// NewReplayCache creates the replay cache configured in appCfg,
+// MemoryReplayCache is used by default. The PostgreSQL replay cache shares
+// db with the storage backend, see PostgreSQLDB.
+//
+// Signatures are remembered until created_at is too old to be accepted,
+// so neither of the created_at age checks can be disabled.
+func NewReplayCache(appCfg AppConfig, db *sql.DB, log *logging.ZapEventLogger) (ReplayCache, error) {
+	if CreatedAtMaxAge(appCfg.MaxCreatedAtAge) == 0 || BatchCreatedAtMaxAge(appCfg.MaxBatchCreatedAtAge) == 0 {
+		return nil, errors.New("created_at age checks can't be disabled, replays would be accepted once signatures expire")
+	}
+	switch appCfg.ReplayCache {
+	case "", ReplayCacheMemory:
+		return NewMemoryReplayCache(), nil
+	case ReplayCachePostgreSQL:
+		if db == nil {
+			return nil, fmt.Errorf("%s replay cache requires PostgreSQL to be configured", appCfg.ReplayCache)
+		}
+		return NewPostgreSQLReplayCache(db, log), nil
+	default:
+		return nil, fmt.Errorf("unknown replay cache: %s", appCfg.ReplayCache)
+	}
+}
+
+type replayKey struct {
+	submitter Pk
+	sig       Sig
+}
+
+// MemoryReplayCache keeps signatures in memory of the process, replays
+// sent to another replica or after a restart aren't detected.
+type MemoryReplayCache struct {
+	seen  map[replayKey]time.Time
+	mutex sync.Mutex
+	now   nowFunc
+}
+
+func NewMemoryReplayCache() *MemoryReplayCache {
+	return &MemoryReplayCache{
+		seen: make(map[replayKey]time.Time),
+		now:  func() time.Time { return time.Now() },
+	}
+}
+
+func (c *MemoryReplayCache) Record(submitter Pk, sig Sig, expiresAt time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := replayKey{submitter, sig}
+	if e, seen := c.seen[key]; seen && e.After(c.now()) {
+		return false
+	}
+	c.seen[key] = expiresAt
+	return true
+}
+
+func (c *MemoryReplayCache) Forget(submitter Pk, sig Sig) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.seen, replayKey{submitter, sig})
+}
+
+// Sweep drops expired signatures, returning the number of them.
+func (c *MemoryReplayCache) Sweep() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	swept := 0
+	for key, expiresAt := range c.seen {
+		if !expiresAt.After(now) {
+			delete(c.seen, key)
+			swept++
+		}
+	}
+	return swept
+}
+
+func (c *MemoryReplayCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Sweep()
+		}
+	}
+}
+
+// Size returns the number of signatures held, including expired ones not swept yet.
+func (c *MemoryReplayCache) Size() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.seen)
+}
+
+// PostgreSQLReplayCache keeps signatures in the seen_signatures table,
+// so that replays are detected by all replicas of the service.
+type PostgreSQLReplayCache struct {
+	DB  *sql.DB
+	log *logging.ZapEventLogger
+	now nowFunc
+}
+
+func NewPostgreSQLReplayCache(db *sql.DB, log *logging.ZapEventLogger) *PostgreSQLReplayCache {
+	return &PostgreSQLReplayCache{
+		DB:  db,
+		log: log,
+		now: func() time.Time { return time.Now() },
+	}
+}
+
+func encodeSig(sig Sig) string {
+	return base64.StdEncoding.EncodeToString(sig[:])
+}
+
+// Record lets the submission through if the database can't be reached,
+// the same way PostgreSQLRateLimiter does.
+func (c *PostgreSQLReplayCache) Record(submitter Pk, sig Sig, expiresAt time.Time) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), RATE_LIMITER_QUERY_TIMEOUT)
+	defer cancel()
+	// An expired signature is replaced, a recent one is left as is
+	res, err := c.DB.ExecContext(ctx, `INSERT INTO seen_signatures (submitter, signature, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (submitter, signature) DO UPDATE SET expires_at = EXCLUDED.expires_at
+		WHERE seen_signatures.expires_at <= $4`,
+		submitter.String(), encodeSig(sig), expiresAt, c.now())
+	if err == nil {
+		var n int64
+		if n, err = res.RowsAffected(); err == nil {
+			return n > 0
+		}
+	}
+	replayCacheErrorsTotal.Inc()
+	c.log.Errorf("Error recording signature of %s, allowing it: %v", submitter, err)
+	return true
+}
+
+func (c *PostgreSQLReplayCache) Forget(submitter Pk, sig Sig) {
+	ctx, cancel := context.WithTimeout(context.Background(), RATE_LIMITER_QUERY_TIMEOUT)
+	defer cancel()
+	if _, err := c.DB.ExecContext(ctx, `DELETE FROM seen_signatures WHERE submitter = $1 AND signature = $2`,
+		submitter.String(), encodeSig(sig)); err != nil {
+		replayCacheErrorsTotal.Inc()
+		c.log.Errorf("Error forgetting signature of %s: %v", submitter, err)
+	}
+}
+
+func (c *PostgreSQLReplayCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			queryCtx, cancel := context.WithTimeout(ctx, RATE_LIMITER_QUERY_TIMEOUT)
+			if _, err := c.DB.ExecContext(queryCtx, `DELETE FROM seen_signatures WHERE expires_at <= $1`, c.now()); err != nil {
+				c.log.Warnf("Error deleting expired signatures: %v", err)
+			}
+			cancel()
+		}
+	}
+}
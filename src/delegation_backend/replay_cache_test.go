@@ -0,0 +1,77 @@
+package delegation_backend
+
+import (
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestMemoryReplayCache(t *testing.T) {
+	cache := NewMemoryReplayCache()
+	tm := &timeMock{time: time.Now()}
+	cache.now = tm.Now
+	pk := mkPk()
+	var sig, otherSig Sig
+	otherSig[0] = 1
+	if !cache.Record(pk, sig, tm.Now().Add(10*m)) {
+		t.Fatal("signature seen for the first time rejected")
+	}
+	if cache.Record(pk, sig, tm.Now().Add(10*m)) {
+		t.Fatal("replayed signature accepted")
+	}
+	if !cache.Record(pk, otherSig, tm.Now().Add(10*m)) || !cache.Record(mkPk(), sig, tm.Now().Add(10*m)) {
+		t.Fatal("signature of another submission rejected")
+	}
+	cache.Forget(pk, otherSig)
+	if !cache.Record(pk, otherSig, tm.Now().Add(5*m)) {
+		t.Fatal("forgotten signature rejected")
+	}
+	tm.Advance(5 * m)
+	if swept := cache.Sweep(); swept != 1 {
+		t.Fatalf("expected one signature to expire, got %d", swept)
+	}
+	tm.Advance(5 * m)
+	if !cache.Record(pk, sig, tm.Now().Add(10*m)) {
+		t.Fatal("expired signature rejected")
+	}
+	if cache.Size() != 2 {
+		t.Fatalf("unexpected size: %d", cache.Size())
+	}
+}
+
+func TestCreatedAtMaxAge(t *testing.T) {
+	if age := CreatedAtMaxAge(0); age != DEFAULT_MAX_CREATED_AT_AGE {
+		t.Errorf("unexpected default age: %v", age)
+	}
+	if age := CreatedAtMaxAge(-1); age != 0 {
+		t.Errorf("expected negative age to disable the check, got %v", age)
+	}
+	if age := CreatedAtMaxAge(90); age != 90*s {
+		t.Errorf("unexpected age: %v", age)
+	}
+}
+
+func TestNewReplayCache(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	for _, name := range []string{"", ReplayCacheMemory} {
+		cache, err := NewReplayCache(AppConfig{ReplayCache: name}, nil, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := cache.(*MemoryReplayCache); !ok {
+			t.Fatalf("expected in-memory replay cache for %q, got %T", name, cache)
+		}
+	}
+	for _, cfg := range []AppConfig{{ReplayCache: ReplayCachePostgreSQL}, {ReplayCache: "redis"}} {
+		if _, err := NewReplayCache(cfg, nil, log); err == nil {
+			t.Errorf("expected %q replay cache without configuration to be rejected", cfg.ReplayCache)
+		}
+	}
+	// Signatures would be forgotten while the submission is still accepted
+	for _, cfg := range []AppConfig{{MaxCreatedAtAge: -1}, {MaxBatchCreatedAtAge: -1}} {
+		if _, err := NewReplayCache(cfg, nil, log); err == nil {
+			t.Errorf("expected replay cache with created_at age check disabled to be rejected: %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package delegation_backend
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const DEFAULT_SAVE_QUEUE_SIZE = 100
+const SAVE_PIPELINE_RETRY_INTERVAL = 5 * time.Second
+
+// ErrSaveQueueFull is returned by AsyncStorage.Save when the backend
+// can't keep up with incoming submissions.
+var ErrSaveQueueFull = errors.New("save queue is full")
+
+var errSaveQueueClosed = errors.New("save queue is closed")
+
+// AsyncStorage decouples saving from the request handling by putting
+// submissions into a bounded queue consumed by a pool of workers.
+//
+// A submission the backend fails to save is retried by the worker until it
+// succeeds, and meanwhile Save fails with the error of the backend, so that
+// the save policy accounts for the backend being down as it does without
+// the pipeline. Submissions still failing on Close are lost, the spool
+// should be used where that isn't acceptable.
+type AsyncStorage struct {
+	backend       Storage
+	queue         chan ObjectsToSave
+	log           logging.StandardLogger
+	retryInterval time.Duration
+
+	mutex   sync.RWMutex
+	closed  bool
+	failing error // last error of the backend, nil once a save succeeds
+	stop    chan struct{}
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewAsyncStorage wraps the backend into a queue of queueSize
+// submissions processed by the given number of workers.
+func NewAsyncStorage(backend Storage, workers int, queueSize int, log logging.StandardLogger) *AsyncStorage {
+	if workers < 1 {
+		workers = 1
+	}
+	if queueSize < 1 {
+		queueSize = DEFAULT_SAVE_QUEUE_SIZE
+	}
+	as := &AsyncStorage{
+		backend:       backend,
+		queue:         make(chan ObjectsToSave, queueSize),
+		log:           log,
+		retryInterval: SAVE_PIPELINE_RETRY_INTERVAL,
+		stop:          make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		as.wg.Add(1)
+		go as.work()
+	}
+	return as
+}
+
+func (as *AsyncStorage) work() {
+	defer as.wg.Done()
+	for objs := range as.queue {
+		as.save(objs)
+	}
+}
+
+// save retries saving objs until it succeeds or the storage is closed.
+func (as *AsyncStorage) save(objs ObjectsToSave) {
+	for {
+		err := as.backend.Save(objs)
+		as.mutex.Lock()
+		as.failing = err
+		as.mutex.Unlock()
+		if err == nil {
+			return
+		}
+		select {
+		case <-as.stop:
+			as.log.Errorf("%s: Submission lost on shutdown, error saving it: %v", as.backend.Name(), err)
+			return
+		case <-time.After(as.retryInterval):
+			as.log.Warnf("%s: Retrying queued submission after error: %v", as.backend.Name(), err)
+		}
+	}
+}
+
+func (as *AsyncStorage) Name() string {
+	return as.backend.Name()
+}
+
+// Save enqueues objects without waiting for them to be saved,
+// unless the last save of the backend failed.
+func (as *AsyncStorage) Save(objs ObjectsToSave) error {
+	as.mutex.RLock()
+	defer as.mutex.RUnlock()
+	if as.closed {
+		return errSaveQueueClosed
+	}
+	if as.failing != nil {
+		return fmt.Errorf("backend is failing: %w", as.failing)
+	}
+	select {
+	case as.queue <- objs:
+		return nil
+	default:
+		return fmt.Errorf("%w (capacity %d)", ErrSaveQueueFull, cap(as.queue))
+	}
+}
+
+func (as *AsyncStorage) Exists(path string) (bool, error) {
+	return as.backend.Exists(path)
+}
+
+func (as *AsyncStorage) HealthCheck() error {
+	return as.backend.HealthCheck()
+}
+
+// Close stops accepting submissions, waits for the queued ones to be
+// saved and closes the backend. Each queued submission is attempted once
+// more, those failing aren't retried anymore.
+// Calls after the first one return the result of the first one.
+func (as *AsyncStorage) Close() error {
+	as.closeOnce.Do(func() {
+		as.mutex.Lock()
+		as.closed = true
+		close(as.queue)
+		close(as.stop)
+		as.mutex.Unlock()
+		as.wg.Wait()
+		as.closeErr = as.backend.Close()
+	})
+	return as.closeErr
+}
+
+// QueueDepth returns the number of submissions waiting to be saved.
+func (as *AsyncStorage) QueueDepth() int {
+	return len(as.queue)
+}
+
+// QueueCapacity returns the maximum number of submissions the queue can hold.
+func (as *AsyncStorage) QueueCapacity() int {
+	return cap(as.queue)
+}
+
+// QueueDepths reports queue depths of the backends which are asynchronous.
+func (ms *MultiStorage) QueueDepths() map[string]int {
+	res := make(map[string]int)
+	for _, b := range ms.backends {
+		if as, ok := b.(*AsyncStorage); ok {
+			res[as.Name()] = as.QueueDepth()
+		}
+	}
+	return res
+}
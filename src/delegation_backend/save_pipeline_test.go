@@ -0,0 +1,126 @@
+package delegation_backend
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// blockingStorage holds every save until it's released.
+type blockingStorage struct {
+	*testStorage
+	release chan struct{}
+}
+
+func (s *blockingStorage) Save(objs ObjectsToSave) error {
+	<-s.release
+	return s.testStorage.Save(objs)
+}
+
+func TestAsyncStorageBackpressure(t *testing.T) {
+	backend := &blockingStorage{newTestStorage("slow"), make(chan struct{})}
+	as := NewAsyncStorage(backend, 1, 2, logging.Logger("delegation backend test"))
+
+	// One submission is picked up by the worker, two more fill the queue
+	accepted := 0
+	for i := 0; i < 4; i++ {
+		err := as.Save(ObjectsToSave{fmt.Sprintf("blocks/%d.dat", i): {byte(i)}})
+		if err == nil {
+			accepted++
+		} else if !errors.Is(err, ErrSaveQueueFull) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i == 0 {
+			waitFor(t, func() bool { return as.QueueDepth() == 0 })
+		}
+	}
+	if accepted != 3 || as.QueueDepth() != 2 || as.QueueCapacity() != 2 {
+		t.Fatalf("unexpected queue state: accepted %d, depth %d", accepted, as.QueueDepth())
+	}
+
+	// Closing flushes the pending submissions
+	close(backend.release)
+	if err := as.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if backend.count() != 3 || !backend.closed {
+		t.Fatalf("expected queued submissions to be saved on close, got %d", backend.count())
+	}
+	if err := as.Save(ObjectsToSave{"blocks/x.dat": {}}); err == nil {
+		t.Fatal("expected save after close to fail")
+	}
+	// Closing again doesn't close the backend a second time
+	backend.closed = false
+	if err := as.Close(); err != nil || backend.closed {
+		t.Fatal("expected second close to be a no-op")
+	}
+}
+
+func TestAsyncStorageRetriesFailedSave(t *testing.T) {
+	backend := newTestStorage("flaky")
+	backend.setSaveErr(errors.New("unavailable"))
+	as := NewAsyncStorage(backend, 1, 2, logging.Logger("delegation backend test"))
+	as.retryInterval = time.Millisecond
+	if err := as.Save(ObjectsToSave{"blocks/1.dat": {1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the backend fails, the save policy sees it as failing
+	// instead of further submissions being acknowledged
+	waitFor(t, func() bool {
+		as.mutex.RLock()
+		defer as.mutex.RUnlock()
+		return as.failing != nil
+	})
+	if err := as.Save(ObjectsToSave{"blocks/2.dat": {2}}); err == nil {
+		t.Fatal("expected save to fail while the backend is failing")
+	}
+	ms, err := NewMultiStorage(logging.Logger("delegation backend test"), SavePolicyAll, 0, as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Save(ObjectsToSave{"blocks/2.dat": {2}}); err == nil {
+		t.Fatal("expected save policy to fail while the backend is failing")
+	}
+
+	// The failed submission is saved when the backend recovers
+	backend.setSaveErr(nil)
+	waitFor(t, func() bool { return backend.count() == 1 })
+	if _, exists := backend.objs["blocks/1.dat"]; !exists {
+		t.Fatal("expected the failed submission to be retried")
+	}
+	waitFor(t, func() bool { return as.Save(ObjectsToSave{"blocks/3.dat": {3}}) == nil })
+	if err := as.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if backend.count() != 2 {
+		t.Fatalf("expected submissions to be saved, got %d", backend.count())
+	}
+}
+
+func TestSubmitWithFullSaveQueue(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	_, sh, _ := testSubmitH(1, nil)
+	sh.app.WhitelistDisabled = true
+	backend := &blockingStorage{newTestStorage("slow"), make(chan struct{})}
+	defer close(backend.release)
+	as := NewAsyncStorage(backend, 1, 1, sh.app.Log)
+	if err := as.Save(ObjectsToSave{}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return as.QueueDepth() == 0 })
+	if err := as.Save(ObjectsToSave{}); err != nil {
+		t.Fatal(err)
+	}
+	ms, err := NewMultiStorage(sh.app.Log, SavePolicyAll, 0, as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.app.Storage = ms
+	if rep := sh.testRequest(body); rep.Code != 503 || rep.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with full queue, got %v", rep)
+	}
+}
@@ -0,0 +1,188 @@
+package delegation_backend
+
+import "math/big"
+
+// Pallas curve y^2 = x^3 + 5 over the base field of fieldModulus,
+// its group order is scalarModulus
+var (
+	fieldModulus  = mustParseHex("40000000000000000000000000000000224698fc094cf91b992d30ed00000001")
+	scalarModulus = mustParseHex("40000000000000000000000000000000224698fc0994a8dd8c46eb2100000001")
+	pallasB       = big.NewInt(5)
+	pallasGen     = &pallasPoint{
+		x: big.NewInt(1),
+		y: mustParseHex("1b74b5a30a12937c53dfa9f06378ee548f655bd4333d477119cf7a23caed2abb"),
+		z: big.NewInt(1),
+	}
+)
+
+// pallasPoint is a point in Jacobian coordinates (x/z^2, y/z^3),
+// the point at infinity has z = 0
+type pallasPoint struct {
+	x, y, z *big.Int
+}
+
+func pallasInfinity() *pallasPoint {
+	return &pallasPoint{x: big.NewInt(1), y: big.NewInt(1), z: new(big.Int)}
+}
+
+func (pt *pallasPoint) isInfinity() bool {
+	return pt.z.Sign() == 0
+}
+
+func fieldMul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, fieldModulus)
+}
+
+// fieldSub and fieldAdd expect reduced arguments,
+// which avoids the costly division of Mod
+
+func fieldSub(a, b *big.Int) *big.Int {
+	r := new(big.Int).Sub(a, b)
+	if r.Sign() < 0 {
+		r.Add(r, fieldModulus)
+	}
+	return r
+}
+
+func fieldAdd(a, b *big.Int) *big.Int {
+	r := new(big.Int).Add(a, b)
+	if r.Cmp(fieldModulus) >= 0 {
+		r.Sub(r, fieldModulus)
+	}
+	return r
+}
+
+func (pt *pallasPoint) double() *pallasPoint {
+	if pt.isInfinity() || pt.y.Sign() == 0 {
+		return pallasInfinity()
+	}
+	a := fieldMul(pt.x, pt.x)
+	b := fieldMul(pt.y, pt.y)
+	c := fieldMul(b, b)
+	xb := fieldAdd(pt.x, b)
+	d := fieldSub(fieldSub(fieldMul(xb, xb), a), c)
+	d = fieldAdd(d, d)
+	e := fieldAdd(fieldAdd(a, a), a)
+	f := fieldMul(e, e)
+	x3 := fieldSub(fieldSub(f, d), d)
+	c8 := fieldAdd(c, c)
+	c8 = fieldAdd(c8, c8)
+	c8 = fieldAdd(c8, c8)
+	y3 := fieldSub(fieldMul(e, fieldSub(d, x3)), c8)
+	yz := fieldMul(pt.y, pt.z)
+	z3 := fieldAdd(yz, yz)
+	return &pallasPoint{x: x3, y: y3, z: z3}
+}
+
+func (pt *pallasPoint) add(other *pallasPoint) *pallasPoint {
+	if pt.isInfinity() {
+		return other
+	}
+	if other.isInfinity() {
+		return pt
+	}
+	z1z1 := fieldMul(pt.z, pt.z)
+	z2z2 := fieldMul(other.z, other.z)
+	u1 := fieldMul(pt.x, z2z2)
+	u2 := fieldMul(other.x, z1z1)
+	s1 := fieldMul(fieldMul(pt.y, other.z), z2z2)
+	s2 := fieldMul(fieldMul(other.y, pt.z), z1z1)
+	h := fieldSub(u2, u1)
+	r := fieldSub(s2, s1)
+	if h.Sign() == 0 {
+		if r.Sign() == 0 {
+			return pt.double()
+		}
+		return pallasInfinity()
+	}
+	h2 := fieldAdd(h, h)
+	i := fieldMul(h2, h2)
+	j := fieldMul(h, i)
+	r = fieldAdd(r, r)
+	v := fieldMul(u1, i)
+	x3 := fieldSub(fieldSub(fieldSub(fieldMul(r, r), j), v), v)
+	s1j := fieldMul(s1, j)
+	y3 := fieldSub(fieldSub(fieldMul(r, fieldSub(v, x3)), s1j), s1j)
+	z12 := fieldAdd(pt.z, other.z)
+	z3 := fieldMul(fieldSub(fieldSub(fieldMul(z12, z12), z1z1), z2z2), h)
+	return &pallasPoint{x: x3, y: y3, z: z3}
+}
+
+// affine returns the affine coordinates of a point other than infinity.
+func (pt *pallasPoint) affine() (x, y *big.Int) {
+	zInv := new(big.Int).ModInverse(pt.z, fieldModulus)
+	zInv2 := fieldMul(zInv, zInv)
+	return fieldMul(pt.x, zInv2), fieldMul(fieldMul(pt.y, zInv2), zInv)
+}
+
+// pallasDoubleMul computes a*p + b*q, sharing the doublings.
+func pallasDoubleMul(a *big.Int, p *pallasPoint, b *big.Int, q *pallasPoint) *pallasPoint {
+	pq := p.add(q)
+	res := pallasInfinity()
+	for i := max(a.BitLen(), b.BitLen()) - 1; i >= 0; i-- {
+		res = res.double()
+		switch {
+		case a.Bit(i) == 1 && b.Bit(i) == 1:
+			res = res.add(pq)
+		case a.Bit(i) == 1:
+			res = res.add(p)
+		case b.Bit(i) == 1:
+			res = res.add(q)
+		}
+	}
+	return res
+}
+
+func leBytesToInt(bs []byte) *big.Int {
+	be := make([]byte, len(bs))
+	for i, b := range bs {
+		be[len(bs)-1-i] = b
+	}
+	return new(big.Int).SetBytes(be)
+}
+
+// decompressPk recovers the curve point out of the x coordinate
+// and parity of y, as encoded in Pk.
+func decompressPk(pk *Pk) (*pallasPoint, bool) {
+	x := leBytesToInt(pk[:32])
+	isOdd := pk[32]
+	if x.Cmp(fieldModulus) >= 0 || isOdd > 1 {
+		return nil, false
+	}
+	y2 := fieldAdd(fieldMul(fieldMul(x, x), x), pallasB)
+	y := new(big.Int).ModSqrt(y2, fieldModulus)
+	if y == nil {
+		return nil, false
+	}
+	if y.Bit(0) != uint(isOdd) {
+		y.Sub(fieldModulus, y)
+	}
+	return &pallasPoint{x: x, y: y, z: big.NewInt(1)}, true
+}
+
+// verifySigPure checks a Mina Schnorr signature of data, interpreted as a string
+// of bits, the same way libmina_signer does, but without leaving Go.
+func verifySigPure(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+	pub, ok := decompressPk(pk)
+	if !ok {
+		return false
+	}
+	rx := leBytesToInt(sig[:32])
+	s := leBytesToInt(sig[32:])
+	if rx.Cmp(fieldModulus) >= 0 || s.Cmp(scalarModulus) >= 0 {
+		return false
+	}
+
+	e := poseidonLegacyHash(networkId, []*big.Int{pub.x, pub.y, rx}, data)
+	e.Mod(e, scalarModulus)
+
+	// R = s*G - e*pk
+	negE := new(big.Int).Sub(scalarModulus, e)
+	r := pallasDoubleMul(s, pallasGen, negE, pub)
+	if r.isInfinity() {
+		return false
+	}
+	x, y := r.affine()
+	return y.Bit(0) == 0 && x.Cmp(rx) == 0
+}
@@ -0,0 +1,145 @@
+package delegation_backend
+
+import (
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+type sigTestVector struct {
+	pk   string
+	sig  string
+	data []byte
+}
+
+func sigTestVectors(t *testing.T) []sigTestVector {
+	hash4 := blake2b.Sum256(readTestFile("payload-no-snark", t))
+	hash5 := blake2b.Sum256(readTestFile("payload-with-snark", t))
+	return []sigTestVector{
+		{PK1, SIG1, []byte{0, 0}},
+		{PK2, SIG2, []byte{0x80}},
+		{PK3, SIG3, []byte{0xFF}},
+		{PK4, SIG4, hash4[:]},
+		{PK5, SIG5, hash5[:]},
+	}
+}
+
+func parseSigTestVector(v sigTestVector, t *testing.T) (*Pk, *Sig) {
+	var pk Pk
+	var sig Sig
+	if err := StringToPk(&pk, v.pk); err != nil {
+		t.Fatalf("Error parsing pk: %s", v.pk)
+	}
+	if err := StringToSig(&sig, v.sig); err != nil {
+		t.Fatalf("Error parsing sig: %s", v.sig)
+	}
+	return &pk, &sig
+}
+
+func TestVerifySigPure(t *testing.T) {
+	for i, v := range sigTestVectors(t) {
+		pk, sig := parseSigTestVector(v, t)
+		if !verifySigPure(pk, sig, v.data, 1) {
+			t.Errorf("vector %d: valid signature rejected", i+1)
+		}
+		if verifySigPure(pk, sig, v.data, 0) {
+			t.Errorf("vector %d: signature accepted for a different network", i+1)
+		}
+		data := append([]byte{}, v.data...)
+		data[0] ^= 1
+		if verifySigPure(pk, sig, data, 1) {
+			t.Errorf("vector %d: signature accepted for modified data", i+1)
+		}
+		badSig := *sig
+		badSig[40] ^= 1
+		if verifySigPure(pk, &badSig, v.data, 1) {
+			t.Errorf("vector %d: modified signature accepted", i+1)
+		}
+		badPk := *pk
+		badPk[32] ^= 1
+		if verifySigPure(&badPk, sig, v.data, 1) {
+			t.Errorf("vector %d: signature accepted for negated public key", i+1)
+		}
+	}
+}
+
+func TestVerifySigPureMalformed(t *testing.T) {
+	v := sigTestVectors(t)[0]
+	pk, sig := parseSigTestVector(v, t)
+	outOfField := *pk
+	for i := 0; i < 32; i++ {
+		outOfField[i] = 0xFF
+	}
+	if verifySigPure(&outOfField, sig, v.data, 1) {
+		t.Error("public key out of field accepted")
+	}
+	badParity := *pk
+	badParity[32] = 2
+	if verifySigPure(&badParity, sig, v.data, 1) {
+		t.Error("public key with invalid parity byte accepted")
+	}
+	outOfScalar := *sig
+	for i := 32; i < 64; i++ {
+		outOfScalar[i] = 0xFF
+	}
+	if verifySigPure(pk, &outOfScalar, v.data, 1) {
+		t.Error("signature with scalar out of range accepted")
+	}
+}
+
+// Secret key and nonce of test data signed by the tests themselves
+var (
+	testSecretKey = mustParseHex("1f2d3c4b5a69788796a5b4c3d2e1f00112233445566778899aabbccddeeff001")
+	testNonce     = mustParseHex("0c0ffee0ddba11cafebabedeadbeef0123456789abcdef0fedcba9876543210f")
+)
+
+func intToLeBytes(x *big.Int, bs []byte) {
+	be := x.FillBytes(make([]byte, len(bs)))
+	for i, b := range be {
+		bs[len(bs)-1-i] = b
+	}
+}
+
+// signPure makes a Mina Schnorr signature of data which verifySigPure accepts,
+// with the nonce k rather than one derived the way libmina_signer does it.
+func signPure(sk, k *big.Int, data []byte, networkId uint8) (Pk, Sig) {
+	var pk Pk
+	var sig Sig
+	pubX, pubY := pallasDoubleMul(sk, pallasGen, new(big.Int), pallasGen).affine()
+	intToLeBytes(pubX, pk[:32])
+	pk[32] = byte(pubY.Bit(0))
+	// R must have an even y, which is the case of either k*G or -k*G
+	rx, ry := pallasDoubleMul(k, pallasGen, new(big.Int), pallasGen).affine()
+	if ry.Bit(0) == 1 {
+		k = new(big.Int).Sub(scalarModulus, k)
+	}
+	e := poseidonLegacyHash(networkId, []*big.Int{pubX, pubY, rx}, data)
+	s := new(big.Int).Mul(e, sk)
+	s.Add(s, k)
+	s.Mod(s, scalarModulus)
+	intToLeBytes(rx, sig[:32])
+	intToLeBytes(s, sig[32:])
+	return pk, sig
+}
+
+func TestSignPure(t *testing.T) {
+	data := []byte{1, 2, 3}
+	pk, sig := signPure(testSecretKey, testNonce, data, 1)
+	if !verifySigPure(&pk, &sig, data, 1) {
+		t.Fatal("signature made by the test key rejected")
+	}
+	if verifySigPure(&pk, &sig, data, 0) {
+		t.Fatal("signature accepted for a different network")
+	}
+}
+
+func BenchmarkVerifySigPure(b *testing.B) {
+	var pk Pk
+	var sig Sig
+	_ = StringToPk(&pk, PK1)
+	_ = StringToSig(&sig, SIG1)
+	for i := 0; i < b.N; i++ {
+		verifySigPure(&pk, &sig, []byte{0, 0}, 1)
+	}
+}
@@ -0,0 +1,205 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func secondsOr(seconds int, def time.Duration) time.Duration {
+	if seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return def
+}
+
+// Address returns the configured address or DELEGATION_BACKEND_LISTEN_TO.
+func (cfg *ServerConfig) Address() string {
+	if cfg == nil || cfg.ListenAddress == "" {
+		return DELEGATION_BACKEND_LISTEN_TO
+	}
+	return cfg.ListenAddress
+}
+
+// NewServer creates an HTTP server with timeouts and, if configured, TLS.
+// The TLS certificate is reloaded when its files change until ctx is cancelled.
+func NewServer(ctx context.Context, cfg *ServerConfig, handler http.Handler, log logging.StandardLogger) (*http.Server, error) {
+	if cfg == nil {
+		cfg = new(ServerConfig)
+	}
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: secondsOr(cfg.ReadHeaderTimeout, DEFAULT_SERVER_READ_HEADER_TIMEOUT),
+		ReadTimeout:       secondsOr(cfg.ReadTimeout, DEFAULT_SERVER_READ_TIMEOUT),
+		WriteTimeout:      secondsOr(cfg.WriteTimeout, DEFAULT_SERVER_WRITE_TIMEOUT),
+		IdleTimeout:       secondsOr(cfg.IdleTimeout, DEFAULT_SERVER_IDLE_TIMEOUT),
+	}
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		if cfg.TLSClientCAFile != "" {
+			return nil, errors.New("client CA is configured without TLS certificate and key")
+		}
+		return srv, nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, errors.New("both TLS certificate and key should be configured")
+	}
+	reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, log)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.watch(ctx, TLS_CERT_RELOAD_INTERVAL)
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSClientCAFile)
+		}
+		srv.TLSConfig.ClientCAs = pool
+		srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return srv, nil
+}
+
+// certReloader serves a TLS certificate, reloading it when the files are modified.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      logging.StandardLogger
+
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, log logging.StandardLogger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, log: log}
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := cr.load(modTime); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// reloadIfModified loads the certificate again if its files changed since
+// the last load. On error the previous certificate keeps being served.
+func (cr *certReloader) reloadIfModified() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cr.mutex.RLock()
+	unchanged := modTime.Equal(cr.modTime)
+	cr.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+	if err := cr.load(modTime); err != nil {
+		return err
+	}
+	cr.log.Infof("TLS certificate reloaded from %s", cr.certFile)
+	return nil
+}
+
+func (cr *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cr.reloadIfModified(); err != nil {
+				cr.log.Errorf("Failed to reload TLS certificate, using previous one, error: %v", err)
+			}
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.cert, nil
+}
+
+// Serve handles requests on the listener until ctx is cancelled. At that point
+// the app is marked as not ready, and after shutdownDelay (which gives load
+// balancers time to notice) the server stops accepting new connections
+// and waits up to drainTimeout for in-flight requests to complete.
+func Serve(ctx context.Context, srv *http.Server, ln net.Listener, app *App, shutdownDelay, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			serveErr <- srv.ServeTLS(ln, "", "")
+		} else {
+			serveErr <- srv.Serve(ln)
+		}
+	}()
+	app.IsReady.Store(true)
+
+	select {
+	case err := <-serveErr:
+		app.IsReady.Store(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	app.IsReady.Store(false)
+	app.Log.Infof("Shutting down, waiting %v before draining requests", shutdownDelay)
+	time.Sleep(shutdownDelay)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		return fmt.Errorf("error draining requests: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	app.Log.Infof("All in-flight requests completed")
+	return nil
+}
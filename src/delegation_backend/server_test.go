@@ -0,0 +1,220 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func testServe(t *testing.T, handler http.Handler, drainTimeout time.Duration) (*App, string, context.CancelFunc, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := new(App)
+	app.Log = logging.Logger("delegation backend test")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, &http.Server{Handler: handler}, ln, app, 0, drainTimeout)
+	}()
+	waitFor(t, app.IsReady.Load)
+	return app, "http://" + ln.Addr().String(), cancel, done
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app, url, cancel, done := testServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}), time.Minute)
+
+	respCode := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			respCode <- 0
+			return
+		}
+		resp.Body.Close()
+		respCode <- resp.StatusCode
+	}()
+	<-started
+	cancel()
+	waitFor(t, func() bool { return !app.IsReady.Load() })
+	close(release)
+
+	if code := <-respCode; code != http.StatusOK {
+		t.Fatalf("in-flight request wasn't completed, got %v", code)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error on shutdown: %v", err)
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	_, url, cancel, done := testServe(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), 10*time.Millisecond)
+
+	go func() {
+		if resp, err := http.Get(url); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("expected drain timeout to be reported")
+	}
+}
+
+// writeTestCert writes a certificate signed by parent (or self-signed
+// if parent is nil) along with its key into dir.
+func writeTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	srv, err := NewServer(context.Background(), nil, http.NotFoundHandler(), logging.Logger("delegation backend test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.TLSConfig != nil || srv.ReadHeaderTimeout != DEFAULT_SERVER_READ_HEADER_TIMEOUT || srv.IdleTimeout != DEFAULT_SERVER_IDLE_TIMEOUT {
+		t.Fatalf("unexpected server defaults: %+v", srv)
+	}
+	cfg := &ServerConfig{ReadTimeout: 7, TLSClientCAFile: "ca.crt"}
+	if _, err := NewServer(context.Background(), cfg, http.NotFoundHandler(), logging.Logger("delegation backend test")); err == nil {
+		t.Fatal("expected client CA without TLS to be rejected")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	_, _, certFile, keyFile := writeTestCert(t, dir, "server", 1, nil, nil)
+	cr, err := newCertReloader(certFile, keyFile, logging.Logger("delegation backend test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestCert(t, dir, "server", 2, nil, nil)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	if err := cr.reloadIfModified(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := cr.GetCertificate(nil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.SerialNumber.Int64() != 2 {
+		t.Fatalf("expected reloaded certificate to be served, got %v", leaf.SerialNumber)
+	}
+
+	// A broken certificate isn't picked up, previous one is kept
+	os.WriteFile(certFile, []byte("garbage"), 0600)
+	later := future.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if cr.reloadIfModified() == nil {
+		t.Fatal("expected reload of a broken certificate to fail")
+	}
+	if c, _ := cr.GetCertificate(nil); c != cert {
+		t.Fatal("expected previous certificate to be kept")
+	}
+}
+
+func TestServeMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeTestCert(t, dir, "ca", 1, nil, nil)
+	_, _, certFile, keyFile := writeTestCert(t, dir, "server", 2, ca, caKey)
+	_, _, clientCertFile, clientKeyFile := writeTestCert(t, dir, "client", 3, ca, caKey)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &ServerConfig{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile}
+	srv, err := NewServer(ctx, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), logging.Logger("delegation backend test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := new(App)
+	app.Log = logging.Logger("delegation backend test")
+	go Serve(ctx, srv, ln, app, 0, time.Second)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	url := "https://" + ln.Addr().String()
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	if resp, err := anonymous.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected request without client certificate to be rejected")
+	}
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticated := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := authenticated.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.StatusCode)
+	}
+}
@@ -1,51 +1,96 @@
 package delegation_backend
 
 import (
+	"context"
+	"fmt"
+	"strings"
+
 	logging "github.com/ipfs/go-log/v2"
 	sheets "google.golang.org/api/sheets/v4"
 )
 
-// Process rows retrieved from Google spreadsheet
-// and extract public keys from the first column.
-func processRows(rows [][](interface{})) Whitelist {
+// Process rows retrieved from Google spreadsheet and extract public keys
+// from the first column. Following columns, when present, are enrollment
+// start, enrollment end, operator and tier (see parseWhitelistRow).
+func processRows(rows [][](interface{}), log logging.StandardLogger) Whitelist {
 	wl := make(Whitelist)
 	for _, row := range rows {
-		if len(row) > 0 {
-			switch v := row[0].(type) {
-			case string:
-				var pk Pk
-				err := StringToPk(&pk, v)
-				if err == nil {
-					wl[pk] = true // we need something to be provided as value
-				}
+		if len(row) == 0 {
+			continue
+		}
+		if _, ok := row[0].(string); !ok {
+			continue
+		}
+		fields := make([]string, len(row))
+		for i, cell := range row {
+			if cell != nil {
+				fields[i] = fmt.Sprint(cell)
 			}
 		}
+		parseWhitelistRow(wl, fields, log)
 	}
 	return wl
 }
 
+// WHITELIST_METADATA_COLUMNS is the number of columns following
+// the public key column with enrollment window, operator and tier.
+const WHITELIST_METADATA_COLUMNS = 4
+
+// shiftColumn returns the A1 notation of the column n columns
+// to the right of col, e.g. shiftColumn("Z", 2) is "AB".
+func shiftColumn(col string, n int) string {
+	idx := 0
+	for _, c := range strings.ToUpper(col) {
+		idx = idx*26 + int(c-'A'+1)
+	}
+	idx += n
+	var res []byte
+	for ; idx > 0; idx = (idx - 1) / 26 {
+		res = append([]byte{byte('A' + (idx-1)%26)}, res...)
+	}
+	return string(res)
+}
+
+// SheetsWhitelistSource reads the whitelist out of the column
+// of delegation program spreadsheet containing public keys
+// of program participants.
+type SheetsWhitelistSource struct {
+	Service *sheets.Service
+	AppCfg  AppConfig
+	Log     *logging.ZapEventLogger
+}
+
+func (src *SheetsWhitelistSource) Name() string {
+	return "sheets " + src.AppCfg.GsheetId
+}
+
+func (src *SheetsWhitelistSource) Load(ctx context.Context) (Whitelist, error) {
+	col := src.AppCfg.DelegationWhitelistColumn
+	lastCol := col
+	if src.AppCfg.DelegationWhitelistMetadata {
+		lastCol = shiftColumn(col, WHITELIST_METADATA_COLUMNS)
+	}
+	readRange := src.AppCfg.DelegationWhitelistList + "!" + col + ":" + lastCol
+	resp, err := src.Service.Spreadsheets.Values.Get(src.AppCfg.GsheetId, readRange).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return processRows(resp.Values, src.Log), nil
+}
+
+func (src *SheetsWhitelistSource) Close() error {
+	return nil
+}
+
 // Retrieve data from delegation program spreadsheet
 // and extract public keys out of the column containing
 // public keys of program participants.
 func RetrieveWhitelist(service *sheets.Service, log *logging.ZapEventLogger, appCfg AppConfig, retries int) (Whitelist, error) {
-	var resp *sheets.ValueRange
-	var err error
-
-	operation := func() error {
-		col := appCfg.DelegationWhitelistColumn
-		readRange := appCfg.DelegationWhitelistList + "!" + col + ":" + col
-		spId := appCfg.GsheetId
-		resp, err = service.Spreadsheets.Values.Get(spId, readRange).Do()
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-	err = ExponentialBackoff(operation, retries, initialBackoff)
+	src := &SheetsWhitelistSource{Service: service, AppCfg: appCfg, Log: log}
+	wl, err := LoadWhitelist(context.Background(), src, retries)
 	if err != nil {
 		log.Errorf("Unable to retrieve data from sheet after %v retries: %v", retries, err)
 		return nil, err
 	}
-
-	return processRows(resp.Values), nil
+	return wl, nil
 }
@@ -6,6 +6,8 @@ import (
 	"reflect"
 	"testing"
 	"testing/quick"
+
+	logging "github.com/ipfs/go-log/v2"
 )
 
 func randRow(r *rand.Rand) ([](interface{}), *Pk) {
@@ -58,7 +60,7 @@ func (Rows) Generate(r *rand.Rand, size int) reflect.Value {
 		row, pk := randRow(r)
 		res = append(res, row)
 		if pk != nil {
-			wl[*pk] = true
+			wl[*pk] = &WhitelistEntry{}
 		}
 	}
 	return reflect.ValueOf(Rows{res, wl})
@@ -66,11 +68,11 @@ func (Rows) Generate(r *rand.Rand, size int) reflect.Value {
 
 func TestProcessRow(t *testing.T) {
 	f := func(rows Rows) bool {
-		actual := processRows(rows.rows)
-		res := reflect.DeepEqual(map[Pk]unit(rows.expected), map[Pk]unit(actual))
+		actual := processRows(rows.rows, logging.Logger("delegation backend test"))
+		res := reflect.DeepEqual(rows.expected, actual)
 		if !res {
-			t.Logf("expected: %s", rows.expected)
-			t.Logf("actual: %s", actual)
+			t.Logf("expected: %v", rows.expected)
+			t.Logf("actual: %v", actual)
 		}
 		return res
 	}
@@ -0,0 +1,143 @@
+package delegation_backend
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const DEFAULT_SIGNATURE_CACHE_SIZE = 10000
+
+// SignatureCheck is a signature of a submission to be verified.
+type SignatureCheck struct {
+	Submitter Pk
+	Sig       Sig
+	Hash      [blake2b.Size256]byte // of the sign payload
+	NetworkId uint8
+}
+
+// ParseSignatureCheck extracts the signature out of a body of /v1/submit request.
+func ParseSignatureCheck(body []byte, networkId uint8) (SignatureCheck, error) {
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return SignatureCheck{}, err
+	}
+	if !req.CheckRequiredFields() {
+		return SignatureCheck{}, errors.New("one of required fields wasn't provided")
+	}
+	payload, err := req.Data.MakeSignPayload()
+	if err != nil {
+		return SignatureCheck{}, err
+	}
+	return SignatureCheck{
+		Submitter: req.Submitter,
+		Sig:       req.Sig,
+		Hash:      blake2b.Sum256(payload),
+		NetworkId: networkId,
+	}, nil
+}
+
+// SignatureCache remembers signatures which were successfully verified,
+// evicting the least recently used ones. Invalid signatures aren't cached,
+// so that they can't push the valid ones out of the cache.
+// A nil cache verifies every signature.
+type SignatureCache struct {
+	mutex   sync.Mutex
+	size    int
+	entries map[SignatureCheck]*list.Element
+	lru     *list.List
+}
+
+func NewSignatureCache(size int) *SignatureCache {
+	if size < 1 {
+		size = DEFAULT_SIGNATURE_CACHE_SIZE
+	}
+	return &SignatureCache{
+		size:    size,
+		entries: make(map[SignatureCheck]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (c *SignatureCache) lookup(check SignatureCheck) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[check]; ok {
+		c.lru.MoveToFront(e)
+		return true
+	}
+	return false
+}
+
+func (c *SignatureCache) add(check SignatureCheck) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[check]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[check] = c.lru.PushFront(check)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(SignatureCheck))
+	}
+}
+
+// Len returns the number of cached signatures.
+func (c *SignatureCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// Verify checks the signature, skipping verification if it was already verified.
+func (c *SignatureCache) Verify(check SignatureCheck) bool {
+	if c != nil && c.lookup(check) {
+		signatureCacheLookups.WithLabelValues(signatureCacheHit).Inc()
+		return true
+	}
+	if c != nil {
+		signatureCacheLookups.WithLabelValues(signatureCacheMiss).Inc()
+	}
+	if !verifySig(&check.Submitter, &check.Sig, check.Hash[:], check.NetworkId) {
+		return false
+	}
+	if c != nil {
+		c.add(check)
+	}
+	return true
+}
+
+// VerifyBatch verifies signatures concurrently with the given number of workers
+// (or one per CPU if workers isn't positive), returning results in the order of checks.
+func (c *SignatureCache) VerifyBatch(checks []SignatureCheck, workers int) []bool {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	results := make([]bool, len(checks))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = c.Verify(checks[i])
+			}
+		}()
+	}
+	for i := range checks {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return results
+}
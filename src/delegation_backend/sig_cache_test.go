@@ -0,0 +1,96 @@
+package delegation_backend
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func sigTestChecks(t *testing.T) []SignatureCheck {
+	var checks []SignatureCheck
+	for _, v := range sigTestVectors(t) {
+		pk, sig := parseSigTestVector(v, t)
+		check := SignatureCheck{Submitter: *pk, Sig: *sig, NetworkId: 1}
+		copy(check.Hash[:], v.data)
+		// Hash field is fixed-size, so only vectors signing a hash are usable
+		if len(v.data) == len(check.Hash) {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+func TestSignatureCacheHit(t *testing.T) {
+	check := sigTestChecks(t)[0]
+	cache := NewSignatureCache(10)
+	hits := signatureCacheLookups.WithLabelValues(signatureCacheHit)
+	before := testutil.ToFloat64(hits)
+	if !cache.Verify(check) || cache.Len() != 1 {
+		t.Fatal("valid signature should be verified and cached")
+	}
+	if !cache.Verify(check) {
+		t.Fatal("cached signature should be valid")
+	}
+	if after := testutil.ToFloat64(hits); after != before+1 {
+		t.Fatalf("expected a cache hit, got %v -> %v", before, after)
+	}
+}
+
+func TestSignatureCacheInvalid(t *testing.T) {
+	check := sigTestChecks(t)[0]
+	check.Hash[0] ^= 1
+	cache := NewSignatureCache(10)
+	if cache.Verify(check) || cache.Verify(check) {
+		t.Fatal("invalid signature accepted")
+	}
+	if cache.Len() != 0 {
+		t.Fatal("invalid signature shouldn't be cached")
+	}
+}
+
+func TestSignatureCacheEviction(t *testing.T) {
+	checks := sigTestChecks(t)
+	cache := NewSignatureCache(1)
+	for _, c := range checks {
+		cache.Verify(c)
+	}
+	if cache.Len() != 1 || !cache.lookup(checks[len(checks)-1]) || cache.lookup(checks[0]) {
+		t.Fatal("least recently used signature should be evicted")
+	}
+}
+
+func TestVerifyBatch(t *testing.T) {
+	var checks []SignatureCheck
+	var expected []bool
+	for i := 0; i < 5; i++ {
+		for _, c := range sigTestChecks(t) {
+			valid := i%2 == 0
+			if !valid {
+				c.Sig[40] ^= 1
+			}
+			checks = append(checks, c)
+			expected = append(expected, valid)
+		}
+	}
+	for _, cache := range []*SignatureCache{nil, NewSignatureCache(10)} {
+		results := cache.VerifyBatch(checks, 3)
+		for i := range results {
+			if results[i] != expected[i] {
+				t.Fatalf("check %d: expected %v, got %v", i, expected[i], results[i])
+			}
+		}
+	}
+}
+
+func TestParseSignatureCheck(t *testing.T) {
+	check, err := ParseSignatureCheck(readTestFile("req-with-snark", t), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !NewSignatureCache(1).Verify(check) {
+		t.Fatal("signature of a valid request rejected")
+	}
+	if _, err := ParseSignatureCheck([]byte("{}"), 1); err == nil {
+		t.Fatal("expected request without fields to be rejected")
+	}
+}
@@ -1,3 +1,5 @@
+//go:build !puresigner
+
 package delegation_backend
 
 // TODO think of getting rid of -L flags with relative paths
@@ -0,0 +1,35 @@
+//go:build !puresigner
+
+package delegation_backend
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// TestVerifySigPureMatchesC checks that both implementations agree
+// on valid signatures as well as on corrupted ones.
+func TestVerifySigPureMatchesC(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for i, v := range sigTestVectors(t) {
+		pk, sig := parseSigTestVector(v, t)
+		for j := 0; j < 20; j++ {
+			data := append([]byte{}, v.data...)
+			badSig := *sig
+			networkId := uint8(1)
+			switch j % 4 {
+			case 1:
+				data[r.Intn(len(data))] ^= byte(1 << r.Intn(8))
+			case 2:
+				badSig[r.Intn(len(badSig))] ^= byte(1 << r.Intn(8))
+			case 3:
+				networkId = 0
+			}
+			c := verifySig(pk, &badSig, data, networkId)
+			pure := verifySigPure(pk, &badSig, data, networkId)
+			if c != pure {
+				t.Errorf("vector %d, case %d: libmina_signer returned %v, pure Go %v", i+1, j, c, pure)
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build puresigner
+
+package delegation_backend
+
+// Without cgo dependency on libmina_signer,
+// enabled with the puresigner build tag
+func verifySig(pk *Pk, sig *Sig, data []byte, networkId uint8) bool {
+	return verifySigPure(pk, sig, data, networkId)
+}
@@ -0,0 +1,510 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+const (
+	DEFAULT_SPOOL_SEGMENT_SIZE   int64 = 64 * 1024 * 1024 // 64MB
+	DEFAULT_SPOOL_RETRY_INTERVAL       = 10 * time.Second
+	DEFAULT_SPOOL_MAX_ATTEMPTS         = 100
+	spoolSegmentPrefix                 = "segment-"
+	spoolSegmentSuffix                 = ".log"
+	spoolCursorPrefix                  = "cursor-"
+	spoolDeadLetterPrefix              = "deadletter-"
+	spoolRecordHeaderSize              = 8 // record length (4B) + CRC32 of the record (4B)
+	// A record holds a submission's block and metadata, which are at most
+	// as large as its payload, along with their paths
+	spoolMaxRecordSize = MAX_SUBMIT_PAYLOAD_SIZE + 1<<20
+)
+
+var errSpoolRecordIncomplete = errors.New("incomplete spool record")
+var errSpoolRecordTooLarge = errors.New("spool record too large")
+
+// spoolCursor points at the next record a backend has yet to receive.
+type spoolCursor struct {
+	Segment uint64
+	Offset  int64
+}
+
+// Spool is a write-ahead log of submissions kept on a local disk.
+//
+// Submissions are appended to segment files and acknowledged as soon as
+// they are synced to disk. For each storage backend a drainer replays the
+// spooled submissions in order, retrying until the backend accepts them,
+// and remembers its position in a cursor file, so that a restart resumes
+// where it stopped. Segments consumed by all backends are deleted.
+//
+// A record a healthy backend keeps refusing is moved to the backend's
+// dead-letter file after maxAttempts, so that it doesn't hold up the rest.
+// Failures while the backend's health check fails aren't counted.
+type Spool struct {
+	dir           string
+	segmentSize   int64
+	retryInterval time.Duration
+	maxAttempts   int // no limit if 0
+	backends      *MultiStorage
+	log           logging.StandardLogger
+
+	mutex       sync.Mutex
+	current     *os.File
+	currentSeq  uint64
+	currentSize int64
+	cursors     map[string]spoolCursor
+
+	notify    []chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewSpool opens (or creates) the spool in cfg.Directory for the given backends.
+// Call Start to begin draining the spool into the backends.
+func NewSpool(cfg *SpoolConfig, backends []Storage, log logging.StandardLogger) (*Spool, error) {
+	if err := os.MkdirAll(cfg.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("error creating spool directory: %w", err)
+	}
+	sp := &Spool{
+		dir:           cfg.Directory,
+		segmentSize:   cfg.SegmentSize,
+		retryInterval: time.Duration(cfg.RetryInterval) * time.Second,
+		maxAttempts:   cfg.MaxAttempts,
+		log:           log,
+		cursors:       make(map[string]spoolCursor),
+		stop:          make(chan struct{}),
+	}
+	if sp.segmentSize <= 0 {
+		sp.segmentSize = DEFAULT_SPOOL_SEGMENT_SIZE
+	}
+	if sp.retryInterval <= 0 {
+		sp.retryInterval = DEFAULT_SPOOL_RETRY_INTERVAL
+	}
+	if sp.maxAttempts == 0 {
+		sp.maxAttempts = DEFAULT_SPOOL_MAX_ATTEMPTS
+	} else if sp.maxAttempts < 0 {
+		sp.maxAttempts = 0
+	}
+	// All backends need to persist the record before the drainer moves on,
+	// the multi storage is only used for Exists/HealthCheck/Close
+	ms, err := NewMultiStorage(log, SavePolicyAll, 0, backends...)
+	if err != nil {
+		return nil, err
+	}
+	sp.backends = ms
+
+	segments, err := sp.segments()
+	if err != nil {
+		return nil, err
+	}
+	oldest := uint64(1)
+	if len(segments) > 0 {
+		oldest = segments[0]
+		// Never append after a record that might have been torn by a crash
+		sp.currentSeq = segments[len(segments)-1]
+	}
+	for _, b := range backends {
+		c, err := sp.readCursor(b.Name())
+		if err != nil {
+			return nil, err
+		}
+		if c.Segment < oldest {
+			c = spoolCursor{Segment: oldest}
+		}
+		sp.cursors[b.Name()] = c
+		sp.notify = append(sp.notify, make(chan struct{}, 1))
+	}
+	if err := sp.rotate(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// Start launches one drainer per backend.
+func (sp *Spool) Start() {
+	for i, b := range sp.backends.Backends() {
+		sp.wg.Add(1)
+		go sp.drain(b, sp.notify[i])
+	}
+}
+
+func (sp *Spool) Name() string {
+	return "spool"
+}
+
+// Save appends objects to the spool, returning once they're synced to disk.
+func (sp *Spool) Save(objs ObjectsToSave) error {
+	record := encodeSpoolRecord(objs)
+	if len(record)-spoolRecordHeaderSize > spoolMaxRecordSize {
+		return fmt.Errorf("error writing to spool: %w", errSpoolRecordTooLarge)
+	}
+	sp.mutex.Lock()
+	if sp.currentSize >= sp.segmentSize {
+		if err := sp.rotate(); err != nil {
+			sp.mutex.Unlock()
+			return err
+		}
+	}
+	_, err := sp.current.Write(record)
+	if err == nil {
+		err = sp.current.Sync()
+	}
+	if err != nil {
+		// Start over in a fresh segment, the drainers skip the torn record
+		sp.currentSize = sp.segmentSize
+		sp.mutex.Unlock()
+		return fmt.Errorf("error writing to spool: %w", err)
+	}
+	sp.currentSize += int64(len(record))
+	sp.mutex.Unlock()
+
+	for _, n := range sp.notify {
+		select {
+		case n <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (sp *Spool) Exists(path string) (bool, error) {
+	return sp.backends.Exists(path)
+}
+
+func (sp *Spool) HealthCheck() error {
+	info, err := os.Stat(sp.dir)
+	if err != nil {
+		return fmt.Errorf("spool directory unavailable: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", sp.dir)
+	}
+	return nil
+}
+
+// Backends returns the storage backends the spool is drained to.
+func (sp *Spool) Backends() []Storage {
+	return sp.backends.Backends()
+}
+
+// Close stops the drainers and closes the backends.
+// Submissions which weren't drained yet are kept on disk for the next start.
+// Calls after the first one return the result of the first one.
+func (sp *Spool) Close() error {
+	sp.closeOnce.Do(func() {
+		close(sp.stop)
+		sp.wg.Wait()
+		sp.mutex.Lock()
+		err := sp.current.Close()
+		sp.mutex.Unlock()
+		sp.closeErr = errors.Join(err, sp.backends.Close())
+	})
+	return sp.closeErr
+}
+
+// Lag returns the number of segments each backend is behind the spool head by.
+func (sp *Spool) Lag() map[string]uint64 {
+	sp.mutex.Lock()
+	defer sp.mutex.Unlock()
+	lag := make(map[string]uint64, len(sp.cursors))
+	for name, c := range sp.cursors {
+		lag[name] = sp.currentSeq - c.Segment
+	}
+	return lag
+}
+
+// rotate starts a new segment, must be called with the mutex held.
+func (sp *Spool) rotate() error {
+	f, err := os.OpenFile(sp.segmentPath(sp.currentSeq+1), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating spool segment: %w", err)
+	}
+	if sp.current != nil {
+		if err := sp.current.Close(); err != nil {
+			sp.log.Warnf("Spool: Error closing segment %d: %v", sp.currentSeq, err)
+		}
+	}
+	sp.current = f
+	sp.currentSeq++
+	sp.currentSize = 0
+	return nil
+}
+
+func (sp *Spool) drain(b Storage, notify chan struct{}) {
+	defer sp.wg.Done()
+	sp.mutex.Lock()
+	c := sp.cursors[b.Name()]
+	sp.mutex.Unlock()
+	attempts := 0 // failed attempts to save the record c points at
+	for {
+		next, progressed, err := sp.drainSegment(b, c, &attempts)
+		if next != c {
+			c = next
+			if err := sp.advance(b.Name(), c); err != nil {
+				sp.log.Errorf("Spool: Error persisting cursor of %s: %v", b.Name(), err)
+			}
+		}
+		if progressed && err == nil {
+			continue
+		}
+		wait := sp.retryInterval
+		if err == nil {
+			// Caught up with the head of the spool, wait for new records
+			wait = time.Hour
+		}
+		select {
+		case <-sp.stop:
+			return
+		case <-notify:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// drainSegment replays records of the segment c points into, starting at c.Offset.
+// It returns the cursor following the last replayed record and whether any
+// progress was made. An error is returned when the backend failed to save a record.
+// attempts counts failures to save the record at the cursor across calls.
+func (sp *Spool) drainSegment(b Storage, c spoolCursor, attempts *int) (spoolCursor, bool, error) {
+	sp.mutex.Lock()
+	head := sp.currentSeq
+	sp.mutex.Unlock()
+
+	f, err := os.Open(sp.segmentPath(c.Segment))
+	if os.IsNotExist(err) && c.Segment < head {
+		return spoolCursor{Segment: c.Segment + 1}, true, nil
+	}
+	if err != nil {
+		return c, false, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(c.Offset, io.SeekStart); err != nil {
+		return c, false, err
+	}
+	r := bufio.NewReader(f)
+	progressed := false
+	for {
+		select {
+		case <-sp.stop:
+			return c, progressed, nil
+		default:
+		}
+		objs, size, err := readSpoolRecord(r)
+		if err != nil {
+			if c.Segment == head {
+				// Record is still being written (or there are no new records yet)
+				return c, progressed, nil
+			}
+			if err != io.EOF {
+				sp.log.Errorf("Spool: Skipping rest of segment %d for %s: %v", c.Segment, b.Name(), err)
+			}
+			return spoolCursor{Segment: c.Segment + 1}, true, nil
+		}
+		if err := b.Save(objs); err != nil {
+			if b.HealthCheck() == nil {
+				*attempts++
+			}
+			if sp.maxAttempts == 0 || *attempts < sp.maxAttempts {
+				sp.log.Warnf("Spool: %s failed to save spooled submission, retrying in %v: %v", b.Name(), sp.retryInterval, err)
+				return c, progressed, err
+			}
+			if err := sp.deadLetter(b.Name(), objs); err != nil {
+				sp.log.Errorf("Spool: Error moving submission refused by %s to dead letters: %v", b.Name(), err)
+				return c, progressed, err
+			}
+			sp.log.Errorf("Spool: %s refused spooled submission %d times, moved it to %s: %v", b.Name(), *attempts, sp.deadLetterPath(b.Name()), err)
+			spoolDeadLettersTotal.WithLabelValues(b.Name()).Inc()
+		}
+		*attempts = 0
+		c.Offset += size
+		progressed = true
+	}
+}
+
+// advance records the new cursor of a backend and removes
+// segments which all backends have already consumed.
+func (sp *Spool) advance(name string, c spoolCursor) error {
+	if err := sp.writeCursor(name, c); err != nil {
+		return err
+	}
+	sp.mutex.Lock()
+	prevSegment := sp.cursors[name].Segment
+	sp.cursors[name] = c
+	oldest := c.Segment
+	for _, other := range sp.cursors {
+		if other.Segment < oldest {
+			oldest = other.Segment
+		}
+	}
+	sp.mutex.Unlock()
+	if c.Segment == prevSegment {
+		return nil
+	}
+	segments, err := sp.segments()
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq >= oldest {
+			break
+		}
+		if err := os.Remove(sp.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+			sp.log.Warnf("Spool: Error removing drained segment %d: %v", seq, err)
+		}
+	}
+	return nil
+}
+
+func (sp *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%s%016d%s", spoolSegmentPrefix, seq, spoolSegmentSuffix))
+}
+
+func (sp *Spool) cursorPath(name string) string {
+	return filepath.Join(sp.dir, spoolCursorPrefix+name)
+}
+
+func (sp *Spool) deadLetterPath(name string) string {
+	return filepath.Join(sp.dir, spoolDeadLetterPrefix+name+spoolSegmentSuffix)
+}
+
+// deadLetter appends a record to the dead-letter file of a backend, which
+// has the format of a segment, so that it can be inspected and replayed.
+func (sp *Spool) deadLetter(name string, objs ObjectsToSave) error {
+	f, err := os.OpenFile(sp.deadLetterPath(name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(encodeSpoolRecord(objs))
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
+
+// segments lists sequence numbers of segments present on disk in ascending order.
+func (sp *Spool) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(sp.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, spoolSegmentPrefix) || !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, spoolSegmentPrefix), spoolSegmentSuffix), 10, 64)
+		if err == nil {
+			res = append(res, seq)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+func (sp *Spool) readCursor(name string) (spoolCursor, error) {
+	var c spoolCursor
+	bs, err := os.ReadFile(sp.cursorPath(name))
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("error reading spool cursor of %s: %w", name, err)
+	}
+	if _, err := fmt.Sscanf(string(bs), "%d %d", &c.Segment, &c.Offset); err != nil {
+		return c, fmt.Errorf("malformed spool cursor of %s: %w", name, err)
+	}
+	return c, nil
+}
+
+func (sp *Spool) writeCursor(name string, c spoolCursor) error {
+	tmp := sp.cursorPath(name) + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", c.Segment, c.Offset)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sp.cursorPath(name))
+}
+
+// encodeSpoolRecord serializes objects as a sequence of
+// (path length, path, data length, data) entries, preceded
+// by a header with the total length and a CRC32 checksum.
+func encodeSpoolRecord(objs ObjectsToSave) []byte {
+	size := spoolRecordHeaderSize
+	for path, bs := range objs {
+		size += 8 + len(path) + len(bs)
+	}
+	record := make([]byte, spoolRecordHeaderSize, size)
+	for path, bs := range objs {
+		record = binary.BigEndian.AppendUint32(record, uint32(len(path)))
+		record = append(record, path...)
+		record = binary.BigEndian.AppendUint32(record, uint32(len(bs)))
+		record = append(record, bs...)
+	}
+	payload := record[spoolRecordHeaderSize:]
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	return record
+}
+
+// readSpoolRecord reads the next record, returning the decoded
+// objects along with the number of bytes the record occupied.
+func readSpoolRecord(r io.Reader) (ObjectsToSave, int64, error) {
+	var header [spoolRecordHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errSpoolRecordIncomplete
+		}
+		return nil, 0, err
+	}
+	// The length is checked before allocating, as a corrupt one may be up to 4GB
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > spoolMaxRecordSize {
+		return nil, 0, fmt.Errorf("%w: %d bytes", errSpoolRecordTooLarge, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errSpoolRecordIncomplete
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("spool record checksum mismatch")
+	}
+	objs := make(ObjectsToSave)
+	rest := payload
+	for len(rest) > 0 {
+		var path, bs []byte
+		var err error
+		if path, rest, err = splitSpoolField(rest); err != nil {
+			return nil, 0, err
+		}
+		if bs, rest, err = splitSpoolField(rest); err != nil {
+			return nil, 0, err
+		}
+		objs[string(path)] = bs
+	}
+	return objs, int64(spoolRecordHeaderSize + len(payload)), nil
+}
+
+func splitSpoolField(bs []byte) ([]byte, []byte, error) {
+	if len(bs) < 4 {
+		return nil, nil, errors.New("malformed spool record")
+	}
+	n := binary.BigEndian.Uint32(bs[:4])
+	if uint64(len(bs)-4) < uint64(n) {
+		return nil, nil, errors.New("malformed spool record")
+	}
+	return bs[4 : 4+n], bs[4+n:], nil
+}
@@ -0,0 +1,197 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func testSpool(t *testing.T, dir string, segmentSize int64, backends ...Storage) *Spool {
+	sp, err := NewSpool(&SpoolConfig{Directory: dir, SegmentSize: segmentSize}, backends, logging.Logger("delegation backend test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.retryInterval = 10 * time.Millisecond
+	return sp
+}
+
+func (s *testStorage) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.objs)
+}
+
+func (s *testStorage) setSaveErr(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.saveErr = err
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpoolRecordRoundTrip(t *testing.T) {
+	objs := ObjectsToSave{"submissions/a.json": []byte("{}"), "blocks/a.dat": {0, 1, 2}, "empty": {}}
+	record := encodeSpoolRecord(objs)
+	decoded, size, err := readSpoolRecord(bytes.NewReader(record))
+	if err != nil || size != int64(len(record)) || len(decoded) != len(objs) {
+		t.Fatalf("failed decoding record: %v", err)
+	}
+	for path, bs := range objs {
+		if !bytes.Equal(decoded[path], bs) {
+			t.Fatalf("content mismatch for %s", path)
+		}
+	}
+	if _, _, err := readSpoolRecord(bytes.NewReader(record[:len(record)-1])); err != errSpoolRecordIncomplete {
+		t.Fatalf("expected truncated record to be incomplete, got %v", err)
+	}
+	record[len(record)-1] ^= 0xFF
+	if _, _, err := readSpoolRecord(bytes.NewReader(record)); err == nil {
+		t.Fatal("expected checksum mismatch")
+	}
+	// A corrupt length is rejected rather than allocated
+	binary.BigEndian.PutUint32(record[0:4], 0xFFFFFFFF)
+	if _, _, err := readSpoolRecord(bytes.NewReader(record)); !errors.Is(err, errSpoolRecordTooLarge) {
+		t.Fatalf("expected oversized record to be rejected, got %v", err)
+	}
+}
+
+// refusingStorage stays healthy but refuses to save a given path
+type refusingStorage struct {
+	*testStorage
+	refused string
+}
+
+func (s *refusingStorage) Save(objs ObjectsToSave) error {
+	if _, exists := objs[s.refused]; exists {
+		return errors.New("refused")
+	}
+	return s.testStorage.Save(objs)
+}
+
+func TestSpoolDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	backend := &refusingStorage{testStorage: newTestStorage("backend"), refused: "blocks/1.dat"}
+	sp := testSpool(t, dir, DEFAULT_SPOOL_SEGMENT_SIZE, backend)
+	sp.maxAttempts = 3
+	sp.Start()
+	defer sp.Close()
+	for i := 1; i <= 2; i++ {
+		if err := sp.Save(ObjectsToSave{fmt.Sprintf("blocks/%d.dat", i): {byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The refused record no longer holds up the one behind it
+	waitFor(t, func() bool { return backend.count() == 1 })
+
+	f, err := os.Open(sp.deadLetterPath("backend"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	objs, _, err := readSpoolRecord(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(objs["blocks/1.dat"], []byte{1}) {
+		t.Fatal("expected refused submission in dead letters")
+	}
+}
+
+func TestSpoolDrainsAfterOutage(t *testing.T) {
+	ok := newTestStorage("ok")
+	down := newTestStorage("down")
+	down.setSaveErr(errors.New("unavailable"))
+	sp := testSpool(t, t.TempDir(), 256, ok, down)
+	sp.Start()
+	defer sp.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := sp.Save(ObjectsToSave{fmt.Sprintf("blocks/%d.dat", i): bytes.Repeat([]byte{byte(i)}, 100)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return ok.count() == 10 })
+	if down.count() != 0 {
+		t.Fatal("failing backend shouldn't have received anything")
+	}
+	down.setSaveErr(nil)
+	waitFor(t, func() bool { return down.count() == 10 })
+
+	// Drained segments get removed, only the head is kept
+	waitFor(t, func() bool {
+		segments, err := sp.segments()
+		return err == nil && len(segments) == 1
+	})
+}
+
+func TestSpoolResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestStorage("backend")
+	sp := testSpool(t, dir, DEFAULT_SPOOL_SEGMENT_SIZE, first)
+	sp.Start()
+	if err := sp.Save(ObjectsToSave{"blocks/1.dat": {1}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return first.count() == 1 })
+	first.setSaveErr(errors.New("unavailable"))
+	if err := sp.Save(ObjectsToSave{"blocks/2.dat": {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Closing again, as the shutdown and a deferred close may both do, is a no-op
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestStorage("backend")
+	sp = testSpool(t, dir, DEFAULT_SPOOL_SEGMENT_SIZE, second)
+	sp.Start()
+	defer sp.Close()
+	waitFor(t, func() bool { return second.count() == 1 })
+	if _, exists := second.objs["blocks/2.dat"]; !exists {
+		t.Fatal("expected only the undelivered submission to be replayed")
+	}
+}
+
+func TestSpoolSkipsTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	sp := testSpool(t, dir, DEFAULT_SPOOL_SEGMENT_SIZE)
+	if err := sp.Save(ObjectsToSave{"blocks/1.dat": {1}}); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash in the middle of writing a record
+	if _, err := sp.current.Write(encodeSpoolRecord(ObjectsToSave{"blocks/2.dat": {2}})[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(sp.cursorPath("backend")); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	backend := newTestStorage("backend")
+	sp = testSpool(t, dir, DEFAULT_SPOOL_SEGMENT_SIZE, backend)
+	sp.Start()
+	defer sp.Close()
+	if err := sp.Save(ObjectsToSave{"blocks/3.dat": {3}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return backend.count() == 2 })
+}
@@ -0,0 +1,225 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Storage is implemented by every backend submissions can be persisted to.
+type Storage interface {
+	// Name identifies the backend in logs and error messages.
+	Name() string
+	// Save persists all objects, returning an error if any of them
+	// could not be stored.
+	Save(objs ObjectsToSave) error
+	// Exists reports whether an object with the given path is already stored.
+	Exists(path string) (bool, error)
+	// HealthCheck returns an error if the backend is currently unusable.
+	HealthCheck() error
+	// Close releases resources held by the backend.
+	Close() error
+}
+
+// StorageFactory creates a storage backend out of the application config.
+// It returns a nil Storage (and no error) if the backend isn't configured.
+type StorageFactory func(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (Storage, error)
+
+type storageRegistration struct {
+	name    string
+	factory StorageFactory
+}
+
+var storageRegistry []storageRegistration
+
+// RegisterStorage makes a storage backend available to NewStorages.
+// Backends are initialized in the order they were registered.
+func RegisterStorage(name string, factory StorageFactory) {
+	for _, r := range storageRegistry {
+		if r.name == name {
+			panic(fmt.Sprintf("storage backend %s registered twice", name))
+		}
+	}
+	storageRegistry = append(storageRegistry, storageRegistration{name, factory})
+}
+
+func init() {
+	RegisterStorage("aws_s3", NewAwsS3Storage)
+	RegisterStorage("aws_keyspaces", NewKeyspaceStorage)
+	RegisterStorage("postgresql", NewPostgreSQLStorage)
+	RegisterStorage("filesystem", NewLocalFileSystemStorage)
+}
+
+// NewStorages initializes every registered backend that is configured in appCfg.
+// If one of the backends fails to initialize, the ones already created are closed.
+func NewStorages(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) ([]Storage, error) {
+	var storages []Storage
+	for _, r := range storageRegistry {
+		s, err := r.factory(ctx, appCfg, log)
+		if err != nil {
+			for _, created := range storages {
+				_ = created.Close()
+			}
+			return nil, fmt.Errorf("error initializing %s storage: %w", r.name, err)
+		}
+		if s != nil {
+			log.Infof("storage backend: %s", s.Name())
+			storages = append(storages, instrumentStorage(s))
+		}
+	}
+	return storages, nil
+}
+
+// unwrapStorage returns the backend behind instrumentation and the save pipeline.
+func unwrapStorage(s Storage) Storage {
+	for {
+		switch w := s.(type) {
+		case *instrumentedStorage:
+			s = w.Storage
+		case *AsyncStorage:
+			s = w.backend
+		default:
+			return s
+		}
+	}
+}
+
+// SavePolicy decides how many storage backends need to persist
+// a submission for it to be acknowledged to the submitter.
+type SavePolicy string
+
+const (
+	// SavePolicyAll fails the submission if any of the backends fails.
+	SavePolicyAll SavePolicy = "all"
+	// SavePolicyAny fails the submission only if all of the backends fail.
+	SavePolicyAny SavePolicy = "any"
+	// SavePolicyQuorum requires at least a configured number of backends to succeed.
+	SavePolicyQuorum SavePolicy = "quorum"
+)
+
+const DEFAULT_SAVE_POLICY = SavePolicyAny
+
+// required returns the number of backends out of total
+// that must succeed to satisfy the policy.
+func (p SavePolicy) required(total int, quorum int) (int, error) {
+	switch p {
+	case SavePolicyAll:
+		return total, nil
+	case SavePolicyAny:
+		return 1, nil
+	case SavePolicyQuorum:
+		if quorum < 1 || quorum > total {
+			return 0, fmt.Errorf("save quorum should be between 1 and %d (number of storage backends), got %d", total, quorum)
+		}
+		return quorum, nil
+	default:
+		return 0, fmt.Errorf("unknown save policy: %s", p)
+	}
+}
+
+// SavePolicyError is returned by MultiStorage.Save when too few
+// backends persisted a submission to satisfy the save policy.
+type SavePolicyError struct {
+	Policy    SavePolicy
+	Succeeded int
+	Required  int
+	Err       error
+}
+
+func (e *SavePolicyError) Error() string {
+	return fmt.Sprintf("save policy %s not met, %d of required %d backends succeeded: %v", e.Policy, e.Succeeded, e.Required, e.Err)
+}
+
+func (e *SavePolicyError) Unwrap() error {
+	return e.Err
+}
+
+// MultiStorage fans out every operation to a list of backends.
+type MultiStorage struct {
+	backends []Storage
+	policy   SavePolicy
+	required int
+	log      logging.StandardLogger
+}
+
+// NewMultiStorage combines backends under the given save policy,
+// quorum is only used with SavePolicyQuorum.
+func NewMultiStorage(log logging.StandardLogger, policy SavePolicy, quorum int, backends ...Storage) (*MultiStorage, error) {
+	if policy == "" {
+		policy = DEFAULT_SAVE_POLICY
+	}
+	required, err := policy.required(len(backends), quorum)
+	if err != nil {
+		return nil, err
+	}
+	return &MultiStorage{backends: backends, policy: policy, required: required, log: log}, nil
+}
+
+func (ms *MultiStorage) Name() string {
+	return "multi"
+}
+
+func (ms *MultiStorage) Backends() []Storage {
+	return ms.backends
+}
+
+// Save writes objects to all backends, even if some of them fail.
+// Failures are only reported (as *SavePolicyError) when
+// they prevent the save policy from being satisfied.
+func (ms *MultiStorage) Save(objs ObjectsToSave) error {
+	var errs []error
+	for _, b := range ms.backends {
+		if err := b.Save(objs); err != nil {
+			ms.log.Errorf("%s: Error saving submission: %v", b.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+		}
+	}
+	succeeded := len(ms.backends) - len(errs)
+	if succeeded < ms.required {
+		return &SavePolicyError{
+			Policy:    ms.policy,
+			Succeeded: succeeded,
+			Required:  ms.required,
+			Err:       errors.Join(errs...),
+		}
+	}
+	return nil
+}
+
+// Exists reports whether any of the backends has the object stored.
+func (ms *MultiStorage) Exists(path string) (bool, error) {
+	var errs []error
+	for _, b := range ms.backends {
+		exists, err := b.Exists(path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	return false, errors.Join(errs...)
+}
+
+func (ms *MultiStorage) HealthCheck() error {
+	var errs []error
+	for _, b := range ms.backends {
+		if err := b.HealthCheck(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ms *MultiStorage) Close() error {
+	var errs []error
+	for _, b := range ms.backends {
+		if err := b.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
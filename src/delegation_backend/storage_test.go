@@ -0,0 +1,188 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// testStorage keeps saved objects in memory and can be told to fail.
+type testStorage struct {
+	name    string
+	mutex   sync.Mutex
+	objs    ObjectsToSave
+	saveErr error
+	closed  bool
+}
+
+func newTestStorage(name string) *testStorage {
+	return &testStorage{name: name, objs: make(ObjectsToSave)}
+}
+
+func (s *testStorage) Name() string {
+	return s.name
+}
+
+func (s *testStorage) Save(objs ObjectsToSave) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.saveErr != nil {
+		return s.saveErr
+	}
+	for path, value := range objs {
+		s.objs[path] = value
+	}
+	return nil
+}
+
+func (s *testStorage) Exists(path string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, exists := s.objs[path]
+	return exists, nil
+}
+
+func (s *testStorage) HealthCheck() error {
+	return s.saveErr
+}
+
+func (s *testStorage) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestMultiStorageSave(t *testing.T) {
+	ok := newTestStorage("ok")
+	failing := newTestStorage("failing")
+	failing.saveErr = errors.New("connection refused")
+	ms, err := NewMultiStorage(logging.Logger("delegation backend test"), SavePolicyAll, 0, ok, failing)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ms.Save(ObjectsToSave{"blocks/a.dat": []byte{1}})
+	if err == nil || !errors.Is(err, failing.saveErr) {
+		t.Fatalf("expected error of failing backend, got: %v", err)
+	}
+	if !bytes.Equal(ok.objs["blocks/a.dat"], []byte{1}) {
+		t.Fatal("healthy backend should still receive the objects")
+	}
+	exists, err := ms.Exists("blocks/a.dat")
+	if err != nil || !exists {
+		t.Fatalf("expected object to exist, got: %v, %v", exists, err)
+	}
+	if ms.HealthCheck() == nil {
+		t.Fatal("expected health check to report failing backend")
+	}
+	if err := ms.Close(); err != nil || !ok.closed || !failing.closed {
+		t.Fatal("expected all backends to be closed")
+	}
+}
+
+func TestSavePolicies(t *testing.T) {
+	testCases := []struct {
+		policy     SavePolicy
+		quorum     int
+		failing    int
+		shouldFail bool
+	}{
+		{SavePolicyAll, 0, 0, false},
+		{SavePolicyAll, 0, 1, true},
+		{SavePolicyAny, 0, 2, false},
+		{SavePolicyAny, 0, 3, true},
+		{SavePolicyQuorum, 2, 1, false},
+		{SavePolicyQuorum, 2, 2, true},
+		{"", 0, 2, false},
+	}
+	for _, tc := range testCases {
+		backends := make([]Storage, 3)
+		for i := range backends {
+			b := newTestStorage(fmt.Sprintf("backend-%d", i))
+			if i < tc.failing {
+				b.saveErr = errors.New("unavailable")
+			}
+			backends[i] = b
+		}
+		ms, err := NewMultiStorage(logging.Logger("delegation backend test"), tc.policy, tc.quorum, backends...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ms.Save(ObjectsToSave{"blocks/a.dat": []byte{1}})
+		var policyErr *SavePolicyError
+		if tc.shouldFail != errors.As(err, &policyErr) {
+			t.Errorf("policy %s (quorum %d) with %d failing backends: unexpected result %v", tc.policy, tc.quorum, tc.failing, err)
+		}
+	}
+	for _, quorum := range []int{0, 4} {
+		if _, err := NewMultiStorage(logging.Logger("delegation backend test"), SavePolicyQuorum, quorum, newTestStorage("a"), newTestStorage("b"), newTestStorage("c")); err == nil {
+			t.Errorf("expected quorum %d to be rejected", quorum)
+		}
+	}
+	if _, err := NewMultiStorage(logging.Logger("delegation backend test"), "most", 0, newTestStorage("a")); err == nil {
+		t.Error("expected unknown policy to be rejected")
+	}
+}
+
+func TestNewStoragesFromConfig(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	storages, err := NewStorages(context.Background(), AppConfig{}, log)
+	if err != nil || len(storages) != 0 {
+		t.Fatalf("expected no backends for empty config, got: %v, %v", storages, err)
+	}
+
+	dir := t.TempDir()
+	storages, err = NewStorages(context.Background(), AppConfig{LocalFileSystem: &LocalFileSystemConfig{Path: dir}}, log)
+	if err != nil || len(storages) != 1 || storages[0].Name() != "filesystem" {
+		t.Fatalf("expected filesystem backend, got: %v, %v", storages, err)
+	}
+}
+
+func TestLocalFileSystemStorage(t *testing.T) {
+	fs := &LocalFileSystemContext{Directory: t.TempDir(), Log: logging.Logger("delegation backend test")}
+	path := "submissions/2021-07-01/2021-07-01T16:21:33Z-B62qkaKV3BLvLTf7nYXRehSaZAd36NWijt3MEmy2QgHRavboeRGtBMN.json"
+	if exists, err := fs.Exists(path); err != nil || exists {
+		t.Fatalf("unexpected object before save: %v, %v", exists, err)
+	}
+	if err := fs.Save(ObjectsToSave{path: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := fs.Exists(path); err != nil || !exists {
+		t.Fatalf("expected object after save: %v, %v", exists, err)
+	}
+	if err := fs.HealthCheck(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubmissionColumnsBatched(t *testing.T) {
+	var req submitRequest
+	if err := json.Unmarshal(readTestFile("req-no-snark", t), &req); err != nil {
+		t.Fatal(err)
+	}
+	blockHash := req.GetBlockDataHash()
+	for _, batched := range []bool{false, true} {
+		meta, err := req.MakeMetaToBeSaved(blockHash, "127.0.0.1:8080", "127.0.0.1", batched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps := makePaths(req.Data.CreatedAt, blockHash, req.Submitter)
+		objs := ObjectsToSave{ps.Meta: meta, ps.Block: req.Data.Block.data}
+		submission, err := objectToSaveToSubmission(objs, logging.Logger("delegation backend test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		columns, values := submissionColumns(submission, true, true)
+		if len(columns) != len(values) || columns[len(columns)-1] != "batched" {
+			t.Fatalf("unexpected columns: %v", columns)
+		}
+		if values[len(values)-1] != batched {
+			t.Fatalf("expected batched to be written as %v, got %v", batched, values[len(values)-1])
+		}
+	}
+}
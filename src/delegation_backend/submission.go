@@ -14,12 +14,14 @@ type Submission struct {
 	SubmittedAt        time.Time // Extracted from filePath and parsed
 	CreatedAt          time.Time `json:"created_at"`
 	RemoteAddr         string    `json:"remote_addr"`
+	ClientIP           string    `json:"client_ip,omitempty"`
 	PeerId             string    `json:"peer_id"`
 	Submitter          string    `json:"submitter"` // is base58check-encoded submitter's public key
 	RawBlock           []byte    `json:"raw_block,omitempty"`
 	SnarkWork          []byte    `json:"snark_work,omitempty"`
 	GraphqlControlPort int       `json:"graphql_control_port,omitempty"`
 	BuiltWithCommitSha string    `json:"built_with_commit_sha,omitempty"`
+	Batched            bool      `json:"batched,omitempty"`
 }
 
 type Block struct {
@@ -32,7 +34,9 @@ type Logger interface {
 	Errorf(format string, args ...interface{})
 }
 
-func parseSubmissionBytes(data []byte, filePath string) (*Submission, error) {
+// parseSubmissionPath extracts submitted_at_date, submitted_at and submitter
+// out of a submission path of the form submissions/<date>/<submitted_at>-<submitter>.json
+func parseSubmissionPath(filePath string) (*Submission, error) {
 	// Extract information from filePath
 	filePathParts := strings.Split(filePath, "/")
 	if len(filePathParts) < 3 {
@@ -41,6 +45,9 @@ func parseSubmissionBytes(data []byte, filePath string) (*Submission, error) {
 	submittedAtDate := filePathParts[1]
 	submittedAtWithSubmitter := strings.TrimSuffix(filePathParts[2], ".json")
 	lastHyphenIndex := strings.LastIndex(submittedAtWithSubmitter, "-")
+	if lastHyphenIndex < 0 {
+		return nil, fmt.Errorf("invalid file path: %s", filePath)
+	}
 	submittedAtStr := submittedAtWithSubmitter[:lastHyphenIndex]
 
 	// Parse submittedAtStr string into time.Time
@@ -49,6 +56,19 @@ func parseSubmissionBytes(data []byte, filePath string) (*Submission, error) {
 		return nil, fmt.Errorf("error parsing submitted_at string: %w", err)
 	}
 
+	return &Submission{
+		SubmittedAtDate: submittedAtDate,
+		SubmittedAt:     submittedAt,
+		Submitter:       submittedAtWithSubmitter[lastHyphenIndex+1:],
+	}, nil
+}
+
+func parseSubmissionBytes(data []byte, filePath string) (*Submission, error) {
+	fromPath, err := parseSubmissionPath(filePath)
+	if err != nil {
+		return nil, err
+	}
+
 	// Parse JSON contents
 	var submission Submission
 	err = json.Unmarshal(data, &submission)
@@ -57,8 +77,8 @@ func parseSubmissionBytes(data []byte, filePath string) (*Submission, error) {
 	}
 
 	// Populate additional fields from filePath
-	submission.SubmittedAtDate = submittedAtDate
-	submission.SubmittedAt = submittedAt
+	submission.SubmittedAtDate = fromPath.SubmittedAtDate
+	submission.SubmittedAt = fromPath.SubmittedAt
 
 	return &submission, nil
 }
@@ -89,11 +109,13 @@ func objectToSaveToSubmission(objs ObjectsToSave, logger Logger) (*Submission, e
 			submissionToSave.GraphqlControlPort = submission.GraphqlControlPort
 			submissionToSave.PeerId = submission.PeerId
 			submissionToSave.RemoteAddr = submission.RemoteAddr
+			submissionToSave.ClientIP = submission.ClientIP
 			submissionToSave.SnarkWork = submission.SnarkWork
 			submissionToSave.SubmittedAt = submission.SubmittedAt
 			submissionToSave.SubmittedAtDate = submission.SubmittedAtDate
 			submissionToSave.Submitter = submission.Submitter
 			submissionToSave.BuiltWithCommitSha = submission.BuiltWithCommitSha
+			submissionToSave.Batched = submission.Batched
 
 		} else if strings.HasPrefix(path, "blocks/") {
 			block, err := parseBlockBytes(bs, path)
@@ -2,116 +2,89 @@ package delegation_backend
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
-	"os"
-	"path/filepath"
+	"net/netip"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	logging "github.com/ipfs/go-log/v2"
-	"golang.org/x/crypto/blake2b"
 )
 
 type errorResponse struct {
-	Msg string `json:"error"`
+	Msg       string `json:"error"`
+	Retryable bool   `json:"retryable,omitempty"`
 }
 
 func writeErrorResponse(app *App, w *http.ResponseWriter, msg string) {
-	app.Log.Debugf("Responding with error: %s", msg)
-	bs, err := json.Marshal(errorResponse{msg})
-	if err == nil {
-		_, err2 := io.Copy(*w, bytes.NewReader(bs))
-		if err2 != nil {
-			app.Log.Debugf("Failed to respond with error status: %v", err2)
-		}
-	} else {
-		app.Log.Fatal("Failed to json-marshal error message")
-	}
+	writeErrorResponseImpl(app, w, errorResponse{Msg: msg})
 }
 
-func (ctx *AwsContext) S3Save(objs ObjectsToSave) {
-	for path, bs := range objs {
-		fullKey := aws.String(ctx.Prefix + "/" + path)
-		if strings.HasPrefix(path, "blocks/") {
-			_, err := ctx.Client.HeadObject(ctx.Context, &s3.HeadObjectInput{
-				Bucket: ctx.BucketName,
-				Key:    fullKey,
-			})
-			if err == nil {
-				//block already exists, skipping
-				continue
-			}
-			if !strings.Contains(err.Error(), "NotFound") {
-				ctx.Log.Warnf("S3Save: Error when checking if block exists, but will continue with block save: %s, error: %v", path, err)
-			}
-		}
+// writeRetryableErrorResponse tells the submitter that the request
+// failed due to a temporary condition and should be sent again.
+func writeRetryableErrorResponse(app *App, w *http.ResponseWriter, msg string) {
+	writeErrorResponseImpl(app, w, errorResponse{Msg: msg, Retryable: true})
+}
 
-		ctx.Log.Infof("S3Save: saving %s", path)
-		_, err := ctx.Client.PutObject(ctx.Context, &s3.PutObjectInput{
-			Bucket:     ctx.BucketName,
-			Key:        fullKey,
-			Body:       bytes.NewReader(bs),
-			ContentMD5: nil,
-		})
-		if err != nil {
-			ctx.Log.Warnf("S3Save: Error while saving metadata: %v", err)
-		}
+// writeRateLimitedResponse tells the client when it may send
+// the next request, if known.
+func writeRateLimitedResponse(app *App, w *http.ResponseWriter, retryAfter time.Duration, msg string) {
+	if retryAfter > 0 {
+		(*w).Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
 	}
+	(*w).WriteHeader(429)
+	writeErrorResponse(app, w, msg)
 }
 
-func LocalFileSystemSave(objs ObjectsToSave, directory string, log logging.StandardLogger) {
-	for path, bs := range objs {
-		fullPath := filepath.Join(directory, path)
-
-		// Check if file exists
-		if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
-			log.Warnf("LocalFileSystemSave: file already exists: %s", fullPath)
-			continue // skip to the next object
-		}
-
-		err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
-		if err != nil {
-			log.Errorf("LocalFileSystemSave: Error creating directories for %s: %v", fullPath, err)
-			continue // skip to the next object
-		}
-		log.Infof("LocalFileSystemSave: saving %s", fullPath)
-		err = os.WriteFile(fullPath, bs, 0644)
-		if err != nil {
-			log.Warnf("Error writing to file %s: %v", fullPath, err)
+func writeErrorResponseImpl(app *App, w *http.ResponseWriter, resp errorResponse) {
+	app.Log.Debugf("Responding with error: %s", resp.Msg)
+	bs, err := json.Marshal(resp)
+	if err == nil {
+		_, err2 := io.Copy(*w, bytes.NewReader(bs))
+		if err2 != nil {
+			app.Log.Debugf("Failed to respond with error status: %v", err2)
 		}
+	} else {
+		app.Log.Fatal("Failed to json-marshal error message")
 	}
 }
 
 type ObjectsToSave map[string][]byte
 
-type AwsContext struct {
-	Client     *s3.Client
-	BucketName *string
-	Prefix     string
-	Context    context.Context
-	Log        *logging.ZapEventLogger
-}
-
 type App struct {
 	Log                     *logging.ZapEventLogger
-	SubmitCounter           *AttemptCounter
+	SubmitCounter           RateLimiter
+	RequestLimiter          *RequestLimiter
+	ClientIPs               *ClientIPResolver
 	Whitelist               *WhitelistMVar
 	WhitelistDisabled       bool
 	VerifySignatureDisabled bool
+	SignatureCache          *SignatureCache
+	CreatedAtMaxAge         time.Duration // no limit if 0
+	BatchCreatedAtMaxAge    time.Duration // of submissions sent in a batch, no limit if 0
+	ReplayCache             ReplayCache
+	MemoryBudget            *MemoryBudget
+	BodyReadTimeout         time.Duration // no deadline if 0
+	Blocklist               *Blocklist
 	NetworkId               uint8
-	Save                    func(ObjectsToSave)
+	Storage                 Storage
 	Now                     nowFunc
-	IsReady                 bool
+	IsReady                 atomic.Bool
 }
 
+// submitDecodeFunc decodes a body in the format of a version of the submit endpoint.
+type submitDecodeFunc func(r io.Reader) (*decodedSubmitRequest, error)
+
+// SubmitH serves both /v1/submit and /v2/submit, which only differ in decode.
 type SubmitH struct {
-	app *App
+	app    *App
+	decode submitDecodeFunc
 }
 
 type Paths struct {
@@ -134,109 +107,332 @@ var nilSig Sig
 var nilPk Pk
 var nilTime time.Time
 
-func (h *SubmitH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// readRequest runs the checks applying to a request as a whole and decodes
+// its body with decode. If the request is refused, it responds and returns
+// false, otherwise release must be called once the decoded body isn't used.
+func (h *SubmitH) readRequest(w http.ResponseWriter, r *http.Request, decode func(body io.Reader) error) (clientIP netip.Addr, release func(), ok bool) {
 	if r.ContentLength == -1 {
+		recordRejection(rejectionLengthRequired)
 		w.WriteHeader(411)
-		return
+		return clientIP, nil, false
 	} else if r.ContentLength > MAX_SUBMIT_PAYLOAD_SIZE {
+		recordRejection(rejectionPayloadTooLarge)
 		w.WriteHeader(413)
-		return
+		return clientIP, nil, false
+	}
+	clientIP = h.app.ClientIPs.ClientIP(r)
+	if h.app.Blocklist.CheckIP(clientIP) != nil {
+		recordRejection(rejectionBlocked)
+		w.WriteHeader(403)
+		writeErrorResponse(h.app, &w, "Submissions from this address are blocked")
+		return clientIP, nil, false
+	}
+	// The address limit is checked first, so that a client
+	// exceeding it doesn't use up the global limit
+	if ok, retryAfter := h.app.RequestLimiter.AllowIP(clientIP.String()); !ok {
+		recordRejection(rejectionIPRateLimited)
+		writeRateLimitedResponse(h.app, &w, retryAfter, "Too many requests from this address")
+		return clientIP, nil, false
 	}
-	body, err1 := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
-	if err1 != nil || int64(len(body)) != r.ContentLength {
-		h.app.Log.Debugf("Error while reading /submit request's body: %v", err1)
+	if ok, retryAfter := h.app.RequestLimiter.AllowGlobal(); !ok {
+		recordRejection(rejectionGlobalRateLimited)
+		writeRateLimitedResponse(h.app, &w, retryAfter, "Server is busy, too many requests")
+		return clientIP, nil, false
+	}
+	encoding := requestEncoding(r.Header)
+	decodedLimit := decodedSizeLimit(encoding, r.ContentLength)
+	if h.app.BodyReadTimeout > 0 {
+		// A slow client holds its reservation at most until the deadline,
+		// the deadline is lifted once the body is read for the response
+		// not to be cut short by it
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(h.app.BodyReadTimeout)); err == nil {
+			defer rc.SetReadDeadline(time.Time{})
+		}
+	}
+
+	// The body is decompressed and decoded as it's read, see submitDecoder,
+	// reserving decompressed bytes in the memory budget as they arrive
+	body := &countingReader{r: io.LimitReader(r.Body, r.ContentLength)}
+	content, err := newContentDecoder(encoding, body, decodedLimit)
+	if errors.Is(err, errUnsupportedEncoding) {
+		recordRejection(rejectionUnsupportedEncoding)
+		w.WriteHeader(415)
+		writeErrorResponse(h.app, &w, fmt.Sprintf("Unsupported content encoding: %s", encoding))
+		return clientIP, nil, false
+	}
+	budget := &budgetReader{r: content, budget: h.app.MemoryBudget}
+	defer func() {
+		if !ok {
+			budget.release()
+		}
+	}()
+	err1 := err
+	if err == nil {
+		err1 = decode(budget)
+		content.Close()
+	}
+	if errors.Is(err1, errMemoryBudget) {
+		recordRejection(rejectionMemoryBudget)
+		w.Header().Set("Retry-After", MEMORY_BUDGET_RETRY_AFTER)
+		w.WriteHeader(503)
+		writeRetryableErrorResponse(h.app, &w, "Server is busy, please retry")
+		return clientIP, nil, false
+	}
+	if body.err != nil || ((err1 == nil || errors.Is(err1, io.ErrUnexpectedEOF)) && body.n != r.ContentLength) {
+		h.app.Log.Debugf("Error while reading /submit request's body: %v", body.err)
+		recordRejection(rejectionMalformed)
 		w.WriteHeader(400)
 		writeErrorResponse(h.app, &w, "Error reading the body")
-		return
+		return clientIP, nil, false
 	}
-
-	var req submitRequest
-	if err := json.Unmarshal(body, &req); err != nil {
-		h.app.Log.Debugf("Error while unmarshaling JSON of /submit request's body: %v", err)
+	if errors.Is(err1, errDecodedTooLarge) {
+		recordRejection(rejectionPayloadTooLarge)
+		w.WriteHeader(413)
+		writeErrorResponse(h.app, &w, "Decompressed payload is too large")
+		return clientIP, nil, false
+	}
+	if errors.Is(err1, errBatchTooLarge) {
+		recordRejection(rejectionPayloadTooLarge)
+		w.WriteHeader(413)
+		writeErrorResponse(h.app, &w, fmt.Sprintf("Batch has more than %d submissions", MAX_SUBMIT_BATCH_SIZE))
+		return clientIP, nil, false
+	}
+	if err1 != nil {
+		h.app.Log.Debugf("Error while decoding /submit request's body: %v", err1)
+		recordRejection(rejectionMalformed)
 		w.WriteHeader(400)
 		writeErrorResponse(h.app, &w, "Error decoding payload")
+		return clientIP, nil, false
+	}
+	return clientIP, budget.release, true
+}
+
+func (h *SubmitH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var decoded *decodedSubmitRequest
+	clientIP, release, ok := h.readRequest(w, r, func(body io.Reader) (err error) {
+		decoded, err = h.decode(body)
+		return
+	})
+	if !ok {
+		return
+	}
+	defer release()
+
+	submittedAt := h.app.Now()
+	res, ok := h.precheck(decoded.submitRequest, submittedAt, h.app.CreatedAtMaxAge)
+	if ok && !h.app.VerifySignatureDisabled && !h.app.SignatureCache.Verify(h.signatureCheck(decoded)) {
+		res, ok = invalidSignatureResult, false
+	}
+	if ok {
+		res = h.accept(decoded, submittedAt, h.origin(r, clientIP))
+	}
+	h.writeResult(w, res)
+}
+
+// submitResult is the outcome of a single submission, written as the
+// response of /submit or as an item of the response of /submit/batch.
+type submitResult struct {
+	code       int // 200 if the submission was accepted
+	msg        string
+	rejection  string // reason recorded in metrics
+	retryable  bool
+	retryAfter string // seconds, sent in Retry-After header if set
+}
+
+var acceptedResult = submitResult{code: 200}
+var invalidSignatureResult = rejected(401, rejectionInvalidSignature, "Invalid signature")
+
+func rejected(code int, rejection string, msg string) submitResult {
+	return submitResult{code: code, msg: msg, rejection: rejection}
+}
+
+func rateLimited(rejection string, retryAfter time.Duration, msg string) submitResult {
+	res := rejected(429, rejection, msg)
+	if retryAfter > 0 {
+		res.retryAfter = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+	}
+	return res
+}
+
+func (h *SubmitH) writeResult(w http.ResponseWriter, res submitResult) {
+	if res.code != 200 {
+		recordRejection(res.rejection)
+		if res.retryAfter != "" {
+			w.Header().Set("Retry-After", res.retryAfter)
+		}
+		w.WriteHeader(res.code)
+		writeErrorResponseImpl(h.app, &w, errorResponse{Msg: res.msg, Retryable: res.retryable})
 		return
 	}
+	_, err2 := io.Copy(w, bytes.NewReader([]byte("{\"status\":\"ok\"}")))
+	if err2 != nil {
+		h.app.Log.Debugf("Error while responding with ok status to the user: %v", err2)
+	}
+}
 
+// submitOrigin is where a submission came from, as stored along with it.
+type submitOrigin struct {
+	remoteAddr string
+	clientIP   string
+	batched    bool // sent in a batch rather than alone
+}
+
+func (h *SubmitH) origin(r *http.Request, clientIP netip.Addr) submitOrigin {
+	o := submitOrigin{remoteAddr: h.app.ClientIPs.RawRemoteAddr(r)}
+	if clientIP.IsValid() {
+		o.clientIP = clientIP.String()
+	}
+	return o
+}
+
+// precheck runs the checks preceding signature verification, which are cheap
+// and don't need the submission to be authentic, returning false if one fails.
+// created_at may be at most maxAge old, unless maxAge is 0.
+func (h *SubmitH) precheck(req submitRequest, submittedAt time.Time, maxAge time.Duration) (submitResult, bool) {
 	if !req.CheckRequiredFields() {
 		h.app.Log.Debug("One of required fields wasn't provided")
-		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "One of required fields wasn't provided")
-		return
+		return rejected(400, rejectionMissingFields, "One of required fields wasn't provided"), false
+	}
+
+	if e := h.app.Blocklist.CheckSubmission(req.Submitter, req.Data.PeerId); e != nil {
+		h.app.Log.Debugf("Submission blocked by %s %s", e.Kind, e.Value)
+		return rejected(403, rejectionBlocked, fmt.Sprintf("Submissions from this %s are blocked", strings.ReplaceAll(e.Kind, "_", " "))), false
 	}
 
 	if !h.app.WhitelistDisabled {
 		wl := h.app.Whitelist.ReadWhitelist()
-		if (*wl)[req.Submitter] == nil {
-			w.WriteHeader(401)
-			message := fmt.Sprintf("Submitter is not registered: %s", req.Submitter)
-			writeErrorResponse(h.app, &w, message)
-			return
+		entry := (*wl)[req.Submitter]
+		if entry == nil {
+			return rejected(401, rejectionNotWhitelisted, fmt.Sprintf("Submitter is not registered: %s", req.Submitter)), false
+		}
+		if err := entry.CheckEnrollment(submittedAt); err != nil {
+			return rejected(403, rejectionOutsideEnrollment, fmt.Sprintf("Submitter %v: %s", err, req.Submitter)), false
 		}
 	}
 
-	submittedAt := h.app.Now()
 	if req.Data.CreatedAt.Add(TIME_DIFF_DELTA).After(submittedAt) {
 		h.app.Log.Debugf("Field created_at is a timestamp in future: %v", submittedAt)
-		w.WriteHeader(400)
-		writeErrorResponse(h.app, &w, "Field created_at is a timestamp in future")
-		return
+		return rejected(400, rejectionFutureCreatedAt, "Field created_at is a timestamp in future"), false
+	}
+	if maxAge > 0 && req.Data.CreatedAt.Add(maxAge).Before(submittedAt) {
+		h.app.Log.Debugf("Field created_at is too old: %v", req.Data.CreatedAt)
+		return rejected(400, rejectionStaleCreatedAt, "Field created_at is too old"), false
 	}
+	return acceptedResult, true
+}
 
-	if !h.app.VerifySignatureDisabled {
-		payload, err := req.Data.MakeSignPayload()
-		if err != nil {
-			h.app.Log.Errorf("Error while making sign payload: %v", err)
-			w.WriteHeader(500)
-			writeErrorResponse(h.app, &w, "Unexpected server error")
-			return
-		}
+func (h *SubmitH) signatureCheck(decoded *decodedSubmitRequest) SignatureCheck {
+	return SignatureCheck{
+		Submitter: decoded.Submitter,
+		Sig:       decoded.Sig,
+		Hash:      decoded.SignHash,
+		NetworkId: h.app.NetworkId,
+	}
+}
 
-		hash := blake2b.Sum256(payload)
-		if !verifySig(&req.Submitter, &req.Sig, hash[:], h.app.NetworkId) {
-			w.WriteHeader(401)
-			writeErrorResponse(h.app, &w, "Invalid signature")
-			return
+// accept runs the checks following signature verification and saves the
+// submission under storedAt, which is the time it was received, or its
+// created_at for a submission sent in a batch.
+func (h *SubmitH) accept(decoded *decodedSubmitRequest, storedAt time.Time, origin submitOrigin) submitResult {
+	req := decoded.submitRequest
+
+	// Replays are rejected before rate limits, so that they don't use up limits of
+	// the submitter. The signature is forgotten if the submission isn't accepted.
+	if h.app.ReplayCache != nil {
+		if !h.app.ReplayCache.Record(req.Submitter, req.Sig, h.replayExpiresAt(req)) {
+			return rejected(409, rejectionReplayed, "Submission was already received")
 		}
 	}
 
+	// Peer id isn't authenticated, so it's only limited once the signature is checked
+	if ok, retryAfter := h.app.RequestLimiter.AllowPeer(req.Data.PeerId); !ok {
+		h.forgetSignature(req)
+		return rateLimited(rejectionPeerRateLimited, retryAfter, "Too many requests from this peer")
+	}
+
 	passesAttemptLimit := h.app.SubmitCounter.RecordAttempt(req.Submitter)
 	if !passesAttemptLimit {
-		w.WriteHeader(429)
-		writeErrorResponse(h.app, &w, "Too many requests per hour")
-		return
+		h.forgetSignature(req)
+		return rateLimited(rejectionRateLimited, h.app.SubmitCounter.RetryAfter(req.Submitter), "Too many requests per hour")
 	}
 
-	blockHash := req.GetBlockDataHash()
-	ps := makePaths(submittedAt, blockHash, req.Submitter)
-
-	remoteAddr := r.Header.Get("X-Forwarded-For")
-	if remoteAddr == "" {
-		// If there is no X-Forwarded-For header, use the remote address
-		remoteAddr = r.RemoteAddr
-	}
+	blockHash := decoded.BlockHash
+	ps := makePaths(storedAt, blockHash, req.Submitter)
 
-	metaBytes, err1 := req.MakeMetaToBeSaved(remoteAddr)
+	metaBytes, err1 := req.MakeMetaToBeSaved(blockHash, origin.remoteAddr, origin.clientIP, origin.batched)
 	if err1 != nil {
 		h.app.Log.Errorf("Error while marshaling JSON for metaToBeSaved: %v", err1)
-		w.WriteHeader(500)
-		writeErrorResponse(h.app, &w, "Unexpected server error")
-		return
+		h.forgetSignature(req)
+		return rejected(500, rejectionInternalError, "Unexpected server error")
 	}
 
 	toSave := make(ObjectsToSave)
 	toSave[ps.Meta] = metaBytes
 	toSave[ps.Block] = []byte(req.Data.Block.data)
-	h.app.Save(toSave)
+	if err := h.app.Storage.Save(toSave); err != nil {
+		h.app.Log.Errorf("Error while saving submission: %v", err)
+		h.forgetSignature(req)
+		// The submitter is asked to retry, which shouldn't use up its limit
+		h.app.SubmitCounter.ForgetAttempt(req.Submitter)
+		var res submitResult
+		if errors.Is(err, ErrSaveQueueFull) {
+			res = rejected(503, rejectionStorageBusy, "Server is busy, please retry")
+		} else {
+			res = rejected(503, rejectionStorageFailure, "Submission could not be stored, please retry")
+		}
+		res.retryable = true
+		res.retryAfter = SAVE_RETRY_AFTER
+		return res
+	}
+	return acceptedResult
+}
 
-	_, err2 := io.Copy(w, bytes.NewReader([]byte("{\"status\":\"ok\"}")))
-	if err2 != nil {
-		h.app.Log.Debugf("Error while responding with ok status to the user: %v", err2)
+// replayExpiresAt returns the time until which the submission can't be
+// replayed: until it's too old to be accepted, alone or in a batch.
+// It doesn't depend on the time the submission was received, so that a
+// captured request can't be replayed once its signature is forgotten.
+func (h *SubmitH) replayExpiresAt(req submitRequest) time.Time {
+	maxAge := h.app.CreatedAtMaxAge
+	if h.app.BatchCreatedAtMaxAge > maxAge {
+		maxAge = h.app.BatchCreatedAtMaxAge
+	}
+	return req.Data.CreatedAt.Add(maxAge)
+}
+
+func (h *SubmitH) forgetSignature(req submitRequest) {
+	if h.app.ReplayCache != nil {
+		h.app.ReplayCache.Forget(req.Submitter, req.Sig)
+	}
+}
+
+// countingReader counts bytes read and keeps the error
+// of the underlying reader, if it isn't io.EOF.
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
 	}
+	return n, err
 }
 
 func (app *App) NewSubmitH() *SubmitH {
 	s := new(SubmitH)
 	s.app = app
+	s.decode = decodeSubmitRequest
+	return s
+}
+
+// NewSubmitV2H serves the binary /v2/submit, see decodeSubmitRequestV2.
+func (app *App) NewSubmitV2H() *SubmitH {
+	s := app.NewSubmitH()
+	s.decode = decodeSubmitRequestV2
 	return s
 }
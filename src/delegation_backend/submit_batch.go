@@ -0,0 +1,147 @@
+package delegation_backend
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// SubmitBatchH serves /v1/submit/batch, which accepts submissions a node
+// buffered while it couldn't reach the service. Every submission of the
+// batch is checked as if it was sent to /v1/submit alone, and the response
+// has a result for every one of them.
+type SubmitBatchH struct {
+	submit *SubmitH
+}
+
+func (app *App) NewSubmitBatchH() *SubmitBatchH {
+	return &SubmitBatchH{submit: app.NewSubmitH()}
+}
+
+type batchResponse struct {
+	Results []batchItemResult `json:"results"`
+}
+
+// batchItemResult is the outcome of a submission of a batch, in the
+// order of the request. Code is the status /v1/submit would respond with.
+type batchItemResult struct {
+	Status     string `json:"status"` // "ok" or "error"
+	Code       int    `json:"code"`
+	Error      string `json:"error,omitempty"`
+	Retryable  bool   `json:"retryable,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+func (res submitResult) batchItem() batchItemResult {
+	if res.code == 200 {
+		return batchItemResult{Status: "ok", Code: res.code}
+	}
+	retryAfter, _ := strconv.Atoi(res.retryAfter)
+	return batchItemResult{
+		Status:     "error",
+		Code:       res.code,
+		Error:      res.msg,
+		Retryable:  res.retryable,
+		RetryAfter: retryAfter,
+	}
+}
+
+// batchKey identifies the place of a submission in storage:
+// its submitter and the second it's stored under.
+type batchKey struct {
+	submitter Pk
+	second    int64
+}
+
+func (h *SubmitBatchH) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sh := h.submit
+	app := sh.app
+	var reqs []*decodedSubmitRequest
+	clientIP, release, ok := sh.readRequest(w, r, func(body io.Reader) (err error) {
+		reqs, err = decodeSubmitBatch(body)
+		return
+	})
+	if !ok {
+		return
+	}
+	defer release()
+
+	submittedAt := app.Now()
+	results := make([]submitResult, len(reqs))
+	var pending []int
+	var checks []SignatureCheck
+	for i, req := range reqs {
+		// Every submission counts against limits of the address and the
+		// global one, the first one was counted along with the request
+		if i > 0 {
+			if ok, retryAfter := app.RequestLimiter.AllowIP(clientIP.String()); !ok {
+				results[i] = rateLimited(rejectionIPRateLimited, retryAfter, "Too many requests from this address")
+				continue
+			}
+			if ok, retryAfter := app.RequestLimiter.AllowGlobal(); !ok {
+				results[i] = rateLimited(rejectionGlobalRateLimited, retryAfter, "Server is busy, too many requests")
+				continue
+			}
+		}
+		res, ok := sh.precheck(req.submitRequest, submittedAt, app.BatchCreatedAtMaxAge)
+		results[i] = res
+		if ok {
+			pending = append(pending, i)
+			checks = append(checks, sh.signatureCheck(req))
+		}
+	}
+
+	valid := make([]bool, len(checks))
+	if app.VerifySignatureDisabled {
+		for j := range valid {
+			valid[j] = true
+		}
+	} else {
+		valid = app.SignatureCache.VerifyBatch(checks, 0)
+	}
+
+	// Submissions are stored under their created_at, which is signed and
+	// never in the future, so that they're credited for the time the node
+	// couldn't reach the service without taking the place of submissions
+	// yet to come. A submitter has a single submission per second in
+	// storage, so a further one of the same second is refused.
+	origin := sh.origin(r, clientIP)
+	origin.batched = true
+	stored := make(map[batchKey]bool)
+	for j, i := range pending {
+		req := reqs[i]
+		if !valid[j] {
+			results[i] = invalidSignatureResult
+			continue
+		}
+		key := batchKey{req.Submitter, req.Data.CreatedAt.Unix()}
+		if stored[key] {
+			results[i] = rejected(409, rejectionDuplicate, "Submission of the same submitter and second of created_at is already in the batch")
+			continue
+		}
+		results[i] = sh.accept(req, req.Data.CreatedAt, origin)
+		if results[i].code == 200 {
+			stored[key] = true
+		}
+	}
+
+	resp := batchResponse{Results: make([]batchItemResult, len(results))}
+	for i, res := range results {
+		if res.code != 200 {
+			recordRejection(res.rejection)
+		}
+		resp.Results[i] = res.batchItem()
+	}
+	bs, err := json.Marshal(resp)
+	if err != nil {
+		app.Log.Errorf("Error while marshaling JSON of batch response: %v", err)
+		w.WriteHeader(500)
+		writeErrorResponse(app, &w, "Unexpected server error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(bs); err != nil {
+		app.Log.Debugf("Error while responding with batch results to the user: %v", err)
+	}
+}
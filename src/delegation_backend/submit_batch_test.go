@@ -0,0 +1,213 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const v1SubmitBatch = "http://127.0.0.1/v1/submit/batch"
+
+func (h *SubmitBatchH) testRequest(t *testing.T, items ...[]byte) (*httptest.ResponseRecorder, []batchItemResult) {
+	body, err := json.Marshal(map[string][]json.RawMessage{"submissions": rawMessages(items)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", v1SubmitBatch, bytes.NewReader(body))
+	h.ServeHTTP(recorder, req)
+	var resp batchResponse
+	if recorder.Code == 200 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed decoding batch response: %v", err)
+		}
+		if len(resp.Results) != len(items) {
+			t.Fatalf("expected %d results, got %d", len(items), len(resp.Results))
+		}
+	}
+	return recorder, resp.Results
+}
+
+func rawMessages(items [][]byte) []json.RawMessage {
+	res := make([]json.RawMessage, len(items))
+	for i, item := range items {
+		res[i] = item
+	}
+	return res
+}
+
+// modifiedTestRequest returns the test file with fields of data replaced.
+func modifiedTestRequest(t *testing.T, name string, data map[string]interface{}) []byte {
+	var req map[string]interface{}
+	if err := json.Unmarshal(readTestFile(name, t), &req); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range data {
+		req["data"].(map[string]interface{})[k] = v
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestSubmitBatch(t *testing.T) {
+	noSnark := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(noSnark, &req); err != nil {
+		t.Fatal(err)
+	}
+	var other submitRequest
+	if err := json.Unmarshal(readTestFile("req-v1-with-snark", t), &other); err != nil {
+		t.Fatal(err)
+	}
+	var withSnark submitRequest
+	if err := json.Unmarshal(readTestFile("req-with-snark", t), &withSnark); err != nil {
+		t.Fatal(err)
+	}
+	objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}, other.Submitter: {}})
+	sh.app.SubmitCounter = NewAttemptCounter(10, 0)
+	cache := NewMemoryReplayCache()
+	cache.now = tm.Now
+	sh.app.ReplayCache = cache
+	// Test requests were created years apart, signatures are remembered for as long
+	tm.time = other.Data.CreatedAt.Add(m)
+	sh.app.BatchCreatedAtMaxAge = tm.time.Sub(req.Data.CreatedAt) + h
+	h := sh.app.NewSubmitBatchH()
+	rep, results := h.testRequest(t,
+		noSnark,
+		// Same submitter and created_at as the first one
+		readTestFile("req-with-snark", t),
+		// Signed for another network
+		readTestFile("req-v1-with-snark", t),
+		modifiedTestRequest(t, "req-no-snark", map[string]interface{}{"peer_id": "tampered"}),
+		[]byte(`{}`),
+	)
+	if rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	for i, expected := range []int{200, 409, 401, 401, 400} {
+		if results[i].Code != expected {
+			t.Fatalf("expected submission %d to result in %d, got %+v", i, expected, results[i])
+		}
+	}
+	if results[0].Status != "ok" || results[2].Status != "error" || results[2].Error == "" {
+		t.Fatalf("unexpected results: %+v", results)
+	}
+
+	// Submissions are stored under their created_at, a further one of the
+	// same submitter and second isn't stored in place of the first one
+	ps := makePaths(req.Data.CreatedAt, req.GetBlockDataHash(), req.Submitter)
+	if (*objs)[ps.Meta] == nil || (*objs)[ps.Block] == nil || len(*objs) != 2 {
+		t.Fatalf("expected submission to be stored at %s", ps.Meta)
+	}
+	var meta MetaToBeSaved
+	if err := json.Unmarshal((*objs)[ps.Meta], &meta); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Batched || meta.CreatedAt != req.Data.CreatedAt.Format(time.RFC3339) {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+
+	// Submissions of the batch can't be replayed
+	if _, results := h.testRequest(t, noSnark); results[0].Code != 409 {
+		t.Fatalf("expected replayed submission to be rejected, got %+v", results[0])
+	}
+}
+
+func TestSubmitBatchLimits(t *testing.T) {
+	noSnark := readTestFile("req-no-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(noSnark, &req); err != nil {
+		t.Fatal(err)
+	}
+	objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.VerifySignatureDisabled = true
+	sh.app.BatchCreatedAtMaxAge = time.Hour
+	tm.time = req.Data.CreatedAt.Add(30 * m)
+	h := sh.app.NewSubmitBatchH()
+	item := func(createdAt time.Time) []byte {
+		return modifiedTestRequest(t, "req-no-snark", map[string]interface{}{"created_at": createdAt.Format(time.RFC3339)})
+	}
+	rep, results := h.testRequest(t,
+		noSnark,
+		item(req.Data.CreatedAt.Add(m)),
+		item(req.Data.CreatedAt.Add(-time.Hour)),
+	)
+	if rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	// Every submission counts against the attempt limit of the submitter
+	if results[0].Code != 200 || results[1].Code != 429 || results[1].RetryAfter <= 0 {
+		t.Fatalf("expected the second submission to be rate limited, got %+v", results)
+	}
+	if results[2].Code != 400 || !strings.Contains(results[2].Error, "too old") {
+		t.Fatalf("expected submission older than BatchCreatedAtMaxAge to be rejected, got %+v", results[2])
+	}
+	if len(*objs) != 2 {
+		t.Fatalf("expected a single submission to be stored, got %d objects", len(*objs))
+	}
+
+	sh.app.RequestLimiter = NewRequestLimiter(&RequestLimitsConfig{IPPerMinute: 2})
+	sh.app.SubmitCounter = NewAttemptCounter(10, 0)
+	_, results = h.testRequest(t, item(req.Data.CreatedAt.Add(2*m)), item(req.Data.CreatedAt.Add(3*m)), item(req.Data.CreatedAt.Add(4*m)))
+	if results[0].Code != 200 || results[1].Code != 200 || results[2].Code != 429 {
+		t.Fatalf("expected every submission to count against the address limit, got %+v", results)
+	}
+}
+
+func TestSubmitBatchMalformed(t *testing.T) {
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	h := sh.app.NewSubmitBatchH()
+	items := make([][]byte, MAX_SUBMIT_BATCH_SIZE+1)
+	for i := range items {
+		items[i] = []byte(`{}`)
+	}
+	if rep, _ := h.testRequest(t, items...); rep.Code != 413 {
+		t.Fatalf("expected batch exceeding MAX_SUBMIT_BATCH_SIZE to be rejected, got %v", rep)
+	}
+	if rep, _ := h.testRequest(t); rep.Code != 400 {
+		t.Fatalf("expected empty batch to be rejected, got %v", rep)
+	}
+	for _, body := range []string{`[]`, `{}`, `{"other": [{}]}`, `{"submissions": null}`, `{"submissions": {}}`, `{"submissions": [{}, ]}`, `{"submissions": []} []`} {
+		rep := httptest.NewRecorder()
+		sh.app.NewSubmitBatchH().ServeHTTP(rep, httptest.NewRequest("POST", v1SubmitBatch, strings.NewReader(body)))
+		if rep.Code != 400 {
+			t.Fatalf("expected %s to be rejected, got %v", body, rep)
+		}
+	}
+}
+
+func TestDecodeSubmitBatch(t *testing.T) {
+	var body bytes.Buffer
+	body.WriteString(`{"other": [1, {"a": "]"}], "Submissions": [`)
+	names := []string{"req-no-snark", "req-with-snark", "req-v1-with-snark"}
+	for i, f := range names {
+		if i > 0 {
+			body.WriteString(",\n")
+		}
+		body.Write(readTestFile(f, t))
+	}
+	body.WriteString("]}")
+	reqs, err := decodeSubmitBatch(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != len(names) {
+		t.Fatalf("expected %d requests, got %d", len(names), len(reqs))
+	}
+	for i, f := range names {
+		expected, err := decodeSubmitRequest(bytes.NewReader(readTestFile(f, t)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqs[i].SignHash != expected.SignHash || reqs[i].BlockHash != expected.BlockHash ||
+			reqs[i].Submitter != expected.Submitter || !bytes.Equal(reqs[i].Data.Block.data, expected.Data.Block.data) {
+			t.Fatalf("request %s decoded differently in a batch", f)
+		}
+	}
+}
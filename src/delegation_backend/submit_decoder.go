@@ -0,0 +1,444 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Size of base64 text of the block decoded at once, a multiple of 4
+const BLOCK_DECODE_CHUNK_SIZE = 64 * 1024
+
+var errMalformedRequest = errors.New("malformed request")
+var errBatchTooLarge = errors.New("too many submissions in the batch")
+
+// decodedSubmitRequest is a submit request along with hashes computed while decoding it.
+type decodedSubmitRequest struct {
+	submitRequest
+	SignHash  [blake2b.Size256]byte // of the sign payload
+	BlockHash string                // base58check-encoded, as returned by GetBlockDataHash
+}
+
+// submitDecoder decodes a body of /v1/submit request as it's read, instead of
+// buffering it: small fields are decoded as they come, while the block is
+// base64-decoded in chunks into its hash and contents. The JSON text of the
+// block isn't kept, the sign payload is hashed as it's read instead.
+type submitDecoder struct {
+	r         *bufio.Reader
+	signHash  hash.Hash
+	blockHash hash.Hash
+	req       decodedSubmitRequest
+	hasBlock  bool
+}
+
+// decodeSubmitRequest decodes a body of /v1/submit request.
+func decodeSubmitRequest(r io.Reader) (*decodedSubmitRequest, error) {
+	d := newSubmitDecoder(r)
+	req, err := d.request()
+	if err == nil {
+		err = d.end()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// decodeSubmitBatch decodes a body of /v1/submit/batch request, an object
+// with requests in the submissions array, failing with errBatchTooLarge
+// if there are more than MAX_SUBMIT_BATCH_SIZE of them and with
+// errMalformedRequest if there are none.
+func decodeSubmitBatch(r io.Reader) ([]*decodedSubmitRequest, error) {
+	d := newSubmitDecoder(r)
+	var reqs []*decodedSubmitRequest
+	hasSubmissions := false
+	err := d.object(func(key string) error {
+		if !strings.EqualFold(key, "submissions") {
+			return d.skipValue()
+		}
+		if hasSubmissions {
+			return fmt.Errorf("%w: duplicate submissions", errMalformedRequest)
+		}
+		hasSubmissions = true
+		return d.array(func() error {
+			if len(reqs) == MAX_SUBMIT_BATCH_SIZE {
+				return errBatchTooLarge
+			}
+			req, err := d.request()
+			if err == nil {
+				reqs = append(reqs, req)
+			}
+			return err
+		})
+	})
+	if err == nil {
+		err = d.end()
+	}
+	if err == nil && len(reqs) == 0 {
+		err = fmt.Errorf("%w: no submissions", errMalformedRequest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+func newSubmitDecoder(r io.Reader) *submitDecoder {
+	signHash, _ := blake2b.New256(nil)
+	blockHash, _ := blake2b.New256(nil)
+	return &submitDecoder{
+		r:         bufio.NewReaderSize(r, BLOCK_DECODE_CHUNK_SIZE),
+		signHash:  signHash,
+		blockHash: blockHash,
+	}
+}
+
+// request decodes a request, the decoder may be used for the next one then.
+func (d *submitDecoder) request() (*decodedSubmitRequest, error) {
+	d.signHash.Reset()
+	d.blockHash.Reset()
+	d.req = decodedSubmitRequest{}
+	d.hasBlock = false
+	if err := d.object(d.requestField); err != nil {
+		return nil, err
+	}
+	if d.hasBlock {
+		tail, err := d.req.Data.signPayloadTail()
+		if err != nil {
+			return nil, err
+		}
+		d.signHash.Write(tail)
+		d.signHash.Sum(d.req.SignHash[:0])
+		d.req.BlockHash = base58.CheckEncode(d.blockHash.Sum(nil), BASE58CHECK_VERSION_BLOCK_HASH)
+	}
+	req := d.req
+	return &req, nil
+}
+
+// end checks that only whitespace follows what was decoded.
+func (d *submitDecoder) end() error {
+	if c, err := d.next(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("%w: unexpected %q after the request", errMalformedRequest, c)
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *submitDecoder) requestField(key string) error {
+	// Keys are matched case-insensitively, as json.Unmarshal does
+	switch strings.ToLower(key) {
+	case "submitter":
+		return d.decodeValue(&d.req.Submitter)
+	case "signature":
+		return d.decodeValue(&d.req.Sig)
+	case "data":
+		return d.object(d.dataField)
+	default:
+		return d.skipValue()
+	}
+}
+
+func (d *submitDecoder) dataField(key string) error {
+	data := &d.req.Data
+	switch strings.ToLower(key) {
+	case "peer_id":
+		return d.decodeValue(&data.PeerId)
+	case "block":
+		return d.block()
+	case "snark_work":
+		return d.decodeValue(&data.SnarkWork)
+	case "created_at":
+		return d.decodeValue(&data.CreatedAt)
+	case "graphql_control_port":
+		return d.decodeValue(&data.GraphqlControlPort)
+	case "built_with_commit_sha":
+		return d.decodeValue(&data.BuiltWithCommitSha)
+	default:
+		return d.skipValue()
+	}
+}
+
+// next returns the next byte which isn't whitespace.
+func (d *submitDecoder) next() (byte, error) {
+	for {
+		c, err := d.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			return c, nil
+		}
+	}
+}
+
+func (d *submitDecoder) peek() (byte, error) {
+	c, err := d.next()
+	if err == nil {
+		err = d.r.UnreadByte()
+	}
+	return c, err
+}
+
+func (d *submitDecoder) expect(expected byte) error {
+	c, err := d.next()
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if c != expected {
+		return fmt.Errorf("%w: expected %q, got %q", errMalformedRequest, expected, c)
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// object decodes an object, calling field to decode the value of every key.
+func (d *submitDecoder) object(field func(key string) error) error {
+	if err := d.expect('{'); err != nil {
+		return err
+	}
+	if c, err := d.peek(); err != nil {
+		return unexpectedEOF(err)
+	} else if c == '}' {
+		_, _ = d.r.ReadByte()
+		return nil
+	}
+	for {
+		var key string
+		if err := d.decodeValue(&key); err != nil {
+			return err
+		}
+		if err := d.expect(':'); err != nil {
+			return err
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+		c, err := d.next()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if c == '}' {
+			return nil
+		}
+		if c != ',' {
+			return fmt.Errorf("%w: expected ',' or '}', got %q", errMalformedRequest, c)
+		}
+	}
+}
+
+// array decodes an array, calling item to decode every element.
+func (d *submitDecoder) array(item func() error) error {
+	if err := d.expect('['); err != nil {
+		return err
+	}
+	if c, err := d.peek(); err != nil {
+		return unexpectedEOF(err)
+	} else if c == ']' {
+		_, _ = d.r.ReadByte()
+		return nil
+	}
+	for {
+		if err := item(); err != nil {
+			return err
+		}
+		c, err := d.next()
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if c == ']' {
+			return nil
+		}
+		if c != ',' {
+			return fmt.Errorf("%w: expected ',' or ']', got %q", errMalformedRequest, c)
+		}
+	}
+}
+
+// decodeValue reads a value and unmarshals it into v.
+func (d *submitDecoder) decodeValue(v interface{}) error {
+	raw, err := d.rawValue()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func (d *submitDecoder) skipValue() error {
+	raw, err := d.rawValue()
+	if err == nil && !json.Valid(raw) {
+		err = fmt.Errorf("%w: invalid value", errMalformedRequest)
+	}
+	return err
+}
+
+// rawValue reads the JSON text of a value. The text is validated
+// by the caller, rawValue only finds where the value ends.
+func (d *submitDecoder) rawValue() ([]byte, error) {
+	var raw bytes.Buffer
+	c, err := d.next()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	depth, inString, escaped := 0, false, false
+	for {
+		raw.WriteByte(c)
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		}
+		if !inString && depth == 0 {
+			if c == '"' || c == '}' || c == ']' {
+				return raw.Bytes(), nil
+			}
+			// A number or a literal ends before a delimiter
+			next, err := d.r.Peek(1)
+			if err == io.EOF || (err == nil && bytes.IndexByte([]byte(",}] \t\n\r"), next[0]) >= 0) {
+				return raw.Bytes(), nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if depth < 0 {
+			return nil, fmt.Errorf("%w: unexpected %q", errMalformedRequest, c)
+		}
+		if c, err = d.r.ReadByte(); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+}
+
+// block decodes the base64 string of the block, writing its JSON text to the
+// sign payload hash and its contents to the block hash and req.Data.Block.
+func (d *submitDecoder) block() error {
+	if d.hasBlock {
+		return fmt.Errorf("%w: duplicate block", errMalformedRequest)
+	}
+	if c, err := d.peek(); err != nil {
+		return unexpectedEOF(err)
+	} else if c == 'n' {
+		// null block is reported as a missing required field
+		var v *Base64
+		return d.decodeValue(&v)
+	}
+	if err := d.expect('"'); err != nil {
+		return err
+	}
+	d.hasBlock = true
+	d.signHash.Write([]byte(SIGN_PAYLOAD_PREFIX + `"`))
+	// The decoded block is kept, it's saved and stored by its hash after the
+	// request is verified. The buffer grows as the block arrives rather than
+	// being allocated for the declared size, which a client may not send.
+	var data bytes.Buffer
+	dec := base64Stream{out: io.MultiWriter(d.blockHash, &data)}
+	escaped := false
+	for {
+		chunk, err := d.r.ReadSlice('"')
+		if err != nil && err != bufio.ErrBufferFull {
+			return unexpectedEOF(err)
+		}
+		d.signHash.Write(chunk)
+		for _, c := range chunk {
+			switch {
+			case escaped:
+				escaped = false
+				switch c {
+				case '/':
+					dec.text = append(dec.text, c)
+				case 'n', 'r':
+					// Ignored by base64 decoding, as new lines are
+				default:
+					return fmt.Errorf("%w: unsupported escape in block", errMalformedRequest)
+				}
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				// Only the last byte of a chunk can be a quote
+				if err := dec.close(); err != nil {
+					return err
+				}
+				d.req.Data.Block = &Base64{data: data.Bytes()}
+				return nil
+			case c < 0x20:
+				return fmt.Errorf("%w: control character in block", errMalformedRequest)
+			default:
+				dec.text = append(dec.text, c)
+			}
+		}
+		if err := dec.flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// base64Stream decodes base64 text which is appended to it in chunks.
+type base64Stream struct {
+	text   []byte
+	out    io.Writer
+	padded bool
+	buf    []byte
+}
+
+// flush decodes the text once there's enough of it, keeping
+// the bytes which don't make a full quantum for later.
+func (s *base64Stream) flush() error {
+	if len(s.text) < BLOCK_DECODE_CHUNK_SIZE {
+		return nil
+	}
+	n := len(s.text) / 4 * 4
+	return s.decode(n)
+}
+
+func (s *base64Stream) close() error {
+	return s.decode(len(s.text))
+}
+
+func (s *base64Stream) decode(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if s.padded {
+		return fmt.Errorf("%w: block has data after base64 padding", errMalformedRequest)
+	}
+	if cap(s.buf) < base64.StdEncoding.DecodedLen(n) {
+		s.buf = make([]byte, base64.StdEncoding.DecodedLen(n))
+	}
+	m, err := base64.StdEncoding.Decode(s.buf[:cap(s.buf)], s.text[:n])
+	if err != nil {
+		return fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	s.padded = s.text[n-1] == '='
+	if _, err := s.out.Write(s.buf[:m]); err != nil {
+		return err
+	}
+	s.text = append(s.text[:0], s.text[n:]...)
+	return nil
+}
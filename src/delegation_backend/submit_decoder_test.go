@@ -0,0 +1,125 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// checkDecodedRequest compares the streaming decoder with json.Unmarshal.
+func checkDecodedRequest(t *testing.T, body []byte) {
+	var expected submitRequest
+	if err := json.Unmarshal(body, &expected); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSubmitRequest(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Submitter != expected.Submitter || decoded.Sig != expected.Sig ||
+		decoded.Data.PeerId != expected.Data.PeerId || !decoded.Data.CreatedAt.Equal(expected.Data.CreatedAt) ||
+		decoded.Data.GraphqlControlPort != expected.Data.GraphqlControlPort ||
+		decoded.Data.BuiltWithCommitSha != expected.Data.BuiltWithCommitSha {
+		t.Fatalf("decoded request differs: %+v", decoded.submitRequest)
+	}
+	if !bytes.Equal(decoded.Data.Block.data, expected.Data.Block.data) {
+		t.Fatal("decoded block differs")
+	}
+	if (decoded.Data.SnarkWork == nil) != (expected.Data.SnarkWork == nil) ||
+		(expected.Data.SnarkWork != nil && !bytes.Equal(decoded.Data.SnarkWork.data, expected.Data.SnarkWork.data)) {
+		t.Fatal("decoded snark work differs")
+	}
+	if decoded.BlockHash != expected.GetBlockDataHash() {
+		t.Fatalf("unexpected block hash %s", decoded.BlockHash)
+	}
+	payload, err := expected.Data.MakeSignPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.SignHash != blake2b.Sum256(payload) {
+		t.Fatal("unexpected sign payload hash")
+	}
+}
+
+func TestDecodeSubmitRequest(t *testing.T) {
+	for _, f := range []string{"req-no-snark", "req-with-snark", "req-v1-with-snark"} {
+		checkDecodedRequest(t, readTestFile(f, t))
+	}
+}
+
+func TestDecodeLargeBlock(t *testing.T) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(readTestFile("req-with-snark", t), &req); err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 3*BLOCK_DECODE_CHUNK_SIZE+1)
+	rand.Read(block)
+	req["data"].(map[string]interface{})["block"] = base64.StdEncoding.EncodeToString(block)
+	// Unknown fields are skipped, wherever they are
+	req["unknown"] = []interface{}{"}", map[string]interface{}{"a": nil}}
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDecodedRequest(t, body)
+	// Escaped slashes are a valid encoding of the block, sign payload keeps them
+	checkDecodedRequest(t, bytes.ReplaceAll(body, []byte("/"), []byte(`\/`)))
+}
+
+func TestDecodeMalformedRequest(t *testing.T) {
+	body := string(readTestFile("req-no-snark", t))
+	blockStart := strings.Index(body, `"block":"`) + len(`"block":"`)
+	malformed := map[string]string{
+		"trailing data":     body + "{}",
+		"truncated":         body[:len(body)/2],
+		"invalid base64":    body[:blockStart] + "!" + body[blockStart+1:],
+		"escaped quote":     body[:blockStart] + `\"` + body[blockStart:],
+		"duplicate block":   strings.Replace(body, `"data":{`, `"data":{"block":"AAAA",`, 1),
+		"invalid value":     strings.Replace(body, `"data":{`, `"data":{"unknown":tru,`, 1),
+		"missing separator": strings.Replace(body, `","created_at"`, `" "created_at"`, 1),
+		"not an object":     "[]",
+	}
+	for name, b := range malformed {
+		if _, err := decodeSubmitRequest(strings.NewReader(b)); err == nil {
+			t.Errorf("%s: expected request to be rejected", name)
+		}
+	}
+}
+
+func TestBase64StreamPadding(t *testing.T) {
+	var out bytes.Buffer
+	s := base64Stream{out: &out, text: []byte("QQ==")}
+	if err := s.decode(4); err != nil {
+		t.Fatal(err)
+	}
+	s.text = append(s.text, "QUFB"...)
+	if err := s.close(); !errors.Is(err, errMalformedRequest) {
+		t.Fatalf("expected data after padding to be rejected, got %v", err)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(1)
+	if b.limit != MAX_SUBMIT_PAYLOAD_SIZE {
+		t.Fatalf("expected budget to fit a request of maximum size, got %d", b.limit)
+	}
+	if !b.TryReserve(MAX_SUBMIT_PAYLOAD_SIZE-10) || !b.TryReserve(10) {
+		t.Fatal("request within budget refused")
+	}
+	if b.TryReserve(1) {
+		t.Fatal("request exceeding budget reserved")
+	}
+	b.Release(10)
+	if !b.TryReserve(1) || b.Used() != MAX_SUBMIT_PAYLOAD_SIZE-9 {
+		t.Fatalf("unexpected budget use: %d", b.Used())
+	}
+	if NewMemoryBudget(-1) != nil || !NewMemoryBudget(-1).TryReserve(MAX_SUBMIT_PAYLOAD_SIZE) {
+		t.Fatal("expected negative budget to be disabled")
+	}
+}
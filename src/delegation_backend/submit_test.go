@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"math/rand"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -47,15 +50,11 @@ func TestSignPayloadGeneration(t *testing.T) {
 }
 
 func testSubmitH(maxAttempt int, initWl Whitelist) (*ObjectsToSave, *SubmitH, *timeMock) {
-	storage := make(ObjectsToSave)
+	storage := newTestStorage("test")
 	log := logging.Logger("delegation backend test")
 	app := new(App)
 	app.Log = log
-	app.Save = func(objs ObjectsToSave) {
-		for path, value := range objs {
-			storage[path] = value
-		}
-	}
+	app.Storage = storage
 	counter, tm := newTestAttemptCounter(1)
 	app.SubmitCounter = counter
 	app.Now = tm.Now
@@ -63,7 +62,7 @@ func testSubmitH(maxAttempt int, initWl Whitelist) (*ObjectsToSave, *SubmitH, *t
 	wlMvar.Replace(&initWl)
 	app.Whitelist = wlMvar
 	app.NetworkId = 1
-	return &storage, app.NewSubmitH(), tm
+	return &storage.objs, app.NewSubmitH(), tm
 }
 
 const v1Submit = "http://127.0.0.1/v1/submit"
@@ -150,7 +149,7 @@ func TestPkLimitExceeded(t *testing.T) {
 		t.FailNow()
 	}
 	otherSubmitter := mkPk()
-	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: true, otherSubmitter: true})
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}, otherSubmitter: {}})
 	rep := sh.testRequest(body)
 	if rep.Code != 200 {
 		t.Logf("Unexpected failure: %v", rep)
@@ -161,6 +160,9 @@ func TestPkLimitExceeded(t *testing.T) {
 		t.Log(rep2)
 		t.FailNow()
 	}
+	if retryAfter := rep2.Header().Get("Retry-After"); retryAfter != "3600" {
+		t.Fatalf("unexpected Retry-After: %q", retryAfter)
+	}
 	req.Submitter = otherSubmitter
 	body2, err := json.Marshal(req)
 	if err != nil {
@@ -174,6 +176,157 @@ func TestPkLimitExceeded(t *testing.T) {
 	}
 }
 
+func TestRequestLimits(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.RequestLimiter = NewRequestLimiter(&RequestLimitsConfig{IPPerMinute: 1})
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	rep := sh.testRequest(body)
+	if rep.Code != 429 {
+		t.Fatalf("expected request exceeding the address limit to be refused, got %d", rep.Code)
+	}
+	if retryAfter := rep.Header().Get("Retry-After"); retryAfter != "60" {
+		t.Fatalf("unexpected Retry-After: %q", retryAfter)
+	}
+
+	_, sh, _ = testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.RequestLimiter = NewRequestLimiter(&RequestLimitsConfig{PeerPerMinute: 1})
+	sh.app.RequestLimiter.Peer.Allow(req.Data.PeerId)
+	if rep := sh.testRequest(body); rep.Code != 429 {
+		t.Fatalf("expected request exceeding the peer limit to be refused, got %d", rep.Code)
+	}
+	if _, stored := sh.app.SubmitCounter.(*AttemptCounter).attempts[req.Submitter]; stored {
+		t.Fatal("request refused by the peer limit counted towards the submitter limit")
+	}
+}
+
+func TestReplayedSubmission(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	cache := NewMemoryReplayCache()
+	cache.now = tm.Now
+	sh.app.ReplayCache = cache
+	sh.app.CreatedAtMaxAge = DEFAULT_MAX_CREATED_AT_AGE
+	sh.app.BatchCreatedAtMaxAge = DEFAULT_MAX_CREATED_AT_AGE
+	tm.time = req.Data.CreatedAt
+
+	// Submission refused by the rate limit can be sent again
+	sh.app.SubmitCounter.RecordAttempt(req.Submitter)
+	if rep := sh.testRequest(body); rep.Code != 429 {
+		t.Fatalf("expected submission to be rate limited, got %d", rep.Code)
+	}
+	if cache.Size() != 0 {
+		t.Fatal("signature of a rate limited submission kept")
+	}
+	sh.app.SubmitCounter = NewAttemptCounter(3, 0)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	tm.Advance(DEFAULT_MAX_CREATED_AT_AGE / 2)
+	rep := sh.testRequest(body)
+	if rep.Code != 409 {
+		t.Fatalf("expected replayed submission to be rejected, got %d", rep.Code)
+	}
+	// The signature is remembered for as long as the submission isn't stale,
+	// regardless of the time it was received
+	tm.Advance(DEFAULT_MAX_CREATED_AT_AGE/2 + s)
+	if rep := sh.testRequest(body); rep.Code != 400 {
+		t.Fatalf("expected submission to be rejected as stale once the signature expired, got %v", rep)
+	}
+	if cache.Sweep() != 1 {
+		t.Fatal("expected the signature to expire along with created_at")
+	}
+}
+
+func TestStaleCreatedAt(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.CreatedAtMaxAge = 10 * m
+	tm.time = req.Data.CreatedAt.Add(11 * m)
+	if rep := sh.testRequest(body); rep.Code != 400 {
+		t.Fatalf("expected stale submission to be rejected, got %d", rep.Code)
+	}
+	tm.time = req.Data.CreatedAt.Add(9 * m)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+}
+
+func TestMemoryBudgetExceeded(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.MemoryBudget = NewMemoryBudget(1)
+	sh.app.MemoryBudget.TryReserve(MAX_SUBMIT_PAYLOAD_SIZE - int64(len(body)) + 1)
+	rep := sh.testRequest(body)
+	if rep.Code != 503 || rep.Header().Get("Retry-After") != MEMORY_BUDGET_RETRY_AFTER {
+		t.Fatalf("expected request exceeding memory budget to be refused, got %v", rep)
+	}
+	sh.app.MemoryBudget.Release(1)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	if used := sh.app.MemoryBudget.Used(); used != MAX_SUBMIT_PAYLOAD_SIZE-int64(len(body)) {
+		t.Fatalf("memory reserved by the request wasn't released: %d", used)
+	}
+}
+
+func TestMemoryBudgetReservedAsRead(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Fatal("failed decoding test file")
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.MemoryBudget = NewMemoryBudget(1)
+	// A client which declared the whole body but sent a part of it
+	// only holds as much of the budget as it has sent
+	pr, pw := io.Pipe()
+	r := httptest.NewRequest("POST", v1Submit, pr)
+	r.ContentLength = int64(len(body))
+	rep := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		sh.ServeHTTP(rep, r)
+		close(done)
+	}()
+	sent := len(body) / 2
+	if _, err := pw.Write(body[:sent]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; sh.app.MemoryBudget.Used() != int64(sent); i++ {
+		if i == 100 {
+			t.Fatalf("expected %d bytes reserved, got %d", sent, sh.app.MemoryBudget.Used())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	pw.CloseWithError(errors.New("client gone"))
+	<-done
+	if rep.Code != 400 {
+		t.Fatalf("expected incomplete body to be rejected, got %v", rep)
+	}
+	if used := sh.app.MemoryBudget.Used(); used != 0 {
+		t.Fatalf("memory reserved by the request wasn't released: %d", used)
+	}
+}
+
 func TestSuccess(t *testing.T) {
 	testNames := []string{"req-no-snark", "req-with-snark"}
 	for _, f := range testNames {
@@ -183,7 +336,7 @@ func TestSuccess(t *testing.T) {
 			t.Logf("failed decoding test file %s", f)
 			t.FailNow()
 		}
-		objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: true})
+		objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
 		rep := sh.testRequest(body)
 		if rep.Code != 200 {
 			t.Logf("Failed testing %s: %v", f, rep)
@@ -196,6 +349,7 @@ func TestSuccess(t *testing.T) {
 		meta.PeerId = req.Data.PeerId
 		meta.SnarkWork = req.Data.SnarkWork
 		meta.RemoteAddr = "192.0.2.1:1234"
+		meta.ClientIP = "192.0.2.1"
 		meta.BlockHash = bhStr
 		meta.Submitter = req.Submitter
 		metaBytes, err2 := json.Marshal(meta)
@@ -214,7 +368,7 @@ func Test40x(t *testing.T) {
 		t.Log("failed decoding test file")
 		t.FailNow()
 	}
-	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: true})
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
 	//2. Malformed JSON
 	if rep := sh.testRequest([]byte("{}")); rep.Code != 400 {
 		t.Logf("Empty json test failed: %v", rep)
@@ -256,3 +410,82 @@ func Test40x(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestStorageFailure(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Log("failed decoding test file")
+		t.FailNow()
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.Storage.(*testStorage).saveErr = &SavePolicyError{Policy: SavePolicyAll, Required: 1}
+	rep := sh.testRequest(body)
+	var resp errorResponse
+	if rep.Code != 503 || rep.Header().Get("Retry-After") == "" {
+		t.Log(rep)
+		t.FailNow()
+	}
+	if err := json.Unmarshal(rep.Body.Bytes(), &resp); err != nil || !resp.Retryable {
+		t.Logf("Expected retryable error response: %v", rep)
+		t.FailNow()
+	}
+	// The failed attempt doesn't count against the limit of the submitter
+	sh.app.Storage.(*testStorage).saveErr = nil
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Logf("Retry after storage failure was rejected: %v", rep)
+		t.FailNow()
+	}
+}
+
+func TestEnrollmentWindow(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Log("failed decoding test file")
+		t.FailNow()
+	}
+	entry := &WhitelistEntry{}
+	_, sh, tm := testSubmitH(2, Whitelist{req.Submitter: entry})
+	entry.EnrollmentStart = tm.Now().Add(time.Hour)
+	if rep := sh.testRequest(body); rep.Code != 403 || !strings.Contains(rep.Body.String(), ErrEnrollmentNotStarted.Error()) {
+		t.Logf("Submission before enrollment start wasn't rejected: %v", rep)
+		t.FailNow()
+	}
+	tm.Advance(2 * time.Hour)
+	entry.EnrollmentEnd = tm.Now()
+	if rep := sh.testRequest(body); rep.Code != 403 || !strings.Contains(rep.Body.String(), ErrEnrollmentEnded.Error()) {
+		t.Logf("Submission after enrollment end wasn't rejected: %v", rep)
+		t.FailNow()
+	}
+	entry.EnrollmentEnd = tm.Now().Add(time.Minute)
+	if rep := sh.testRequest(body); rep.Code != 200 {
+		t.Logf("Submission within enrollment window failed: %v", rep)
+		t.FailNow()
+	}
+}
+
+func TestBlocklisted(t *testing.T) {
+	body := readTestFile("req-with-snark", t)
+	var req submitRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		t.Log("failed decoding test file")
+		t.FailNow()
+	}
+	_, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+	sh.app.Blocklist, _ = NewBlocklist("", tm.Now)
+	sh.app.Blocklist.Add(BlockEntry{Kind: BlockKindSubmitter, Value: req.Submitter.String()})
+	// blocklist is checked before the signature
+	rand.Read(req.Sig[:])
+	badSigBody, _ := json.Marshal(req)
+	if rep := sh.testRequest(badSigBody); rep.Code != 403 || !strings.Contains(rep.Body.String(), "submitter are blocked") {
+		t.Logf("Blocked submitter wasn't rejected: %v", rep)
+		t.FailNow()
+	}
+	sh.app.Blocklist.Remove(BlockKindSubmitter, req.Submitter.String())
+	sh.app.Blocklist.Add(BlockEntry{Kind: BlockKindCIDR, Value: "192.0.2.0/24"})
+	if rep := sh.testRequest(body); rep.Code != 403 || !strings.Contains(rep.Body.String(), "address are blocked") {
+		t.Logf("Blocked address wasn't rejected: %v", rep)
+		t.FailNow()
+	}
+}
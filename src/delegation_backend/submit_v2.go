@@ -0,0 +1,250 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"time"
+	"unicode/utf8"
+
+	"github.com/btcsuite/btcutil/base58"
+	"golang.org/x/crypto/blake2b"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the /v2/submit envelope, a protobuf message:
+//
+//	message SubmitRequest {
+//	  bytes submitter = 1; // public key, PK_LENGTH bytes
+//	  bytes signature = 2; // SIG_LENGTH bytes
+//	  bytes data = 3;      // SubmitData in the canonical encoding
+//	}
+const (
+	v2FieldSubmitter protowire.Number = 1
+	v2FieldSignature protowire.Number = 2
+	v2FieldData      protowire.Number = 3
+)
+
+// Field numbers of the signed data of /v2/submit:
+//
+//	message SubmitData {
+//	  string peer_id = 1;
+//	  bytes block = 2;
+//	  uint64 created_at = 3; // seconds since the Unix epoch
+//	  bytes snark_work = 4;
+//	  uint32 graphql_control_port = 5; // at most 65535
+//	  string built_with_commit_sha = 6;
+//	}
+const (
+	v2DataFieldPeerId             protowire.Number = 1
+	v2DataFieldBlock              protowire.Number = 2
+	v2DataFieldCreatedAt          protowire.Number = 3
+	v2DataFieldSnarkWork          protowire.Number = 4
+	v2DataFieldGraphqlControlPort protowire.Number = 5
+	v2DataFieldBuiltWithCommitSha protowire.Number = 6
+)
+
+// MakeSignPayloadV2 returns the canonical encoding of SubmitData, the
+// signature of /v2/submit request is made over these bytes as they are.
+// The encoding is the one of protobuf with a single valid form: fields
+// are in increasing order of their numbers, fields holding the default
+// (empty or zero) value are omitted and varints take the fewest bytes.
+//
+// The hash of these bytes is signed the same way as the one of the JSON of
+// MakeSignPayload, the two are kept apart by their encodings instead: the JSON
+// starts with '{', which is the tag of field 15 of the group wire type, and
+// parseCanonical accepts neither. So a signature of a /v1/submit payload is
+// never valid for a /v2/submit one, and the other way round.
+func (req submitRequestData) MakeSignPayloadV2() []byte {
+	var b []byte
+	b = appendStringField(b, v2DataFieldPeerId, req.PeerId)
+	if req.Block != nil {
+		b = appendBytesField(b, v2DataFieldBlock, req.Block.data)
+	}
+	if !req.CreatedAt.IsZero() {
+		b = appendVarintField(b, v2DataFieldCreatedAt, uint64(req.CreatedAt.Unix()))
+	}
+	if req.SnarkWork != nil {
+		b = appendBytesField(b, v2DataFieldSnarkWork, req.SnarkWork.data)
+	}
+	b = appendVarintField(b, v2DataFieldGraphqlControlPort, uint64(req.GraphqlControlPort))
+	b = appendStringField(b, v2DataFieldBuiltWithCommitSha, req.BuiltWithCommitSha)
+	return b
+}
+
+// MarshalV2 encodes the request as a body of /v2/submit request.
+func (req submitRequest) MarshalV2() []byte {
+	var b []byte
+	b = appendBytesField(b, v2FieldSubmitter, req.Submitter[:])
+	b = appendBytesField(b, v2FieldSignature, req.Sig[:])
+	b = appendBytesField(b, v2FieldData, req.Data.MakeSignPayloadV2())
+	return b
+}
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	return appendBytesField(b, num, []byte(v))
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// wireField is a field of a message, either a varint or a length-delimited one.
+type wireField struct {
+	num    protowire.Number
+	typ    protowire.Type
+	bytes  []byte
+	varint uint64
+}
+
+// parseCanonical calls field for every field of the message, failing unless
+// the message is in the canonical encoding described at MakeSignPayloadV2.
+func parseCanonical(b []byte, field func(f wireField) error) error {
+	var last protowire.Number
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errMalformedRequest, protowire.ParseError(n))
+		}
+		if n != protowire.SizeTag(num) || num <= last {
+			return fmt.Errorf("%w: field %d isn't in canonical encoding", errMalformedRequest, num)
+		}
+		last = num
+		b = b[n:]
+		f := wireField{num: num, typ: typ}
+		var canonical bool
+		switch typ {
+		case protowire.VarintType:
+			f.varint, n = protowire.ConsumeVarint(b)
+			canonical = n == protowire.SizeVarint(f.varint) && f.varint != 0
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+			canonical = n == protowire.SizeBytes(len(f.bytes)) && len(f.bytes) != 0
+		default:
+			return fmt.Errorf("%w: field %d has unsupported wire type %d", errMalformedRequest, num, typ)
+		}
+		if n < 0 {
+			return fmt.Errorf("%w: %v", errMalformedRequest, protowire.ParseError(n))
+		}
+		if !canonical {
+			return fmt.Errorf("%w: field %d isn't in canonical encoding", errMalformedRequest, num)
+		}
+		b = b[n:]
+		if err := field(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f wireField) expect(typ protowire.Type) error {
+	if f.typ != typ {
+		return fmt.Errorf("%w: field %d has wire type %d, expected %d", errMalformedRequest, f.num, f.typ, typ)
+	}
+	return nil
+}
+
+func (f wireField) string() (string, error) {
+	if err := f.expect(protowire.BytesType); err != nil {
+		return "", err
+	}
+	if !utf8.Valid(f.bytes) {
+		return "", fmt.Errorf("%w: field %d isn't valid UTF-8", errMalformedRequest, f.num)
+	}
+	return string(f.bytes), nil
+}
+
+func (f wireField) fixedBytes(dst []byte) error {
+	if err := f.expect(protowire.BytesType); err != nil {
+		return err
+	}
+	if len(f.bytes) != len(dst) {
+		return fmt.Errorf("%w: field %d of an unexpected size %d", errMalformedRequest, f.num, len(f.bytes))
+	}
+	copy(dst, f.bytes)
+	return nil
+}
+
+// decodeSubmitRequestV2 decodes a body of /v2/submit request. Unlike the JSON
+// of /v1/submit, the body is read at once, the block and snark work refer to
+// it instead of being copied.
+func decodeSubmitRequestV2(r io.Reader) (*decodedSubmitRequest, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	var req decodedSubmitRequest
+	var data []byte
+	err := parseCanonical(buf.Bytes(), func(f wireField) error {
+		switch f.num {
+		case v2FieldSubmitter:
+			return f.fixedBytes(req.Submitter[:])
+		case v2FieldSignature:
+			return f.fixedBytes(req.Sig[:])
+		case v2FieldData:
+			data = f.bytes
+			return f.expect(protowire.BytesType)
+		default:
+			return fmt.Errorf("%w: unknown field %d", errMalformedRequest, f.num)
+		}
+	})
+	if err == nil {
+		err = parseCanonical(data, req.Data.decodeFieldV2)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.SignHash = blake2b.Sum256(data)
+	if req.Data.Block != nil {
+		blockHash := blake2b.Sum256(req.Data.Block.data)
+		req.BlockHash = base58.CheckEncode(blockHash[:], BASE58CHECK_VERSION_BLOCK_HASH)
+	}
+	return &req, nil
+}
+
+func (req *submitRequestData) decodeFieldV2(f wireField) (err error) {
+	switch f.num {
+	case v2DataFieldPeerId:
+		req.PeerId, err = f.string()
+	case v2DataFieldBlock:
+		if err = f.expect(protowire.BytesType); err == nil {
+			req.Block = &Base64{data: f.bytes}
+		}
+	case v2DataFieldCreatedAt:
+		if err = f.expect(protowire.VarintType); err == nil {
+			if f.varint > math.MaxInt64 {
+				return fmt.Errorf("%w: created_at out of range", errMalformedRequest)
+			}
+			req.CreatedAt = time.Unix(int64(f.varint), 0).UTC()
+		}
+	case v2DataFieldSnarkWork:
+		if err = f.expect(protowire.BytesType); err == nil {
+			req.SnarkWork = &Base64{data: f.bytes}
+		}
+	case v2DataFieldGraphqlControlPort:
+		if err = f.expect(protowire.VarintType); err == nil {
+			if f.varint > math.MaxUint16 {
+				return fmt.Errorf("%w: graphql_control_port out of range", errMalformedRequest)
+			}
+			req.GraphqlControlPort = int(f.varint)
+		}
+	case v2DataFieldBuiltWithCommitSha:
+		req.BuiltWithCommitSha, err = f.string()
+	default:
+		err = fmt.Errorf("%w: unknown field %d of data", errMalformedRequest, f.num)
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package delegation_backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const v2Submit = "http://127.0.0.1/v2/submit"
+
+func (sh *SubmitH) testRequestV2(body []byte) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", v2Submit, bytes.NewReader(body))
+	sh.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestSubmitV2RoundTrip(t *testing.T) {
+	for _, f := range []string{"req-no-snark", "req-with-snark", "req-v1-with-snark"} {
+		var expected submitRequest
+		if err := json.Unmarshal(readTestFile(f, t), &expected); err != nil {
+			t.Fatal(err)
+		}
+		body := expected.MarshalV2()
+		decoded, err := decodeSubmitRequestV2(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed decoding %s: %v", f, err)
+		}
+		if decoded.Submitter != expected.Submitter || decoded.Sig != expected.Sig ||
+			decoded.Data.PeerId != expected.Data.PeerId || !decoded.Data.CreatedAt.Equal(expected.Data.CreatedAt) ||
+			decoded.Data.GraphqlControlPort != expected.Data.GraphqlControlPort ||
+			decoded.Data.BuiltWithCommitSha != expected.Data.BuiltWithCommitSha {
+			t.Fatalf("decoded %s differs: %+v", f, decoded.submitRequest)
+		}
+		if !bytes.Equal(decoded.Data.Block.data, expected.Data.Block.data) {
+			t.Fatalf("decoded block of %s differs", f)
+		}
+		if (decoded.Data.SnarkWork == nil) != (expected.Data.SnarkWork == nil) ||
+			(expected.Data.SnarkWork != nil && !bytes.Equal(decoded.Data.SnarkWork.data, expected.Data.SnarkWork.data)) {
+			t.Fatalf("decoded snark work of %s differs", f)
+		}
+		if decoded.BlockHash != expected.GetBlockDataHash() {
+			t.Fatalf("unexpected block hash of %s: %s", f, decoded.BlockHash)
+		}
+		if decoded.SignHash != blake2b.Sum256(expected.Data.MakeSignPayloadV2()) {
+			t.Fatalf("unexpected sign payload hash of %s", f)
+		}
+		if !bytes.Equal(decoded.MarshalV2(), body) {
+			t.Fatalf("encoding of %s isn't canonical", f)
+		}
+	}
+}
+
+func TestSubmitV2NonCanonical(t *testing.T) {
+	var req submitRequest
+	if err := json.Unmarshal(readTestFile("req-no-snark", t), &req); err != nil {
+		t.Fatal(err)
+	}
+	data := req.Data.MakeSignPayloadV2()
+	envelope := func(data []byte) []byte {
+		var b []byte
+		b = appendBytesField(b, v2FieldSubmitter, req.Submitter[:])
+		b = appendBytesField(b, v2FieldSignature, req.Sig[:])
+		b = protowire.AppendTag(b, v2FieldData, protowire.BytesType)
+		return protowire.AppendBytes(b, data)
+	}
+	peerId := appendStringField(nil, v2DataFieldPeerId, req.Data.PeerId)
+	cases := map[string][]byte{
+		"duplicate field":        envelope(append(append([]byte{}, data...), peerId...)),
+		"fields out of order":    envelope(append(append([]byte{}, data[len(peerId):]...), peerId...)),
+		"unknown field":          envelope(appendStringField(append([]byte{}, data...), 15, "x")),
+		"zero value":             envelope(protowire.AppendVarint(protowire.AppendTag(append([]byte{}, data...), v2DataFieldGraphqlControlPort, protowire.VarintType), 0)),
+		"overlong varint":        envelope(append(protowire.AppendTag(append([]byte{}, data...), v2DataFieldGraphqlControlPort, protowire.VarintType), 0x80|1, 0)),
+		"wrong wire type":        envelope(protowire.AppendVarint(protowire.AppendTag(append([]byte{}, data...), v2DataFieldBuiltWithCommitSha, protowire.VarintType), 1)),
+		"port out of range":      envelope(appendVarintField(append([]byte{}, data...), v2DataFieldGraphqlControlPort, 1<<16)),
+		"short submitter":        appendBytesField(nil, v2FieldSubmitter, req.Submitter[1:]),
+		"truncated":              envelope(data)[:len(envelope(data))-1],
+		"unknown envelope field": appendBytesField(envelope(data), 4, []byte{1}),
+	}
+	for name, body := range cases {
+		if _, err := decodeSubmitRequestV2(bytes.NewReader(body)); !errors.Is(err, errMalformedRequest) {
+			t.Fatalf("expected %s to be rejected as malformed, got %v", name, err)
+		}
+	}
+	if _, err := decodeSubmitRequestV2(bytes.NewReader(envelope(data))); err != nil {
+		t.Fatalf("unexpected failure: %v", err)
+	}
+}
+
+func TestSubmitV2(t *testing.T) {
+	for _, f := range []string{"req-no-snark", "req-with-snark"} {
+		body := readTestFile(f, t)
+		var req submitRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Fatal(err)
+		}
+		v1Objs, sh, tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+		if rep := sh.testRequest(body); rep.Code != 200 {
+			t.Fatalf("unexpected failure of %s: %v", f, rep)
+		}
+
+		// Signatures of the test data are made over the v1 payload
+		v2Objs, sh, v2Tm := testSubmitH(1, Whitelist{req.Submitter: {}})
+		// Both handlers save under the same time, so that paths match
+		v2Tm.time = tm.Now()
+		v2 := sh.app.NewSubmitV2H()
+		sh.app.VerifySignatureDisabled = true
+		if rep := v2.testRequestV2(req.MarshalV2()); rep.Code != 200 {
+			t.Fatalf("unexpected failure of v2 %s: %v", f, rep)
+		}
+		if len(*v2Objs) != len(*v1Objs) {
+			t.Fatalf("expected v2 %s to save %d objects, got %d", f, len(*v1Objs), len(*v2Objs))
+		}
+		for path, o := range *v1Objs {
+			if !bytes.Equal((*v2Objs)[path], o) {
+				t.Fatalf("v2 %s saved %s differently: %s", f, path, (*v2Objs)[path])
+			}
+		}
+	}
+}
+
+// req-v2-with-snark is req-with-snark signed over the v2 payload with the test key
+func TestSubmitV2Signed(t *testing.T) {
+	var req submitRequest
+	if err := json.Unmarshal(readTestFile("req-v2-with-snark", t), &req); err != nil {
+		t.Fatal(err)
+	}
+	hash := blake2b.Sum256(req.Data.MakeSignPayloadV2())
+	if pk, sig := signPure(testSecretKey, testNonce, hash[:], 1); pk != req.Submitter || sig != req.Sig {
+		t.Fatal("test data isn't signed with the test key")
+	}
+	objs, sh, _ := testSubmitH(1, Whitelist{req.Submitter: {}})
+	v2 := sh.app.NewSubmitV2H()
+	req.Data.GraphqlControlPort = 1
+	if rep := v2.testRequestV2(req.MarshalV2()); rep.Code != 401 {
+		t.Fatalf("expected signature of modified data to be rejected, got %v", rep)
+	}
+	req.Data.GraphqlControlPort = 0
+	if rep := v2.testRequestV2(req.MarshalV2()); rep.Code != 200 {
+		t.Fatalf("unexpected failure: %v", rep)
+	}
+	if len(*objs) == 0 {
+		t.Fatal("submission wasn't saved")
+	}
+}
+
+// Both versions sign the hash of their payload with the same key, a signature
+// is only valid for one of them as no payload is valid for both
+func TestSubmitV2DomainSeparation(t *testing.T) {
+	v1Body := readTestFile("req-with-snark", t)
+	var v1Req submitRequest
+	if err := json.Unmarshal(v1Body, &v1Req); err != nil {
+		t.Fatal(err)
+	}
+	_, sh, _ := testSubmitH(1, Whitelist{v1Req.Submitter: {}})
+	if rep := sh.app.NewSubmitV2H().testRequestV2(v1Req.MarshalV2()); rep.Code != 401 {
+		t.Fatalf("expected signature of v1 payload to be rejected on v2, got %v", rep)
+	}
+	if rep := sh.testRequest(v1Body); rep.Code != 200 {
+		t.Fatalf("unexpected failure of v1: %v", rep)
+	}
+
+	v2Body := readTestFile("req-v2-with-snark", t)
+	var v2Req submitRequest
+	if err := json.Unmarshal(v2Body, &v2Req); err != nil {
+		t.Fatal(err)
+	}
+	_, sh, _ = testSubmitH(1, Whitelist{v2Req.Submitter: {}})
+	if rep := sh.testRequest(v2Body); rep.Code != 401 {
+		t.Fatalf("expected signature of v2 payload to be rejected on v1, got %v", rep)
+	}
+
+	payload, err := v1Req.Data.MakeSignPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data submitRequestData
+	if err := parseCanonical(payload, data.decodeFieldV2); !errors.Is(err, errMalformedRequest) {
+		t.Fatalf("expected v1 payload not to be a v2 payload, got %v", err)
+	}
+}
+
+func TestSubmitV2Malformed(t *testing.T) {
+	_, sh, _ := testSubmitH(1, Whitelist{})
+	v2 := sh.app.NewSubmitV2H()
+	if rep := v2.testRequestV2(readTestFile("req-no-snark", t)); rep.Code != 400 {
+		t.Fatalf("expected JSON body to be rejected, got %v", rep)
+	}
+	if rep := v2.testRequestV2(nil); rep.Code != 400 {
+		t.Fatalf("expected empty request to be rejected, got %v", rep)
+	}
+}
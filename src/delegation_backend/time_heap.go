@@ -2,6 +2,8 @@ package delegation_backend
 
 import (
 	"container/heap"
+	"container/list"
+	"context"
 	"sync"
 	"time"
 )
@@ -11,11 +13,32 @@ const minusOneHour time.Duration = -60 * 60 * 1000000000
 type timeHeap []time.Time
 type nowFunc = func() time.Time
 
+const DEFAULT_ATTEMPT_COUNTER_MAX_KEYS = 100000
+const ATTEMPT_COUNTER_SWEEP_INTERVAL = 10 * time.Minute
+
 type AttemptCounter struct {
-	attempts   map[Pk]*timeHeap
+	attempts map[Pk]*attemptCounterKey
+	// lru orders tracked keys from the least to the most recently seen one
+	lru        *list.List
 	maxAttempt int
-	mutex      sync.Mutex
-	now        nowFunc
+	// maxKeys is the number of public keys which can be tracked at once.
+	// When it is reached, the least recently seen key is evicted to make
+	// room for a new one if it has no attempts within the last hour, the
+	// new key is refused otherwise. No limit if not positive.
+	maxKeys int
+	// attemptCount and capacity are totals of attempts and their capacity
+	// over all keys, kept up to date so that Stats doesn't walk the keys
+	attemptCount int
+	capacity     int
+	mutex        sync.Mutex
+	now          nowFunc
+}
+
+type attemptCounterKey struct {
+	pk       Pk
+	times    timeHeap
+	lastSeen time.Time
+	elem     *list.Element
 }
 
 func (h timeHeap) Len() int {
@@ -42,10 +65,17 @@ func (h *timeHeap) Pop() interface{} {
 	return x
 }
 
-func NewAttemptCounter(maxAttemptPerHour int) *AttemptCounter {
+// NewAttemptCounter uses DEFAULT_ATTEMPT_COUNTER_MAX_KEYS if maxKeys is 0,
+// a negative maxKeys disables the limit.
+func NewAttemptCounter(maxAttemptPerHour int, maxKeys int) *AttemptCounter {
 	th := new(AttemptCounter)
 	th.maxAttempt = maxAttemptPerHour
-	th.attempts = make(map[Pk]*timeHeap)
+	th.maxKeys = maxKeys
+	if maxKeys == 0 {
+		th.maxKeys = DEFAULT_ATTEMPT_COUNTER_MAX_KEYS
+	}
+	th.attempts = make(map[Pk]*attemptCounterKey)
+	th.lru = list.New()
 	th.now = func() time.Time { return time.Now() }
 	return th
 }
@@ -57,20 +87,183 @@ func (h *AttemptCounter) RecordAttempt(pk Pk) bool {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 	curTime := h.now()
-	if h.attempts[pk] == nil {
-		t := timeHeap(make([]time.Time, 0, h.maxAttempt))
-		h.attempts[pk] = &t
-	}
-	t := h.attempts[pk]
-	for {
-		if len(*t) == 0 || (*t)[0].After(curTime.Add(minusOneHour)) {
-			break
+	k := h.attempts[pk]
+	if k == nil {
+		if h.maxAttempt <= 0 {
+			return false
 		}
-		_ = heap.Pop(t)
+		if h.maxKeys > 0 && len(h.attempts) >= h.maxKeys && !h.evictIdle(curTime) {
+			// Evicting a key with attempts would reset its count
+			attemptCounterFullTotal.Inc()
+			return false
+		}
+		// heaps grow as needed, so that keys making a single
+		// attempt don't hold memory for maxAttempt of them
+		k = &attemptCounterKey{pk: pk, times: make(timeHeap, 0, 1)}
+		k.elem = h.lru.PushBack(k)
+		h.attempts[pk] = k
+		h.capacity += cap(k.times)
+	} else {
+		h.lru.MoveToBack(k.elem)
+	}
+	k.lastSeen = curTime
+	h.update(k, func(t *timeHeap) {
+		t.expire(curTime)
+	})
+	if len(k.times) >= h.maxAttempt {
+		return false
 	}
-	if len(*t) >= h.maxAttempt {
+	h.update(k, func(t *timeHeap) {
+		heap.Push(t, curTime)
+	})
+	return true
+}
+
+// update applies f to attempts of k, keeping the totals up to date.
+func (h *AttemptCounter) update(k *attemptCounterKey, f func(t *timeHeap)) {
+	n, c := len(k.times), cap(k.times)
+	f(&k.times)
+	h.attemptCount += len(k.times) - n
+	h.capacity += cap(k.times) - c
+}
+
+// evictIdle stops tracking the least recently seen key if it has
+// no attempts within the last hour, reporting whether it did.
+func (h *AttemptCounter) evictIdle(curTime time.Time) bool {
+	k := h.lru.Front().Value.(*attemptCounterKey)
+	h.update(k, func(t *timeHeap) {
+		t.expire(curTime)
+	})
+	if len(k.times) > 0 {
 		return false
 	}
-	heap.Push(t, curTime)
+	h.remove(k)
+	attemptCounterEvictionsTotal.Inc()
 	return true
 }
+
+// remove stops tracking k.
+func (h *AttemptCounter) remove(k *attemptCounterKey) {
+	h.lru.Remove(k.elem)
+	delete(h.attempts, k.pk)
+	h.attemptCount -= len(k.times)
+	h.capacity -= cap(k.times)
+}
+
+// RetryAfter returns the time until the oldest attempt of pk within
+// the last hour expires, if the limit is reached. For a key refused
+// because the counter is full, it's the time until the least recently
+// seen key can be evicted.
+func (h *AttemptCounter) RetryAfter(pk Pk) time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := h.attempts[pk]
+	if k == nil {
+		if h.maxKeys <= 0 || len(h.attempts) < h.maxKeys {
+			return 0
+		}
+		var latest time.Time
+		for _, t := range h.lru.Front().Value.(*attemptCounterKey).times {
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		return max(latest.Sub(h.now().Add(minusOneHour)), 0)
+	}
+	if len(k.times) == 0 || len(k.times) < h.maxAttempt {
+		return 0
+	}
+	return k.times[0].Sub(h.now().Add(minusOneHour))
+}
+
+// ForgetAttempt drops the latest attempt of pk.
+func (h *AttemptCounter) ForgetAttempt(pk Pk) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	k := h.attempts[pk]
+	if k == nil || len(k.times) == 0 {
+		return
+	}
+	h.update(k, func(t *timeHeap) {
+		latest := 0
+		for i := range *t {
+			if (*t)[i].After((*t)[latest]) {
+				latest = i
+			}
+		}
+		heap.Remove(t, latest)
+	})
+}
+
+// expire drops attempts made more than an hour before curTime.
+func (t *timeHeap) expire(curTime time.Time) {
+	for len(*t) > 0 && !(*t)[0].After(curTime.Add(minusOneHour)) {
+		_ = heap.Pop(t)
+	}
+}
+
+// Sweep stops tracking keys not seen in the last hour, which have no
+// attempts left to count, returning the number of keys evicted.
+func (h *AttemptCounter) Sweep() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	idleSince := h.now().Add(minusOneHour)
+	evicted := 0
+	for e := h.lru.Front(); e != nil; e = h.lru.Front() {
+		k := e.Value.(*attemptCounterKey)
+		if k.lastSeen.After(idleSince) {
+			break
+		}
+		h.remove(k)
+		evicted++
+	}
+	attemptCounterEvictionsTotal.Add(float64(evicted))
+	return evicted
+}
+
+// Run sweeps idle keys every interval until ctx is cancelled.
+func (h *AttemptCounter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Sweep()
+		}
+	}
+}
+
+// AttemptCounterStats describes the state held by AttemptCounter.
+type AttemptCounterStats struct {
+	Keys     int
+	Attempts int
+	// MemoryBytes approximates the memory used by keys and attempts,
+	// not accounting for the overhead of the map
+	MemoryBytes int
+}
+
+// Approximate sizes of a tracked key (the key of the map, pointer to the entry,
+// the entry and its element of the LRU list) and of an attempt
+const (
+	attemptCounterKeyBytes     = PK_LENGTH + 8 + (PK_LENGTH + 24 + 24 + 8) + 48
+	attemptCounterAttemptBytes = 24
+)
+
+func (h *AttemptCounter) Stats() AttemptCounterStats {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return AttemptCounterStats{
+		Keys:        len(h.attempts),
+		Attempts:    h.attemptCount,
+		MemoryBytes: len(h.attempts)*attemptCounterKeyBytes + h.capacity*attemptCounterAttemptBytes,
+	}
+}
+
+// Size returns the number of public keys attempts are tracked for.
+func (h *AttemptCounter) Size() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return len(h.attempts)
+}
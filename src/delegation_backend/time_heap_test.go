@@ -7,6 +7,8 @@ import (
 	"testing"
 	"testing/quick"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 const s time.Duration = 1000000000
@@ -37,9 +39,7 @@ func (t *timeMock) Advance(dur time.Duration) {
 }
 
 func newTestAttemptCounter(maxAttemptPerHour int) (*AttemptCounter, *timeMock) {
-	th := new(AttemptCounter)
-	th.maxAttempt = maxAttemptPerHour
-	th.attempts = make(map[Pk]*timeHeap)
+	th := NewAttemptCounter(maxAttemptPerHour, -1)
 	tm := new(timeMock)
 	tm.time = time.Now()
 	th.now = func() time.Time { return tm.Now() }
@@ -136,3 +136,98 @@ func TestTwoPks(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestSweepEvictsIdleKeys(t *testing.T) {
+	pk1 := mkPk()
+	pk2 := mkPk()
+	counter, timeMock := newTestAttemptCounter(2)
+	if !counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+	timeMock.Advance(30 * m)
+	if !counter.RecordAttempt(pk2) {
+		t.FailNow()
+	}
+	if evicted := counter.Sweep(); evicted != 0 {
+		t.Fatalf("expected no evictions, got %d", evicted)
+	}
+	timeMock.Advance(30 * m)
+	if evicted := counter.Sweep(); evicted != 1 {
+		t.Fatalf("expected one eviction, got %d", evicted)
+	}
+	if counter.Size() != 1 {
+		t.Fatalf("expected one key to be tracked, got %d", counter.Size())
+	}
+	timeMock.Advance(30 * m)
+	counter.Sweep()
+	if counter.Size() != 0 {
+		t.Fatalf("expected no keys to be tracked, got %d", counter.Size())
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	pk1 := mkPk()
+	pk2 := mkPk()
+	pk3 := mkPk()
+	counter, timeMock := newTestAttemptCounter(1)
+	counter.maxKeys = 2
+	if !counter.RecordAttempt(pk1) {
+		t.FailNow()
+	}
+	timeMock.Advance(m)
+	if !counter.RecordAttempt(pk2) {
+		t.FailNow()
+	}
+	timeMock.Advance(m)
+	// pk1 is seen again, so pk2 becomes the least recently seen key
+	if counter.RecordAttempt(pk1) {
+		t.Fatal("attempt over the limit accepted")
+	}
+	// Keys with attempts in the last hour aren't evicted, the new key is refused
+	full := testutil.ToFloat64(attemptCounterFullTotal)
+	if counter.RecordAttempt(pk3) {
+		t.Fatal("attempts of a tracked key evicted")
+	}
+	if testutil.ToFloat64(attemptCounterFullTotal) != full+1 {
+		t.Fatal("expected refused key to be counted")
+	}
+	if retryAfter := counter.RetryAfter(pk3); retryAfter != h-m {
+		t.Fatalf("expected to retry once pk2 is idle, got %v", retryAfter)
+	}
+	// Once pk2's attempt expires, it makes room for pk3
+	timeMock.Advance(h - m)
+	if !counter.RecordAttempt(pk3) {
+		t.Fatal("attempt of a new key refused while an idle key can be evicted")
+	}
+	if counter.Size() != 2 {
+		t.Fatalf("expected two keys to be tracked, got %d", counter.Size())
+	}
+	if _, tracked := counter.attempts[pk2]; tracked {
+		t.Fatal("expected idle key to be evicted")
+	}
+}
+
+func TestAttemptCounterStats(t *testing.T) {
+	counter, timeMock := newTestAttemptCounter(3)
+	pk1 := mkPk()
+	pk2 := mkPk()
+	counter.RecordAttempt(pk1)
+	counter.RecordAttempt(pk1)
+	counter.RecordAttempt(pk2)
+	stats := counter.Stats()
+	if stats.Keys != 2 || stats.Attempts != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if stats.MemoryBytes <= 0 {
+		t.Fatalf("expected memory usage to be estimated, got %d", stats.MemoryBytes)
+	}
+	counter.ForgetAttempt(pk1)
+	if stats := counter.Stats(); stats.Keys != 2 || stats.Attempts != 2 {
+		t.Fatalf("unexpected stats after forgetting an attempt: %+v", stats)
+	}
+	timeMock.Advance(h)
+	counter.Sweep()
+	if stats := counter.Stats(); stats.Keys != 0 || stats.Attempts != 0 || stats.MemoryBytes != 0 {
+		t.Fatalf("unexpected stats after sweeping: %+v", stats)
+	}
+}
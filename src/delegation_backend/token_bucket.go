@@ -0,0 +1,244 @@
+package delegation_backend
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+const TOKEN_BUCKET_SWEEP_INTERVAL = time.Minute
+const DEFAULT_TOKEN_BUCKET_MAX_KEYS = 100000
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	key    string
+	elem   *list.Element
+}
+
+// take refills the bucket up to curTime and takes a token out of it.
+// If the bucket is empty, it returns the time until a token is available.
+func (b *tokenBucket) take(rate, burst float64, curTime time.Time) (bool, time.Duration) {
+	if elapsed := curTime.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*rate)
+		b.last = curTime
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// TokenBucket limits the throughput of all requests.
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	bucket tokenBucket
+	mutex  sync.Mutex
+	now    nowFunc
+}
+
+// NewTokenBucket allows ratePerSecond requests per second on average and up
+// to burst at once, burst defaults to ratePerSecond if not positive.
+func NewTokenBucket(ratePerSecond int, burst int) *TokenBucket {
+	if burst <= 0 {
+		burst = ratePerSecond
+	}
+	b := &TokenBucket{
+		rate:  float64(ratePerSecond),
+		burst: float64(burst),
+		now:   func() time.Time { return time.Now() },
+	}
+	b.bucket = tokenBucket{tokens: b.burst, last: b.now()}
+	return b
+}
+
+// Allow returns false along with the time until the next request is
+// allowed if the rate is exceeded.
+func (b *TokenBucket) Allow() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.bucket.take(b.rate, b.burst, b.now())
+}
+
+// KeyedTokenBuckets limits the throughput of requests of every key,
+// such as a client address or a peer id, separately.
+type KeyedTokenBuckets struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	// lru orders buckets from the least to the most recently used one
+	lru *list.List
+	// maxKeys is the number of keys buckets can be held for at once. When it
+	// is reached, the least recently used bucket is dropped to make room for
+	// a new one if it is full again, requests of the new key are refused
+	// otherwise. No limit if not positive.
+	maxKeys int
+	mutex   sync.Mutex
+	now     nowFunc
+}
+
+// NewKeyedTokenBuckets allows ratePerMinute requests per minute of every key
+// on average and up to burst at once, burst defaults to ratePerMinute if not positive.
+// DEFAULT_TOKEN_BUCKET_MAX_KEYS is used if maxKeys is 0, a negative maxKeys
+// disables the limit.
+func NewKeyedTokenBuckets(ratePerMinute int, burst int, maxKeys int) *KeyedTokenBuckets {
+	if burst <= 0 {
+		burst = ratePerMinute
+	}
+	if maxKeys == 0 {
+		maxKeys = DEFAULT_TOKEN_BUCKET_MAX_KEYS
+	}
+	return &KeyedTokenBuckets{
+		rate:    float64(ratePerMinute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		lru:     list.New(),
+		maxKeys: maxKeys,
+		now:     func() time.Time { return time.Now() },
+	}
+}
+
+// Allow returns false along with the time until the next request of key
+// is allowed if the rate is exceeded.
+func (k *KeyedTokenBuckets) Allow(key string) (bool, time.Duration) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	curTime := k.now()
+	b := k.buckets[key]
+	if b == nil {
+		if k.maxKeys > 0 && len(k.buckets) >= k.maxKeys {
+			// Dropping a bucket which isn't full would hand out a full one
+			lru := k.lru.Front().Value.(*tokenBucket)
+			if refill := k.refillTime(lru, curTime); refill > 0 {
+				tokenBucketFullTotal.Inc()
+				return false, refill
+			}
+			tokenBucketEvictionsTotal.Inc()
+			k.remove(lru)
+		}
+		b = &tokenBucket{tokens: k.burst, last: curTime, key: key}
+		b.elem = k.lru.PushBack(b)
+		k.buckets[key] = b
+	} else {
+		k.lru.MoveToBack(b.elem)
+	}
+	return b.take(k.rate, k.burst, curTime)
+}
+
+// refillTime returns the time until b is full again, 0 if it already is.
+func (k *KeyedTokenBuckets) refillTime(b *tokenBucket, curTime time.Time) time.Duration {
+	missing := k.burst - (b.tokens + curTime.Sub(b.last).Seconds()*k.rate)
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / k.rate * float64(time.Second))
+}
+
+func (k *KeyedTokenBuckets) remove(b *tokenBucket) {
+	k.lru.Remove(b.elem)
+	delete(k.buckets, b.key)
+}
+
+// Sweep drops buckets which are full again, they are indistinguishable
+// from buckets of keys seen for the first time. Returns the number of keys dropped.
+func (k *KeyedTokenBuckets) Sweep() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	curTime := k.now()
+	swept := 0
+	for _, b := range k.buckets {
+		if k.refillTime(b, curTime) == 0 {
+			k.remove(b)
+			swept++
+		}
+	}
+	return swept
+}
+
+// Run sweeps full buckets every interval until ctx is cancelled.
+func (k *KeyedTokenBuckets) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.Sweep()
+		}
+	}
+}
+
+// Size returns the number of keys buckets are held for.
+func (k *KeyedTokenBuckets) Size() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return len(k.buckets)
+}
+
+// RequestLimiter limits requests by client address, by peer id and
+// globally, before the per submitter limit of RateLimiter applies.
+// Limiters which aren't configured are nil and let every request through.
+type RequestLimiter struct {
+	Global *TokenBucket
+	IP     *KeyedTokenBuckets
+	Peer   *KeyedTokenBuckets
+}
+
+// NewRequestLimiter returns nil if cfg is nil.
+func NewRequestLimiter(cfg *RequestLimitsConfig) *RequestLimiter {
+	if cfg == nil {
+		return nil
+	}
+	l := new(RequestLimiter)
+	if cfg.GlobalPerSecond > 0 {
+		l.Global = NewTokenBucket(cfg.GlobalPerSecond, cfg.GlobalBurst)
+	}
+	if cfg.IPPerMinute > 0 {
+		l.IP = NewKeyedTokenBuckets(cfg.IPPerMinute, cfg.IPBurst, cfg.MaxKeys)
+	}
+	if cfg.PeerPerMinute > 0 {
+		l.Peer = NewKeyedTokenBuckets(cfg.PeerPerMinute, cfg.PeerBurst, cfg.MaxKeys)
+	}
+	return l
+}
+
+// AllowGlobal, AllowIP and AllowPeer return false along with the time until
+// the next request is allowed if the corresponding limit is exceeded.
+func (l *RequestLimiter) AllowGlobal() (bool, time.Duration) {
+	if l == nil || l.Global == nil {
+		return true, 0
+	}
+	return l.Global.Allow()
+}
+
+func (l *RequestLimiter) AllowIP(ip string) (bool, time.Duration) {
+	if l == nil || l.IP == nil {
+		return true, 0
+	}
+	return l.IP.Allow(ip)
+}
+
+func (l *RequestLimiter) AllowPeer(peerId string) (bool, time.Duration) {
+	if l == nil || l.Peer == nil {
+		return true, 0
+	}
+	return l.Peer.Allow(peerId)
+}
+
+// Run sweeps full buckets of the keyed limiters until ctx is cancelled.
+func (l *RequestLimiter) Run(ctx context.Context, interval time.Duration) {
+	if l == nil {
+		return
+	}
+	for _, k := range []*KeyedTokenBuckets{l.IP, l.Peer} {
+		if k != nil {
+			go k.Run(ctx, interval)
+		}
+	}
+}
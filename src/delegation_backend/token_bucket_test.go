@@ -0,0 +1,104 @@
+package delegation_backend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(2, 4)
+	tm := &timeMock{time: time.Now()}
+	b.now = tm.Now
+	b.bucket.last = tm.Now()
+	for i := 0; i < 4; i++ {
+		if ok, _ := b.Allow(); !ok {
+			t.Fatalf("request %d within burst refused", i)
+		}
+	}
+	ok, retryAfter := b.Allow()
+	if ok {
+		t.Fatal("request exceeding burst allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("unexpected retry after: %v", retryAfter)
+	}
+	tm.Advance(retryAfter)
+	if ok, _ := b.Allow(); !ok {
+		t.Fatal("request refused after the bucket was refilled")
+	}
+	if ok, _ := b.Allow(); ok {
+		t.Fatal("request allowed with an empty bucket")
+	}
+}
+
+func TestKeyedTokenBuckets(t *testing.T) {
+	k := NewKeyedTokenBuckets(1, 0, 0)
+	tm := &timeMock{time: time.Now()}
+	k.now = tm.Now
+	if ok, _ := k.Allow("a"); !ok {
+		t.Fatal("first request refused")
+	}
+	ok, retryAfter := k.Allow("a")
+	if ok || retryAfter != time.Minute {
+		t.Fatalf("expected second request to be refused for a minute, got %v, %v", ok, retryAfter)
+	}
+	if ok, _ := k.Allow("b"); !ok {
+		t.Fatal("request of another key refused")
+	}
+	tm.Advance(30 * time.Second)
+	if swept := k.Sweep(); swept != 0 {
+		t.Fatalf("expected no buckets to be swept, got %d", swept)
+	}
+	tm.Advance(30 * time.Second)
+	if swept := k.Sweep(); swept != 2 || k.Size() != 0 {
+		t.Fatalf("expected full buckets to be swept, got %d, %d left", swept, k.Size())
+	}
+	if ok, _ := k.Allow("a"); !ok {
+		t.Fatal("request refused after the bucket was refilled")
+	}
+}
+
+func TestKeyedTokenBucketsMaxKeys(t *testing.T) {
+	k := NewKeyedTokenBuckets(1, 0, 2)
+	tm := &timeMock{time: time.Now()}
+	k.now = tm.Now
+	k.Allow("a")
+	k.Allow("b")
+	// a is used again, so b becomes the least recently used bucket
+	if ok, _ := k.Allow("a"); ok {
+		t.Fatal("request exceeding the rate allowed")
+	}
+	// b isn't full again yet, dropping it would reset its limit
+	full := testutil.ToFloat64(tokenBucketFullTotal)
+	if ok, retryAfter := k.Allow("c"); ok || retryAfter != time.Minute {
+		t.Fatalf("request of a new key allowed before a bucket can be dropped, retry after %v", retryAfter)
+	}
+	if testutil.ToFloat64(tokenBucketFullTotal) != full+1 {
+		t.Fatal("expected refused request to be counted")
+	}
+	tm.Advance(time.Minute)
+	if ok, _ := k.Allow("c"); !ok {
+		t.Fatal("request of a new key refused once the least recently used bucket is full")
+	}
+	if k.Size() != 2 {
+		t.Fatalf("expected two buckets to be held, got %d", k.Size())
+	}
+	if _, held := k.buckets["b"]; held {
+		t.Fatal("bucket of the least recently used key not dropped")
+	}
+}
+
+func TestNilRequestLimiter(t *testing.T) {
+	l := NewRequestLimiter(nil)
+	for _, allow := range []func() (bool, time.Duration){
+		l.AllowGlobal,
+		func() (bool, time.Duration) { return l.AllowIP("192.0.2.1") },
+		func() (bool, time.Duration) { return l.AllowPeer("peer") },
+	} {
+		if ok, _ := allow(); !ok {
+			t.Fatal("nil request limiter refused a request")
+		}
+	}
+}
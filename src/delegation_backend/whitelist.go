@@ -1,19 +1,170 @@
 package delegation_backend
 
-import "sync"
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
 
-type unit = interface{}
-type Whitelist map[Pk]unit
+var (
+	ErrEnrollmentNotStarted = errors.New("enrollment hasn't started yet")
+	ErrEnrollmentEnded      = errors.New("enrollment has ended")
+)
+
+// WhitelistEntry describes a delegation program participant.
+// Enrollment window is [EnrollmentStart, EnrollmentEnd),
+// a zero time leaves the window open on that side.
+type WhitelistEntry struct {
+	EnrollmentStart time.Time
+	EnrollmentEnd   time.Time
+	Operator        string
+	Tier            string
+}
+
+// CheckEnrollment returns an error if t is outside of the enrollment window.
+func (e *WhitelistEntry) CheckEnrollment(t time.Time) error {
+	if !e.EnrollmentStart.IsZero() && t.Before(e.EnrollmentStart) {
+		return ErrEnrollmentNotStarted
+	}
+	if !e.EnrollmentEnd.IsZero() && !t.Before(e.EnrollmentEnd) {
+		return ErrEnrollmentEnded
+	}
+	return nil
+}
+
+const WHITELIST_DATE_FORMAT = "2006-01-02"
+
+// parseEnrollmentTime accepts RFC3339 timestamps and dates (in UTC),
+// a date used as the end of enrollment includes the whole day.
+func parseEnrollmentTime(s string, end bool) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(WHITELIST_DATE_FORMAT, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid enrollment date %q", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// NewWhitelistEntry parses enrollment start and end dates (both optional)
+// along with operator name and tier of a participant.
+func NewWhitelistEntry(start, end, operator, tier string) (*WhitelistEntry, error) {
+	var e WhitelistEntry
+	var err error
+	if e.EnrollmentStart, err = parseEnrollmentTime(start, false); err != nil {
+		return nil, err
+	}
+	if e.EnrollmentEnd, err = parseEnrollmentTime(end, true); err != nil {
+		return nil, err
+	}
+	if !e.EnrollmentStart.IsZero() && !e.EnrollmentEnd.IsZero() && !e.EnrollmentStart.Before(e.EnrollmentEnd) {
+		return nil, fmt.Errorf("enrollment end %q isn't after its start %q", end, start)
+	}
+	e.Operator = strings.TrimSpace(operator)
+	e.Tier = strings.TrimSpace(tier)
+	return &e, nil
+}
+
+type Whitelist map[Pk]*WhitelistEntry
 
 type WhitelistMVar struct {
 	whitelistMutex sync.RWMutex
 	whitelistSet   *Whitelist
+	refreshedAt    time.Time
+	changedAt      map[Pk]time.Time
+	// loadedAt is the time a whitelist was last loaded out of the source,
+	// whether or not it was applied
+	loadedAt  time.Time
+	rejection error
 }
 
 func (mvar *WhitelistMVar) Replace(wl *Whitelist) {
+	mvar.Update(wl, time.Now())
+}
+
+// Seed sets the whitelist in use before a restart, along with the time each
+// of its keys was last changed, as the previous one of the initial Update.
+// It doesn't count as a refresh.
+func (mvar *WhitelistMVar) Seed(wl Whitelist, changedAt map[Pk]time.Time) {
+	mvar.whitelistMutex.Lock()
+	defer mvar.whitelistMutex.Unlock()
+	mvar.whitelistSet = &wl
+	mvar.changedAt = changedAt
+}
+
+// Update replaces the whitelist and returns changes compared to the previous one,
+// the initial whitelist isn't reported as changes unless the previous one was seeded.
+func (mvar *WhitelistMVar) Update(wl *Whitelist, now time.Time) []WhitelistChange {
 	mvar.whitelistMutex.Lock()
 	defer mvar.whitelistMutex.Unlock()
+	var changes []WhitelistChange
+	changedAt := make(map[Pk]time.Time, len(*wl))
+	if mvar.whitelistSet == nil {
+		for pk := range *wl {
+			changedAt[pk] = now
+		}
+	} else {
+		for pk := range *wl {
+			changedAt[pk] = mvar.changedAt[pk]
+		}
+		changes = DiffWhitelists(*mvar.whitelistSet, *wl, now)
+		for _, c := range changes {
+			if c.Change != WhitelistKeyRemoved {
+				changedAt[c.PublicKey] = now
+			}
+		}
+	}
 	mvar.whitelistSet = wl
+	mvar.refreshedAt = now
+	mvar.changedAt = changedAt
+	mvar.loadedAt = now
+	mvar.rejection = nil
+	whitelistSize.Set(float64(len(*wl)))
+	whitelistLastRefresh.Set(float64(now.Unix()))
+	whitelistRefreshRejected.Set(0)
+	return changes
+}
+
+// Reject records that a whitelist was loaded, but refused
+// by WhitelistGuard, so the current one is kept.
+func (mvar *WhitelistMVar) Reject(err error, now time.Time) {
+	mvar.whitelistMutex.Lock()
+	defer mvar.whitelistMutex.Unlock()
+	mvar.loadedAt = now
+	mvar.rejection = err
+	reason := "unknown"
+	var guardErr *WhitelistGuardError
+	if errors.As(err, &guardErr) {
+		reason = guardErr.Reason
+	}
+	whitelistRefreshRejectionsTotal.WithLabelValues(reason).Inc()
+	whitelistRefreshRejected.Set(1)
+}
+
+// Rejection returns the reason the last loaded whitelist was refused,
+// or nil if it was applied.
+func (mvar *WhitelistMVar) Rejection() error {
+	mvar.whitelistMutex.RLock()
+	defer mvar.whitelistMutex.RUnlock()
+	return mvar.rejection
+}
+
+// LastLoad returns the time a whitelist was last loaded out of the source,
+// even if it was then rejected.
+func (mvar *WhitelistMVar) LastLoad() time.Time {
+	mvar.whitelistMutex.RLock()
+	defer mvar.whitelistMutex.RUnlock()
+	return mvar.loadedAt
 }
 
 func (mvar *WhitelistMVar) ReadWhitelist() (wl *Whitelist) {
@@ -21,3 +172,29 @@ func (mvar *WhitelistMVar) ReadWhitelist() (wl *Whitelist) {
 	defer mvar.whitelistMutex.RUnlock()
 	return mvar.whitelistSet
 }
+
+// LastRefresh returns the time the whitelist was last replaced.
+func (mvar *WhitelistMVar) LastRefresh() time.Time {
+	mvar.whitelistMutex.RLock()
+	defer mvar.whitelistMutex.RUnlock()
+	return mvar.refreshedAt
+}
+
+// ChangedAt returns the time the key was last added or updated, keys
+// of the initial whitelist report the time it was loaded, unless seeded.
+func (mvar *WhitelistMVar) ChangedAt(pk Pk) time.Time {
+	mvar.whitelistMutex.RLock()
+	defer mvar.whitelistMutex.RUnlock()
+	return mvar.changedAt[pk]
+}
+
+// snapshot returns the whitelist along with change times of its keys
+// and the time of last refresh, consistent with each other.
+func (mvar *WhitelistMVar) snapshot() (Whitelist, map[Pk]time.Time, time.Time) {
+	mvar.whitelistMutex.RLock()
+	defer mvar.whitelistMutex.RUnlock()
+	if mvar.whitelistSet == nil {
+		return nil, nil, mvar.refreshedAt
+	}
+	return *mvar.whitelistSet, mvar.changedAt, mvar.refreshedAt
+}
@@ -0,0 +1,70 @@
+package delegation_backend
+
+import "fmt"
+
+const DEFAULT_WHITELIST_MAX_SHRINK_PERCENT = 50
+
+// Reasons for refusing a whitelist, used as label values
+const (
+	whitelistGuardShrink  = "shrink"
+	whitelistGuardMinSize = "min_size"
+)
+
+// WhitelistGuard refuses whitelists which are suspiciously small, e.g. because
+// the spreadsheet was emptied or its column was changed by mistake, so that
+// a bad refresh doesn't lock out all block producers.
+type WhitelistGuard struct {
+	// MaxShrinkPercent is the largest allowed share of keys of the previous
+	// whitelist missing from the next one, the check is disabled if not
+	// positive. Removed keys are counted rather than the drop in size, so
+	// that keys left out (e.g. by malformed rows) aren't offset by additions.
+	MaxShrinkPercent int
+	// MinSize is the smallest allowed size of the whitelist
+	MinSize int
+}
+
+// NewWhitelistGuard uses DEFAULT_WHITELIST_MAX_SHRINK_PERCENT if maxShrinkPercent
+// is 0, a negative maxShrinkPercent disables the shrink check.
+func NewWhitelistGuard(maxShrinkPercent, minSize int) WhitelistGuard {
+	if maxShrinkPercent == 0 {
+		maxShrinkPercent = DEFAULT_WHITELIST_MAX_SHRINK_PERCENT
+	}
+	return WhitelistGuard{MaxShrinkPercent: maxShrinkPercent, MinSize: minSize}
+}
+
+// WhitelistGuardError describes a whitelist refused by WhitelistGuard.
+type WhitelistGuardError struct {
+	Reason   string
+	Size     int
+	PrevSize int
+	Removed  int // keys of the previous whitelist missing from the next one
+	Limit    int
+}
+
+func (e *WhitelistGuardError) Error() string {
+	if e.Reason == whitelistGuardShrink {
+		return fmt.Sprintf("whitelist would lose %d of %d keys, more than %d%%", e.Removed, e.PrevSize, e.Limit)
+	}
+	return fmt.Sprintf("whitelist has %d keys, fewer than the minimum of %d", e.Size, e.Limit)
+}
+
+// Check returns *WhitelistGuardError if next shouldn't replace prev,
+// prev is nil when checking the initial whitelist.
+func (g WhitelistGuard) Check(prev, next Whitelist) error {
+	if len(next) < g.MinSize {
+		return &WhitelistGuardError{Reason: whitelistGuardMinSize, Size: len(next), PrevSize: len(prev), Limit: g.MinSize}
+	}
+	if g.MaxShrinkPercent <= 0 {
+		return nil
+	}
+	removed := 0
+	for pk := range prev {
+		if next[pk] == nil {
+			removed++
+		}
+	}
+	if removed*100 > g.MaxShrinkPercent*len(prev) {
+		return &WhitelistGuardError{Reason: whitelistGuardShrink, Size: len(next), PrevSize: len(prev), Removed: removed, Limit: g.MaxShrinkPercent}
+	}
+	return nil
+}
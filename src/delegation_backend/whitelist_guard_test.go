@@ -0,0 +1,125 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type staticWhitelistSource struct {
+	wl Whitelist
+}
+
+func (src *staticWhitelistSource) Name() string {
+	return "static"
+}
+
+func (src *staticWhitelistSource) Load(_ context.Context) (Whitelist, error) {
+	return src.wl, nil
+}
+
+func (src *staticWhitelistSource) Close() error {
+	return nil
+}
+
+func testWhitelistOfSize(n int) Whitelist {
+	wl := make(Whitelist)
+	for i := 0; i < n; i++ {
+		wl[mkPk()] = &WhitelistEntry{}
+	}
+	return wl
+}
+
+// testWhitelistKeeping returns a whitelist with keep keys of prev and add new ones.
+func testWhitelistKeeping(prev Whitelist, keep, add int) Whitelist {
+	wl := testWhitelistOfSize(add)
+	for pk, e := range prev {
+		if keep == 0 {
+			break
+		}
+		wl[pk] = e
+		keep--
+	}
+	return wl
+}
+
+func TestWhitelistGuardCheck(t *testing.T) {
+	guard := NewWhitelistGuard(0, 3)
+	if guard.MaxShrinkPercent != DEFAULT_WHITELIST_MAX_SHRINK_PERCENT {
+		t.Fatalf("expected default shrink percent, got %d", guard.MaxShrinkPercent)
+	}
+	cases := []struct {
+		prev, keep, add int
+		reason          string
+	}{
+		{0, 0, 2, whitelistGuardMinSize},
+		{0, 0, 3, ""},
+		{10, 5, 0, ""},
+		{10, 4, 0, whitelistGuardShrink},
+		{4, 2, 0, whitelistGuardMinSize},
+		{10, 10, 10, ""},
+		// Removed keys count even if the size is kept by additions
+		{10, 4, 6, whitelistGuardShrink},
+	}
+	for _, c := range cases {
+		var prev Whitelist
+		if c.prev > 0 {
+			prev = testWhitelistOfSize(c.prev)
+		}
+		err := guard.Check(prev, testWhitelistKeeping(prev, c.keep, c.add))
+		var guardErr *WhitelistGuardError
+		if c.reason == "" && err != nil || c.reason != "" && (!errors.As(err, &guardErr) || guardErr.Reason != c.reason) {
+			t.Errorf("%d keys, keeping %d and adding %d: expected %q, got %v", c.prev, c.keep, c.add, c.reason, err)
+		}
+	}
+	if err := NewWhitelistGuard(-1, 0).Check(testWhitelistOfSize(10), Whitelist{}); err != nil {
+		t.Errorf("expected disabled guard to accept empty whitelist: %v", err)
+	}
+}
+
+func TestWhitelistRefresherGuard(t *testing.T) {
+	src := &staticWhitelistSource{wl: testWhitelistOfSize(10)}
+	wlMvar := new(WhitelistMVar)
+	refresher := &WhitelistRefresher{
+		Source:    src,
+		Whitelist: wlMvar,
+		Interval:  time.Hour,
+		Guard:     NewWhitelistGuard(50, 1),
+		Log:       logging.Logger("delegation backend test"),
+	}
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	applied := wlMvar.ReadWhitelist()
+	rejections := testutil.ToFloat64(whitelistRefreshRejectionsTotal.WithLabelValues(whitelistGuardShrink))
+
+	src.wl = testWhitelistOfSize(2)
+	if err := refresher.Refresh(context.Background()); err == nil {
+		t.Fatal("expected shrunk whitelist to be refused")
+	}
+	if wlMvar.ReadWhitelist() != applied || len(*applied) != 10 {
+		t.Fatal("previous whitelist should be kept")
+	}
+	check := WhitelistGuardHealthCheck(wlMvar)
+	if check() == nil || testutil.ToFloat64(whitelistRefreshRejected) != 1 {
+		t.Fatal("refused whitelist should be reported")
+	}
+	if err := WhitelistHealthCheck(wlMvar, time.Minute, time.Now)(); err != nil {
+		t.Fatalf("refused whitelist should still count as loaded: %v", err)
+	}
+	if testutil.ToFloat64(whitelistRefreshRejectionsTotal.WithLabelValues(whitelistGuardShrink)) != rejections+1 {
+		t.Fatal("expected rejection to be counted")
+	}
+
+	src.wl = testWhitelistKeeping(*applied, 6, 0)
+	if err := refresher.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*wlMvar.ReadWhitelist()) != 6 || check() != nil || testutil.ToFloat64(whitelistRefreshRejected) != 0 {
+		t.Fatal("expected whitelist to be applied and rejection cleared")
+	}
+}
@@ -0,0 +1,236 @@
+package delegation_backend
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+	logging "github.com/ipfs/go-log/v2"
+)
+
+// Kinds of whitelist changes
+const (
+	WhitelistKeyAdded   = "added"
+	WhitelistKeyRemoved = "removed"
+	WhitelistKeyUpdated = "updated"
+)
+
+// WhitelistChange records a public key being added to or removed from
+// the whitelist, or its entry being updated, on a whitelist refresh.
+type WhitelistChange struct {
+	PublicKey Pk
+	Change    string
+	ChangedAt time.Time
+	// Entry is the current entry, or the last one for removed keys
+	Entry *WhitelistEntry
+}
+
+// Equal reports whether both entries have the same enrollment window and metadata.
+func (e *WhitelistEntry) Equal(other *WhitelistEntry) bool {
+	return e.EnrollmentStart.Equal(other.EnrollmentStart) &&
+		e.EnrollmentEnd.Equal(other.EnrollmentEnd) &&
+		e.Operator == other.Operator && e.Tier == other.Tier
+}
+
+// DiffWhitelists lists changes turning prev into next, ordered by public key.
+func DiffWhitelists(prev, next Whitelist, at time.Time) []WhitelistChange {
+	var changes []WhitelistChange
+	for pk, entry := range next {
+		if prevEntry, ok := prev[pk]; !ok {
+			changes = append(changes, WhitelistChange{pk, WhitelistKeyAdded, at, entry})
+		} else if !prevEntry.Equal(entry) {
+			changes = append(changes, WhitelistChange{pk, WhitelistKeyUpdated, at, entry})
+		}
+	}
+	for pk, entry := range prev {
+		if _, ok := next[pk]; !ok {
+			changes = append(changes, WhitelistChange{pk, WhitelistKeyRemoved, at, entry})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].PublicKey.String() < changes[j].PublicKey.String()
+	})
+	return changes
+}
+
+// logWhitelistChanges logs every change as a separate structured entry.
+func logWhitelistChanges(log *logging.ZapEventLogger, changes []WhitelistChange) {
+	for _, c := range changes {
+		whitelistChangesTotal.WithLabelValues(c.Change).Inc()
+		log.Infow("Delegation whitelist changed",
+			"change", c.Change,
+			"public_key", c.PublicKey.String(),
+			"operator", c.Entry.Operator,
+			"tier", c.Entry.Tier,
+		)
+	}
+}
+
+// WhitelistHistory persists whitelist changes, so that it is possible
+// to tell when a key was added to or removed from the whitelist.
+type WhitelistHistory interface {
+	RecordWhitelistChanges(ctx context.Context, changes []WhitelistChange) error
+	// LatestWhitelist replays the history, returning the whitelist it
+	// ends with along with the time each key was last added or updated.
+	LatestWhitelist(ctx context.Context) (Whitelist, map[Pk]time.Time, error)
+}
+
+// replayWhitelistChanges applies the latest change of every key,
+// keys which were last removed aren't part of the whitelist.
+func replayWhitelistChanges(changes []WhitelistChange) (Whitelist, map[Pk]time.Time) {
+	latest := make(map[Pk]WhitelistChange)
+	for _, c := range changes {
+		if l, ok := latest[c.PublicKey]; !ok || c.ChangedAt.After(l.ChangedAt) {
+			latest[c.PublicKey] = c
+		}
+	}
+	wl := make(Whitelist)
+	changedAt := make(map[Pk]time.Time)
+	for pk, c := range latest {
+		if c.Change != WhitelistKeyRemoved {
+			wl[pk] = c.Entry
+			changedAt[pk] = c.ChangedAt
+		}
+	}
+	return wl, changedAt
+}
+
+// scanWhitelistChange builds a change out of the columns of a whitelist_history row.
+func scanWhitelistChange(publicKey, change string, changedAt time.Time, operator, tier string, start, end time.Time) (WhitelistChange, error) {
+	var pk Pk
+	if err := StringToPk(&pk, publicKey); err != nil {
+		return WhitelistChange{}, err
+	}
+	entry := &WhitelistEntry{EnrollmentStart: start, EnrollmentEnd: end, Operator: operator, Tier: tier}
+	return WhitelistChange{pk, change, changedAt, entry}, nil
+}
+
+// NewWhitelistHistory stores the history in the database of one of the
+// storage backends (PostgreSQL or AWS Keyspaces, in that order of preference),
+// sharing its connection. It returns nil if neither is configured.
+func NewWhitelistHistory(storages []Storage) WhitelistHistory {
+	if db := PostgreSQLDB(storages); db != nil {
+		return &PostgreSQLWhitelistHistory{DB: db}
+	}
+	if kc := KeyspacesSession(storages); kc != nil {
+		return &KeyspacesWhitelistHistory{Session: kc.Session, Keyspace: kc.Keyspace}
+	}
+	return nil
+}
+
+// nullTime maps zero time (e.g. an unbounded enrollment window) to NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// PostgreSQLWhitelistHistory stores changes in the whitelist_history table,
+// created by database migrations.
+type PostgreSQLWhitelistHistory struct {
+	DB *sql.DB
+}
+
+func (h *PostgreSQLWhitelistHistory) RecordWhitelistChanges(ctx context.Context, changes []WhitelistChange) error {
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	query := `INSERT INTO whitelist_history
+				(public_key,
+				 change,
+				 changed_at,
+				 operator,
+				 tier,
+				 enrollment_start,
+				 enrollment_end)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	for _, c := range changes {
+		if _, err := tx.ExecContext(ctx, query, c.PublicKey.String(), c.Change, c.ChangedAt,
+			c.Entry.Operator, c.Entry.Tier, nullTime(c.Entry.EnrollmentStart), nullTime(c.Entry.EnrollmentEnd)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *PostgreSQLWhitelistHistory) LatestWhitelist(ctx context.Context) (Whitelist, map[Pk]time.Time, error) {
+	query := `SELECT DISTINCT ON (public_key)
+				public_key, change, changed_at, operator, tier, enrollment_start, enrollment_end
+			  FROM whitelist_history
+			  ORDER BY public_key, changed_at DESC, id DESC`
+	rows, err := h.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var changes []WhitelistChange
+	for rows.Next() {
+		var publicKey, change string
+		var changedAt time.Time
+		var operator, tier sql.NullString
+		var start, end sql.NullTime
+		if err := rows.Scan(&publicKey, &change, &changedAt, &operator, &tier, &start, &end); err != nil {
+			return nil, nil, err
+		}
+		c, err := scanWhitelistChange(publicKey, change, changedAt, operator.String, tier.String, start.Time, end.Time)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	wl, changedAt := replayWhitelistChanges(changes)
+	return wl, changedAt, nil
+}
+
+// KeyspacesWhitelistHistory stores changes in the whitelist_history table,
+// created by database migrations.
+type KeyspacesWhitelistHistory struct {
+	Session  *gocql.Session
+	Keyspace string
+}
+
+func (h *KeyspacesWhitelistHistory) RecordWhitelistChanges(ctx context.Context, changes []WhitelistChange) error {
+	query := "INSERT INTO " + h.Keyspace + ".whitelist_history (public_key, changed_at, change, operator, tier, enrollment_start, enrollment_end) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	for _, c := range changes {
+		var start, end interface{}
+		if !c.Entry.EnrollmentStart.IsZero() {
+			start = c.Entry.EnrollmentStart
+		}
+		if !c.Entry.EnrollmentEnd.IsZero() {
+			end = c.Entry.EnrollmentEnd
+		}
+		if err := h.Session.Query(query, c.PublicKey.String(), c.ChangedAt, c.Change,
+			c.Entry.Operator, c.Entry.Tier, start, end).WithContext(ctx).Exec(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *KeyspacesWhitelistHistory) LatestWhitelist(ctx context.Context) (Whitelist, map[Pk]time.Time, error) {
+	// Rows of a key are clustered by descending change time, so its first row is the latest,
+	// but Keyspaces doesn't support PER PARTITION LIMIT, hence all rows are read
+	query := "SELECT public_key, change, changed_at, operator, tier, enrollment_start, enrollment_end FROM " + h.Keyspace + ".whitelist_history"
+	iter := h.Session.Query(query).WithContext(ctx).Iter()
+	var changes []WhitelistChange
+	var publicKey, change, operator, tier string
+	var at, start, end time.Time
+	for iter.Scan(&publicKey, &change, &at, &operator, &tier, &start, &end) {
+		c, err := scanWhitelistChange(publicKey, change, at, operator, tier, start, end)
+		if err != nil {
+			iter.Close()
+			return nil, nil, err
+		}
+		changes = append(changes, c)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	wl, changedAt := replayWhitelistChanges(changes)
+	return wl, changedAt, nil
+}
@@ -0,0 +1,75 @@
+package delegation_backend
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWhitelistHistory struct {
+	mutex   sync.Mutex
+	changes []WhitelistChange
+}
+
+func (h *testWhitelistHistory) RecordWhitelistChanges(_ context.Context, changes []WhitelistChange) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.changes = append(h.changes, changes...)
+	return nil
+}
+
+func (h *testWhitelistHistory) LatestWhitelist(_ context.Context) (Whitelist, map[Pk]time.Time, error) {
+	wl, changedAt := replayWhitelistChanges(h.recorded())
+	return wl, changedAt, nil
+}
+
+func (h *testWhitelistHistory) recorded() []WhitelistChange {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]WhitelistChange(nil), h.changes...)
+}
+
+func TestDiffWhitelists(t *testing.T) {
+	pk1, pk2, pk3, pk4 := mustPk(t, PK1), mustPk(t, PK2), mustPk(t, PK3), mustPk(t, PK4)
+	prev := Whitelist{pk1: {}, pk2: {Operator: "a"}, pk3: {Tier: "1"}}
+	next := Whitelist{pk1: {}, pk2: {Operator: "b"}, pk4: {}}
+	at := time.Now()
+	changes := DiffWhitelists(prev, next, at)
+	expected := map[Pk]string{pk2: WhitelistKeyUpdated, pk3: WhitelistKeyRemoved, pk4: WhitelistKeyAdded}
+	if len(changes) != len(expected) {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	for i, c := range changes {
+		if expected[c.PublicKey] != c.Change || !c.ChangedAt.Equal(at) {
+			t.Fatalf("unexpected change: %+v", c)
+		}
+		if i > 0 && changes[i-1].PublicKey.String() > c.PublicKey.String() {
+			t.Fatal("changes aren't ordered by public key")
+		}
+		if c.PublicKey == pk3 && c.Entry.Tier != "1" {
+			t.Fatal("removed key should carry its last entry")
+		}
+	}
+}
+
+func TestWhitelistMVarUpdate(t *testing.T) {
+	pk1, pk2 := mustPk(t, PK1), mustPk(t, PK2)
+	wlMvar := new(WhitelistMVar)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if changes := wlMvar.Update(&Whitelist{pk1: {}}, t0); len(changes) != 0 {
+		t.Fatalf("initial whitelist reported as changes: %+v", changes)
+	}
+	t1 := t0.Add(time.Hour)
+	changes := wlMvar.Update(&Whitelist{pk1: {}, pk2: {}}, t1)
+	if len(changes) != 1 || changes[0].PublicKey != pk2 {
+		t.Fatalf("unexpected changes: %+v", changes)
+	}
+	if !wlMvar.ChangedAt(pk1).Equal(t0) || !wlMvar.ChangedAt(pk2).Equal(t1) || !wlMvar.LastRefresh().Equal(t1) {
+		t.Fatal("unexpected change times")
+	}
+	wlMvar.Update(&Whitelist{pk2: {}}, t1.Add(time.Hour))
+	if !wlMvar.ChangedAt(pk1).IsZero() {
+		t.Fatal("removed key still has change time")
+	}
+}
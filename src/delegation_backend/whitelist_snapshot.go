@@ -0,0 +1,248 @@
+package delegation_backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const DEFAULT_WHITELIST_SNAPSHOT_MAX_AGE = 24 * time.Hour
+
+// WhitelistSnapshot keeps the last whitelist which was successfully loaded
+// and applied in a local file, so that the service is able to start
+// while the whitelist source is unavailable.
+type WhitelistSnapshot struct {
+	Path string
+	// MaxAge is the age after which the snapshot isn't used, 0 means no limit
+	MaxAge time.Duration
+}
+
+// NewWhitelistSnapshot returns nil if path is empty. DEFAULT_WHITELIST_SNAPSHOT_MAX_AGE
+// is used if maxAgeMinutes is 0, a negative maxAgeMinutes disables the age limit.
+func NewWhitelistSnapshot(path string, maxAgeMinutes int) *WhitelistSnapshot {
+	if path == "" {
+		return nil
+	}
+	maxAge := DEFAULT_WHITELIST_SNAPSHOT_MAX_AGE
+	if maxAgeMinutes > 0 {
+		maxAge = time.Duration(maxAgeMinutes) * time.Minute
+	} else if maxAgeMinutes < 0 {
+		maxAge = 0
+	}
+	return &WhitelistSnapshot{Path: path, MaxAge: maxAge}
+}
+
+type whitelistSnapshotFile struct {
+	SavedAt time.Time `json:"saved_at"`
+	// Checksum is the hex-encoded SHA-256 of Entries
+	Checksum string          `json:"checksum"`
+	Entries  json.RawMessage `json:"entries"`
+}
+
+func formatEnrollmentTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// whitelistSnapshotRecord is an entry of the snapshot along with
+// the time its key was last added or updated.
+type whitelistSnapshotRecord struct {
+	whitelistRecord
+	ChangedAt string `json:"changed_at,omitempty"`
+}
+
+// Save atomically replaces the snapshot with wl and the change times of its keys.
+// Both the file and its directory are synced, so the snapshot survives a crash of the host.
+func (s *WhitelistSnapshot) Save(wl Whitelist, changedAt map[Pk]time.Time, savedAt time.Time) error {
+	records := make([]whitelistSnapshotRecord, 0, len(wl))
+	for pk, e := range wl {
+		records = append(records, whitelistSnapshotRecord{
+			whitelistRecord: whitelistRecord{
+				PublicKey:       pk.String(),
+				EnrollmentStart: formatEnrollmentTime(e.EnrollmentStart),
+				EnrollmentEnd:   formatEnrollmentTime(e.EnrollmentEnd),
+				Operator:        e.Operator,
+				Tier:            e.Tier,
+			},
+			ChangedAt: formatEnrollmentTime(changedAt[pk]),
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].PublicKey < records[j].PublicKey })
+	entries, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	checksum := sha256.Sum256(entries)
+	bs, err := json.Marshal(whitelistSnapshotFile{
+		SavedAt:  savedAt.UTC(),
+		Checksum: hex.EncodeToString(checksum[:]),
+		Entries:  entries,
+	})
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := writeFileSync(tmp, bs); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.Path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(s.Path))
+}
+
+func writeFileSync(path string, bs []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bs); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename within the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Load reads the snapshot, verifying its checksum and age.
+// It returns the whitelist along with the time it was saved.
+func (s *WhitelistSnapshot) Load(now time.Time) (Whitelist, time.Time, error) {
+	wl, _, savedAt, err := s.read()
+	if err != nil {
+		return nil, savedAt, err
+	}
+	if age := now.Sub(savedAt); s.MaxAge > 0 && age > s.MaxAge {
+		return nil, savedAt, fmt.Errorf("whitelist snapshot is %v old, more than the maximum of %v", age.Truncate(time.Second), s.MaxAge)
+	}
+	return wl, savedAt, nil
+}
+
+// read reads the snapshot regardless of its age, verifying its checksum.
+// It returns the whitelist with the change times of its keys (missing
+// in snapshots saved by earlier versions) and the time it was saved.
+func (s *WhitelistSnapshot) read() (Whitelist, map[Pk]time.Time, time.Time, error) {
+	bs, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	var f whitelistSnapshotFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("malformed whitelist snapshot: %w", err)
+	}
+	checksum := sha256.Sum256(f.Entries)
+	if hex.EncodeToString(checksum[:]) != f.Checksum {
+		return nil, nil, f.SavedAt, errors.New("whitelist snapshot checksum mismatch")
+	}
+	var records []whitelistSnapshotRecord
+	if err := json.Unmarshal(f.Entries, &records); err != nil {
+		return nil, nil, f.SavedAt, fmt.Errorf("malformed whitelist snapshot: %w", err)
+	}
+	wl := make(Whitelist, len(records))
+	changedAt := make(map[Pk]time.Time, len(records))
+	for _, r := range records {
+		// Entries were validated before being saved, so any error is corruption
+		var pk Pk
+		if err := StringToPk(&pk, r.PublicKey); err != nil {
+			return nil, nil, f.SavedAt, fmt.Errorf("malformed whitelist snapshot entry: %w", err)
+		}
+		entry, err := NewWhitelistEntry(r.EnrollmentStart, r.EnrollmentEnd, r.Operator, r.Tier)
+		if err != nil {
+			return nil, nil, f.SavedAt, fmt.Errorf("malformed whitelist snapshot entry for %s: %w", r.PublicKey, err)
+		}
+		wl[pk] = entry
+		if r.ChangedAt != "" {
+			if changedAt[pk], err = time.Parse(time.RFC3339Nano, r.ChangedAt); err != nil {
+				return nil, nil, f.SavedAt, fmt.Errorf("malformed whitelist snapshot entry for %s: %w", r.PublicKey, err)
+			}
+		}
+	}
+	return wl, changedAt, f.SavedAt, nil
+}
+
+// Init loads the whitelist on startup. The whitelist in use before the
+// restart is seeded first (see seed), so that changes made to the source
+// meanwhile are logged and persisted like on a refresh, and the guard
+// checks the loaded whitelist against it. If the source fails or its
+// whitelist is refused by the guard, the snapshot (if not nil) is used
+// instead. A whitelist loaded from the source is saved as the new snapshot.
+// A whitelist out of the snapshot counts as loaded when the snapshot was saved.
+func (r *WhitelistRefresher) Init(ctx context.Context) error {
+	r.seed(ctx)
+	wl, err := LoadWhitelist(ctx, r.Source, 1)
+	if err == nil {
+		err = r.Guard.Check(r.previous(), wl)
+	}
+	if err == nil {
+		r.apply(ctx, wl, time.Now())
+		return nil
+	}
+	if r.Snapshot == nil {
+		return fmt.Errorf("failed to initialize whitelist from %s: %w", r.Source.Name(), err)
+	}
+	r.Log.Errorf("Failed to initialize whitelist from %s, falling back to snapshot %s: %v", r.Source.Name(), r.Snapshot.Path, err)
+	wl, savedAt, snapshotErr := r.Snapshot.Load(time.Now())
+	if snapshotErr == nil {
+		snapshotErr = r.Guard.Check(nil, wl)
+	}
+	if snapshotErr != nil {
+		return fmt.Errorf("failed to initialize whitelist from %s (%v) and from snapshot: %w", r.Source.Name(), err, snapshotErr)
+	}
+	// The snapshot may be older than the history it was seeded from,
+	// so differences to it aren't recorded as changes
+	r.Whitelist.Update(&wl, savedAt)
+	var guardErr *WhitelistGuardError
+	if errors.As(err, &guardErr) {
+		// Reported until a refresh is accepted, e.g. a forced one
+		r.Whitelist.Reject(err, time.Now())
+	}
+	r.Log.Warnf("Delegation whitelist loaded from snapshot saved at %v, number of BPs: %v", savedAt, len(wl))
+	return nil
+}
+
+// seed sets the whitelist in use before the restart as the previous one.
+// It's replayed out of the history if any, or read out of the snapshot
+// otherwise (regardless of its age). Without either, the initial whitelist
+// isn't diffed and its keys count as changed when it's loaded.
+func (r *WhitelistRefresher) seed(ctx context.Context) {
+	if r.History != nil {
+		wl, changedAt, err := r.History.LatestWhitelist(ctx)
+		if err == nil {
+			r.Whitelist.Seed(wl, changedAt)
+			return
+		}
+		r.Log.Errorf("Failed to read the previous delegation whitelist out of the history: %v", err)
+	}
+	if r.Snapshot == nil {
+		return
+	}
+	wl, changedAt, _, err := r.Snapshot.read()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			r.Log.Errorf("Failed to read the previous delegation whitelist, changes made before startup aren't recorded: %v", err)
+		}
+		return
+	}
+	r.Whitelist.Seed(wl, changedAt)
+}
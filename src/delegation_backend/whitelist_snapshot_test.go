@@ -0,0 +1,158 @@
+package delegation_backend
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+type failingWhitelistSource struct{}
+
+func (failingWhitelistSource) Name() string {
+	return "failing"
+}
+
+func (failingWhitelistSource) Load(_ context.Context) (Whitelist, error) {
+	return nil, errors.New("unavailable")
+}
+
+func (failingWhitelistSource) Close() error {
+	return nil
+}
+
+func TestWhitelistSnapshot(t *testing.T) {
+	snapshot := NewWhitelistSnapshot(filepath.Join(t.TempDir(), "whitelist.json"), 60)
+	if snapshot.MaxAge != time.Hour {
+		t.Fatalf("unexpected max age: %v", snapshot.MaxAge)
+	}
+	entry, err := NewWhitelistEntry("2024-01-01", "2024-12-31T12:30:00.5Z", "op", "gold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := Whitelist{mustPk(t, PK1): entry, mustPk(t, PK2): {}}
+	savedAt := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	changedAt := savedAt.Add(-time.Hour)
+	if err := snapshot.Save(wl, map[Pk]time.Time{mustPk(t, PK1): changedAt}, savedAt); err != nil {
+		t.Fatal(err)
+	}
+	if _, loadedChangedAt, _, err := snapshot.read(); err != nil || !loadedChangedAt[mustPk(t, PK1)].Equal(changedAt) || !loadedChangedAt[mustPk(t, PK2)].IsZero() {
+		t.Fatalf("unexpected change times %v: %v", loadedChangedAt, err)
+	}
+
+	loaded, loadedSavedAt, err := snapshot.Load(savedAt.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loadedSavedAt.Equal(savedAt) || len(loaded) != 2 || !loaded[mustPk(t, PK1)].Equal(entry) {
+		t.Fatalf("unexpected snapshot: %v saved at %v", loaded, loadedSavedAt)
+	}
+
+	if _, _, err := snapshot.Load(savedAt.Add(2 * time.Hour)); err == nil {
+		t.Fatal("expected stale snapshot to be refused")
+	}
+	snapshot.MaxAge = 0
+	if _, _, err := snapshot.Load(savedAt.Add(1000 * time.Hour)); err != nil {
+		t.Fatalf("expected snapshot without age limit to be loaded: %v", err)
+	}
+
+	bs, _ := os.ReadFile(snapshot.Path)
+	os.WriteFile(snapshot.Path, []byte(strings.Replace(string(bs), `"op"`, `"xx"`, 1)), 0644)
+	if _, _, err := snapshot.Load(savedAt); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("expected tampered snapshot to be refused, got %v", err)
+	}
+}
+
+func TestWhitelistRefresherInit(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	snapshot := NewWhitelistSnapshot(filepath.Join(t.TempDir(), "whitelist.json"), 0)
+	guard := NewWhitelistGuard(0, 1)
+	init := func(src WhitelistSource, snapshot *WhitelistSnapshot) (*WhitelistMVar, error) {
+		wlMvar := new(WhitelistMVar)
+		r := &WhitelistRefresher{Source: src, Whitelist: wlMvar, Guard: guard, Snapshot: snapshot, Log: log}
+		return wlMvar, r.Init(context.Background())
+	}
+
+	if _, err := init(failingWhitelistSource{}, snapshot); err == nil {
+		t.Fatal("expected failure without source and snapshot")
+	}
+
+	src := &staticWhitelistSource{wl: testWhitelistOfSize(3)}
+	wlMvar, err := init(src, snapshot)
+	if err != nil || len(*wlMvar.ReadWhitelist()) != 3 {
+		t.Fatalf("unexpected whitelist: %v", err)
+	}
+	savedAt := wlMvar.LastRefresh()
+
+	// The whitelist out of the snapshot is reported as loaded when it was saved
+	wlMvar, err = init(failingWhitelistSource{}, snapshot)
+	if err != nil || len(*wlMvar.ReadWhitelist()) != 3 {
+		t.Fatalf("expected fallback to snapshot: %v", err)
+	}
+	if !wlMvar.LastRefresh().Equal(savedAt) {
+		t.Fatalf("expected load time of the snapshot %v, got %v", savedAt, wlMvar.LastRefresh())
+	}
+
+	// Whitelist refused by the guard isn't saved and the snapshot is used instead
+	src.wl = Whitelist{}
+	wlMvar, err = init(src, snapshot)
+	if err != nil || len(*wlMvar.ReadWhitelist()) != 3 {
+		t.Fatalf("expected fallback to snapshot: %v", err)
+	}
+
+	// The initial whitelist is checked against the previous one for shrinking
+	src.wl = testWhitelistKeeping(*wlMvar.ReadWhitelist(), 1, 0)
+	wlMvar, err = init(src, snapshot)
+	if err != nil || len(*wlMvar.ReadWhitelist()) != 3 {
+		t.Fatalf("expected fallback to snapshot: %v", err)
+	}
+	if wlMvar.Rejection() == nil {
+		t.Fatal("expected shrunk whitelist to be reported as refused")
+	}
+
+	if _, err := init(failingWhitelistSource{}, nil); err == nil {
+		t.Fatal("expected failure without snapshot")
+	}
+}
+
+func TestWhitelistRefresherInitSeeded(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	pk1, pk2, pk3 := mustPk(t, PK1), mustPk(t, PK2), mustPk(t, PK3)
+	addedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	history := new(testWhitelistHistory)
+	history.RecordWhitelistChanges(context.Background(), []WhitelistChange{
+		{pk1, WhitelistKeyAdded, addedAt, &WhitelistEntry{}},
+		{pk3, WhitelistKeyAdded, addedAt, &WhitelistEntry{}},
+	})
+	src := &staticWhitelistSource{wl: Whitelist{pk1: {}, pk2: {}}}
+	wlMvar := new(WhitelistMVar)
+	snapshot := NewWhitelistSnapshot(filepath.Join(t.TempDir(), "whitelist.json"), 0)
+	r := &WhitelistRefresher{Source: src, Whitelist: wlMvar, Guard: NewWhitelistGuard(0, 0), History: history, Snapshot: snapshot, Log: log}
+	if err := r.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Changes made while the service was down are recorded
+	recorded := history.recorded()[2:]
+	expected := map[Pk]string{pk2: WhitelistKeyAdded, pk3: WhitelistKeyRemoved}
+	if len(recorded) != 2 || expected[recorded[0].PublicKey] != recorded[0].Change || expected[recorded[1].PublicKey] != recorded[1].Change {
+		t.Fatalf("unexpected changes recorded: %+v", recorded)
+	}
+	if !wlMvar.ChangedAt(pk1).Equal(addedAt) || wlMvar.ChangedAt(pk2).Before(addedAt.Add(time.Hour)) {
+		t.Fatalf("unexpected change times: %v, %v", wlMvar.ChangedAt(pk1), wlMvar.ChangedAt(pk2))
+	}
+
+	// Without history, the snapshot is used to seed
+	wlMvar = new(WhitelistMVar)
+	r = &WhitelistRefresher{Source: src, Whitelist: wlMvar, Guard: NewWhitelistGuard(0, 0), Snapshot: snapshot, Log: log}
+	if err := r.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !wlMvar.ChangedAt(pk1).Equal(addedAt) {
+		t.Fatalf("expected change time out of the snapshot, got %v", wlMvar.ChangedAt(pk1))
+	}
+}
@@ -0,0 +1,491 @@
+package delegation_backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/lib/pq"
+	"google.golang.org/api/option"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// Whitelist source types, as configured in WhitelistSourceConfig
+const (
+	WhitelistSourceSheets     = "sheets"
+	WhitelistSourceFile       = "file"
+	WhitelistSourceHTTP       = "http"
+	WhitelistSourcePostgreSQL = "postgresql"
+)
+
+const WHITELIST_FILE_POLL_INTERVAL = 5 * time.Second
+const WHITELIST_HTTP_TIMEOUT = 30 * time.Second
+const DEFAULT_WHITELIST_HTTP_MAX_SIZE = 16 // MB
+
+// WhitelistSource loads the public keys of delegation program participants.
+type WhitelistSource interface {
+	// Name identifies the source in logs.
+	Name() string
+	// Load retrieves the current whitelist.
+	Load(ctx context.Context) (Whitelist, error)
+	// Close releases resources held by the source.
+	Close() error
+}
+
+// WhitelistChangeNotifier is implemented by sources which are able
+// to tell when the whitelist changed, without waiting for the refresh interval.
+type WhitelistChangeNotifier interface {
+	Changes() <-chan struct{}
+}
+
+// NewWhitelistSource creates the whitelist source configured in appCfg,
+// Google Sheets are used if no source is configured explicitly.
+func NewWhitelistSource(ctx context.Context, appCfg AppConfig, log *logging.ZapEventLogger) (WhitelistSource, error) {
+	cfg := appCfg.WhitelistSource
+	if cfg == nil {
+		cfg = &WhitelistSourceConfig{Type: WhitelistSourceSheets}
+	}
+	switch cfg.Type {
+	case "", WhitelistSourceSheets:
+		service, err := sheets.NewService(ctx, option.WithScopes(sheets.SpreadsheetsReadonlyScope))
+		if err != nil {
+			return nil, fmt.Errorf("error creating Sheets service: %w", err)
+		}
+		return &SheetsWhitelistSource{Service: service, AppCfg: appCfg, Log: log}, nil
+	case WhitelistSourceFile:
+		if cfg.Path == "" {
+			return nil, errors.New("whitelist file path isn't configured")
+		}
+		return NewFileWhitelistSource(cfg.Path, WHITELIST_FILE_POLL_INTERVAL, log), nil
+	case WhitelistSourceHTTP:
+		if cfg.URL == "" {
+			return nil, errors.New("whitelist URL isn't configured")
+		}
+		maxSize := cfg.MaxSize
+		if maxSize <= 0 {
+			maxSize = DEFAULT_WHITELIST_HTTP_MAX_SIZE
+		}
+		return &HTTPWhitelistSource{
+			URL:     cfg.URL,
+			Client:  &http.Client{Timeout: WHITELIST_HTTP_TIMEOUT},
+			MaxSize: int64(maxSize) << 20,
+			Log:     log,
+		}, nil
+	case WhitelistSourcePostgreSQL:
+		dbCfg := cfg.PostgreSQL
+		if dbCfg == nil {
+			dbCfg = appCfg.PostgreSQL
+		}
+		if dbCfg == nil {
+			return nil, errors.New("PostgreSQL connection for the whitelist isn't configured")
+		}
+		if cfg.Table == "" || cfg.Column == "" {
+			return nil, errors.New("whitelist table and column should be configured")
+		}
+		db, err := NewPostgreSQL(dbCfg)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to PostgreSQL: %w", err)
+		}
+		return &PostgreSQLWhitelistSource{DB: db, Table: cfg.Table, Column: cfg.Column}, nil
+	default:
+		return nil, fmt.Errorf("unknown whitelist source: %s", cfg.Type)
+	}
+}
+
+// LoadWhitelist loads the whitelist out of the source, retrying with exponential backoff.
+func LoadWhitelist(ctx context.Context, src WhitelistSource, retries int) (Whitelist, error) {
+	var wl Whitelist
+	err := ExponentialBackoff(func() error {
+		var err error
+		wl, err = src.Load(ctx)
+		return err
+	}, retries, initialBackoff)
+	return wl, err
+}
+
+// WhitelistRefresher periodically reloads the whitelist out of its source.
+type WhitelistRefresher struct {
+	Source    WhitelistSource
+	Whitelist *WhitelistMVar
+	Interval  time.Duration
+	Guard     WhitelistGuard
+	// History persists changes of the whitelist, if not nil
+	History WhitelistHistory
+	// Snapshot is replaced with every applied whitelist, if not nil
+	Snapshot *WhitelistSnapshot
+	Log      *logging.ZapEventLogger
+
+	mutex sync.Mutex // serializes refreshes, as they may also be forced
+}
+
+// Run refreshes the whitelist every refresh interval (and on changes,
+// if the source reports them) until ctx is cancelled.
+func (r *WhitelistRefresher) Run(ctx context.Context) {
+	var changes <-chan struct{}
+	if n, ok := r.Source.(WhitelistChangeNotifier); ok {
+		changes = n.Changes()
+	}
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changes:
+			r.Log.Infof("Delegation whitelist source %s changed", r.Source.Name())
+		}
+		if err := r.Refresh(ctx); err != nil {
+			r.Log.Errorf("Failed to refresh delegation whitelist, using previous one, error: %v", err)
+		}
+	}
+}
+
+// Refresh loads the whitelist and replaces the current one with it, unless
+// loading fails or the guard refuses it. Changes are logged and persisted,
+// the applied whitelist is saved as the snapshot.
+func (r *WhitelistRefresher) Refresh(ctx context.Context) error {
+	_, _, err := r.refresh(ctx, r.Guard, 10)
+	return err
+}
+
+// ForceRefresh is Refresh without the shrink check of the guard, to deliberately
+// accept a legitimate large shrink of the whitelist. It returns the applied
+// whitelist along with its changes.
+func (r *WhitelistRefresher) ForceRefresh(ctx context.Context) (Whitelist, []WhitelistChange, error) {
+	guard := r.Guard
+	guard.MaxShrinkPercent = 0
+	r.Log.Warnf("Forcing refresh of delegation whitelist out of %s without the shrink check", r.Source.Name())
+	return r.refresh(ctx, guard, 1)
+}
+
+func (r *WhitelistRefresher) refresh(ctx context.Context, guard WhitelistGuard, retries int) (Whitelist, []WhitelistChange, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	wl, err := LoadWhitelist(ctx, r.Source, retries)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := guard.Check(r.previous(), wl); err != nil {
+		r.Whitelist.Reject(err, time.Now())
+		return nil, nil, err
+	}
+	return wl, r.apply(ctx, wl, time.Now()), nil
+}
+
+// previous returns the whitelist in use, nil if there's none yet.
+func (r *WhitelistRefresher) previous() Whitelist {
+	if current := r.Whitelist.ReadWhitelist(); current != nil {
+		return *current
+	}
+	return nil
+}
+
+// apply replaces the current whitelist with wl, logging and persisting
+// the changes, and saves it as the snapshot. It returns the changes.
+func (r *WhitelistRefresher) apply(ctx context.Context, wl Whitelist, now time.Time) []WhitelistChange {
+	diff := r.Whitelist.Update(&wl, now)
+	logWhitelistChanges(r.Log, diff)
+	r.Log.Infow("Delegation whitelist refreshed", "size", len(wl), "changes", len(diff))
+	if r.Snapshot != nil {
+		_, changedAt, _ := r.Whitelist.snapshot()
+		if err := r.Snapshot.Save(wl, changedAt, now); err != nil {
+			r.Log.Errorf("Failed to save whitelist snapshot to %s: %v", r.Snapshot.Path, err)
+		}
+	}
+	if r.History != nil && len(diff) > 0 {
+		err := ExponentialBackoff(func() error {
+			return r.History.RecordWhitelistChanges(ctx, diff)
+		}, maxRetries, initialBackoff)
+		if err != nil {
+			r.Log.Errorf("Failed to record delegation whitelist changes: %v", err)
+		}
+	}
+	return diff
+}
+
+// parseWhitelistRow adds the participant described by fields to the whitelist:
+// public key, enrollment start, enrollment end, operator and tier, all but
+// the key being optional. Rows without a valid public key (e.g. headers)
+// are skipped. Rows with a malformed enrollment window are skipped as well,
+// but logged and counted, as they leave out a participant by mistake.
+// WhitelistGuard accounts for participants left out that way.
+func parseWhitelistRow(wl Whitelist, fields []string, log logging.StandardLogger) {
+	if len(fields) == 0 {
+		return
+	}
+	var pk Pk
+	if err := StringToPk(&pk, strings.TrimSpace(fields[0])); err != nil {
+		return
+	}
+	var meta [4]string
+	copy(meta[:], fields[1:])
+	entry, err := NewWhitelistEntry(meta[0], meta[1], meta[2], meta[3])
+	if err != nil {
+		whitelistRowsRejectedTotal.Inc()
+		log.Warnf("Delegation whitelist row rejected for %s %q: %v", pk.String(), fields, err)
+		return
+	}
+	wl[pk] = entry
+}
+
+// parseWhitelistKeys adds valid public keys to the whitelist,
+// anything else (e.g. headers or empty values) is skipped.
+func parseWhitelistKeys(wl Whitelist, keys []string) {
+	for _, k := range keys {
+		var pk Pk
+		if err := StringToPk(&pk, strings.TrimSpace(k)); err == nil {
+			wl[pk] = &WhitelistEntry{}
+		}
+	}
+}
+
+type whitelistRecord struct {
+	PublicKey       string `json:"public_key"`
+	EnrollmentStart string `json:"enrollment_start"`
+	EnrollmentEnd   string `json:"enrollment_end"`
+	Operator        string `json:"operator"`
+	Tier            string `json:"tier"`
+}
+
+// parseWhitelistJSON accepts a list of public keys, or of objects
+// with public_key, enrollment_start, enrollment_end, operator and tier.
+func parseWhitelistJSON(r io.Reader, log logging.StandardLogger) (Whitelist, error) {
+	var items []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&items); err != nil {
+		return nil, fmt.Errorf("error decoding whitelist JSON: %w", err)
+	}
+	wl := make(Whitelist)
+	for _, item := range items {
+		var key string
+		if err := json.Unmarshal(item, &key); err == nil {
+			parseWhitelistRow(wl, []string{key}, log)
+			continue
+		}
+		var rec whitelistRecord
+		if err := json.Unmarshal(item, &rec); err != nil {
+			return nil, fmt.Errorf("error decoding whitelist JSON: %w", err)
+		}
+		parseWhitelistRow(wl, []string{rec.PublicKey, rec.EnrollmentStart, rec.EnrollmentEnd, rec.Operator, rec.Tier}, log)
+	}
+	return wl, nil
+}
+
+// parseWhitelistCSV takes public keys from the first column,
+// followed by optional columns as described in parseWhitelistRow.
+func parseWhitelistCSV(r io.Reader, log logging.StandardLogger) (Whitelist, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	wl := make(Whitelist)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return wl, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading whitelist CSV: %w", err)
+		}
+		parseWhitelistRow(wl, record, log)
+	}
+}
+
+// FileWhitelistSource reads the whitelist out of a JSON file (when
+// named *.json) or a CSV file, and polls the file for modifications.
+type FileWhitelistSource struct {
+	Path string
+
+	log       logging.StandardLogger
+	changes   chan struct{}
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func NewFileWhitelistSource(path string, pollInterval time.Duration, log logging.StandardLogger) *FileWhitelistSource {
+	src := &FileWhitelistSource{
+		Path:    path,
+		log:     log,
+		changes: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	// the initial modification time is taken before returning,
+	// so that no change made after construction is missed
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	src.wg.Add(1)
+	go src.poll(pollInterval, modTime)
+	return src
+}
+
+func (src *FileWhitelistSource) Name() string {
+	return "file " + src.Path
+}
+
+func (src *FileWhitelistSource) Load(_ context.Context) (Whitelist, error) {
+	f, err := os.Open(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if strings.EqualFold(filepath.Ext(src.Path), ".json") {
+		return parseWhitelistJSON(f, src.log)
+	}
+	return parseWhitelistCSV(f, src.log)
+}
+
+func (src *FileWhitelistSource) poll(interval time.Duration, lastModTime time.Time) {
+	defer src.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-src.stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(src.Path)
+		if err != nil {
+			src.log.Warnf("Error checking whitelist file %s: %v", src.Path, err)
+			continue
+		}
+		if !info.ModTime().Equal(lastModTime) {
+			lastModTime = info.ModTime()
+			select {
+			case src.changes <- struct{}{}:
+			default: // change is already pending
+			}
+		}
+	}
+}
+
+func (src *FileWhitelistSource) Changes() <-chan struct{} {
+	return src.changes
+}
+
+// Close stops polling the file, calls after the first one are no-ops.
+func (src *FileWhitelistSource) Close() error {
+	src.closeOnce.Do(func() {
+		close(src.stop)
+		src.wg.Wait()
+	})
+	return nil
+}
+
+// HTTPWhitelistSource downloads the whitelist from a URL, responding
+// either with a JSON list of public keys (if its content type is
+// application/json) or with a public key per line.
+type HTTPWhitelistSource struct {
+	URL    string
+	Client *http.Client
+	// MaxSize is the largest response accepted in bytes, no limit if 0
+	MaxSize int64
+	Log     *logging.ZapEventLogger
+}
+
+func (src *HTTPWhitelistSource) Name() string {
+	return "http " + src.URL
+}
+
+func (src *HTTPWhitelistSource) Load(ctx context.Context) (Whitelist, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := src.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	var body io.Reader = resp.Body
+	if src.MaxSize > 0 {
+		if resp.ContentLength > src.MaxSize {
+			return nil, fmt.Errorf("whitelist response of %d bytes exceeds the limit of %d bytes", resp.ContentLength, src.MaxSize)
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, src.MaxSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("error reading whitelist response: %w", err)
+		}
+		if int64(len(data)) > src.MaxSize {
+			return nil, fmt.Errorf("whitelist response exceeds the limit of %d bytes", src.MaxSize)
+		}
+		body = bytes.NewReader(data)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		return parseWhitelistJSON(body, src.Log)
+	}
+	wl := make(Whitelist)
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		parseWhitelistKeys(wl, []string{scanner.Text()})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading whitelist response: %w", err)
+	}
+	return wl, nil
+}
+
+func (src *HTTPWhitelistSource) Close() error {
+	return nil
+}
+
+// PostgreSQLWhitelistSource reads public keys out of a table column.
+type PostgreSQLWhitelistSource struct {
+	DB     *sql.DB
+	Table  string
+	Column string
+}
+
+func (src *PostgreSQLWhitelistSource) Name() string {
+	return "postgresql " + src.Table
+}
+
+func (src *PostgreSQLWhitelistSource) Load(ctx context.Context) (Whitelist, error) {
+	// Table name may be qualified with a schema
+	tableParts := strings.Split(src.Table, ".")
+	for i, part := range tableParts {
+		tableParts[i] = pq.QuoteIdentifier(part)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", pq.QuoteIdentifier(src.Column), strings.Join(tableParts, "."))
+	rows, err := src.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key sql.NullString
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key.String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	wl := make(Whitelist)
+	parseWhitelistKeys(wl, keys)
+	return wl, nil
+}
+
+func (src *PostgreSQLWhitelistSource) Close() error {
+	return src.DB.Close()
+}
@@ -0,0 +1,164 @@
+package delegation_backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func mustPk(t *testing.T, s string) Pk {
+	var pk Pk
+	if err := StringToPk(&pk, s); err != nil {
+		t.Fatal(err)
+	}
+	return pk
+}
+
+func checkWhitelist(t *testing.T, wl Whitelist, keys ...string) {
+	if len(wl) != len(keys) {
+		t.Fatalf("expected %d keys in whitelist, got %d", len(keys), len(wl))
+	}
+	for _, k := range keys {
+		if wl[mustPk(t, k)] == nil {
+			t.Fatalf("expected %s to be whitelisted", k)
+		}
+	}
+}
+
+func TestFileWhitelistSource(t *testing.T) {
+	dir := t.TempDir()
+	log := logging.Logger("delegation backend test")
+
+	csvPath := filepath.Join(dir, "whitelist.csv")
+	os.WriteFile(csvPath, []byte("public_key,enrollment_start,enrollment_end,operator,tier\n"+PK1+",,2024-06-30,a,1\n\n"+PK2+"\nnot a key\n"+PK3+",garbage\n"), 0644)
+	csvSrc := NewFileWhitelistSource(csvPath, time.Hour, log)
+	defer csvSrc.Close()
+	rejectedRows := testutil.ToFloat64(whitelistRowsRejectedTotal)
+	wl, err := csvSrc.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWhitelist(t, wl, PK1, PK2)
+	// Only the row with a valid key and malformed enrollment window is counted
+	if testutil.ToFloat64(whitelistRowsRejectedTotal) != rejectedRows+1 {
+		t.Fatal("expected the malformed row to be counted")
+	}
+	if e := wl[mustPk(t, PK1)]; e.Operator != "a" || e.Tier != "1" || e.EnrollmentEnd.IsZero() {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	jsonPath := filepath.Join(dir, "whitelist.json")
+	os.WriteFile(jsonPath, []byte(`["`+PK3+`", "garbage", {"public_key": "`+PK4+`", "operator": "b", "enrollment_start": "2024-01-01T00:00:00Z"}]`), 0644)
+	jsonSrc := NewFileWhitelistSource(jsonPath, time.Hour, log)
+	defer jsonSrc.Close()
+	wl, err = jsonSrc.Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWhitelist(t, wl, PK3, PK4)
+	if e := wl[mustPk(t, PK4)]; e.Operator != "b" || e.EnrollmentStart.IsZero() {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+
+	missing := NewFileWhitelistSource(filepath.Join(dir, "missing.csv"), time.Hour, log)
+	defer missing.Close()
+	if _, err := missing.Load(context.Background()); err == nil {
+		t.Fatal("expected missing file to fail loading")
+	}
+}
+
+func TestFileWhitelistSourceRefresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.csv")
+	os.WriteFile(path, []byte(PK1+"\n"), 0644)
+	log := logging.Logger("delegation backend test")
+	src := NewFileWhitelistSource(path, 10*time.Millisecond, log)
+	defer src.Close()
+
+	wlMvar := new(WhitelistMVar)
+	wl, err := LoadWhitelist(context.Background(), src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wlMvar.Replace(&wl)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	history := new(testWhitelistHistory)
+	refresher := &WhitelistRefresher{Source: src, Whitelist: wlMvar, Interval: time.Hour, History: history, Log: log}
+	go refresher.Run(ctx)
+
+	os.WriteFile(path, []byte(PK1+"\n"+PK2+"\n"), 0644)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	waitFor(t, func() bool { return len(history.recorded()) == 1 })
+	if len(*wlMvar.ReadWhitelist()) != 2 {
+		t.Fatal("whitelist wasn't refreshed")
+	}
+	if c := history.recorded()[0]; c.PublicKey != mustPk(t, PK2) || c.Change != WhitelistKeyAdded {
+		t.Fatalf("unexpected change recorded: %+v", c)
+	}
+	// Closing before the deferred close doesn't panic
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPWhitelistSource(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/whitelist.json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`["` + PK1 + `", "` + PK2 + `"]`))
+		case "/whitelist.txt":
+			w.Write([]byte(strings.Join([]string{PK3, "", " " + PK1 + " "}, "\n")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	for path, keys := range map[string][]string{"/whitelist.json": {PK1, PK2}, "/whitelist.txt": {PK3, PK1}} {
+		src := &HTTPWhitelistSource{URL: srv.URL + path, Client: srv.Client(), Log: log}
+		wl, err := src.Load(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkWhitelist(t, wl, keys...)
+	}
+	src := &HTTPWhitelistSource{URL: srv.URL + "/missing", Client: srv.Client(), Log: log}
+	if _, err := src.Load(context.Background()); err == nil {
+		t.Fatal("expected error response to fail loading")
+	}
+	src = &HTTPWhitelistSource{URL: srv.URL + "/whitelist.json", Client: srv.Client(), Log: log, MaxSize: 2*int64(len(PK1)) + 8}
+	if _, err := src.Load(context.Background()); err != nil {
+		t.Fatalf("unexpected failure of response within the limit: %v", err)
+	}
+	src.MaxSize--
+	if _, err := src.Load(context.Background()); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("expected response exceeding the limit to fail loading, got %v", err)
+	}
+}
+
+func TestNewWhitelistSourceConfig(t *testing.T) {
+	log := logging.Logger("delegation backend test")
+	invalid := []WhitelistSourceConfig{
+		{Type: "ftp"},
+		{Type: WhitelistSourceFile},
+		{Type: WhitelistSourceHTTP},
+		{Type: WhitelistSourcePostgreSQL, Table: "whitelist", Column: "public_key"},
+	}
+	for _, cfg := range invalid {
+		cfg := cfg
+		if _, err := NewWhitelistSource(context.Background(), AppConfig{WhitelistSource: &cfg}, log); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
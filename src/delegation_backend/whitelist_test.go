@@ -0,0 +1,74 @@
+package delegation_backend
+
+import (
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestNewWhitelistEntry(t *testing.T) {
+	e, err := NewWhitelistEntry("2024-01-01", "2024-01-31", " Operator ", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Operator != "Operator" || e.Tier != "1" {
+		t.Fatalf("unexpected metadata: %+v", e)
+	}
+	for _, c := range []struct {
+		at  time.Time
+		err error
+	}{
+		{time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), ErrEnrollmentNotStarted},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), nil},
+		{time.Date(2024, 1, 31, 23, 59, 59, 0, time.UTC), nil},
+		{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), ErrEnrollmentEnded},
+	} {
+		if err := e.CheckEnrollment(c.at); err != c.err {
+			t.Errorf("at %v expected %v, got %v", c.at, c.err, err)
+		}
+	}
+
+	e, err = NewWhitelistEntry("", "2024-01-31T12:00:00Z", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.EnrollmentStart.IsZero() || !e.EnrollmentEnd.Equal(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected enrollment window: %+v", e)
+	}
+	if err := (&WhitelistEntry{}).CheckEnrollment(time.Now()); err != nil {
+		t.Fatalf("entry without enrollment window rejected: %v", err)
+	}
+
+	for _, invalid := range [][2]string{{"yesterday", ""}, {"", "31/01/2024"}, {"2024-02-01", "2024-01-31"}} {
+		if _, err := NewWhitelistEntry(invalid[0], invalid[1], "", ""); err == nil {
+			t.Errorf("expected enrollment window %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestShiftColumn(t *testing.T) {
+	for col, expected := range map[string]string{"A": "E", "c": "G", "W": "AA", "Z": "AD", "AZ": "BD"} {
+		if actual := shiftColumn(col, WHITELIST_METADATA_COLUMNS); actual != expected {
+			t.Errorf("shifting %s expected %s, got %s", col, expected, actual)
+		}
+	}
+}
+
+func TestProcessRowsMetadata(t *testing.T) {
+	rows := [][]interface{}{
+		{"public_key", "enrollment_start", "enrollment_end", "operator", "tier"},
+		{PK1, "2024-01-01", "", "Operator 1", "gold"},
+		{PK2},
+		{PK3, "not a date"},
+	}
+	wl := processRows(rows, logging.Logger("delegation backend test"))
+	if len(wl) != 2 || wl[mustPk(t, PK2)] == nil {
+		t.Fatalf("unexpected whitelist: %v", wl)
+	}
+	e := wl[mustPk(t, PK1)]
+	if e == nil || e.Operator != "Operator 1" || e.Tier != "gold" ||
+		!e.EnrollmentStart.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
@@ -22,6 +22,9 @@ const (
 	// AWS Keyspaces
 	DATABASE_MIGRATION_DIR   = "../../database/migrations"
 	AWS_SSL_CERTIFICATE_PATH = "../../database/cert/sf-class2-root.crt"
+
+	// PostgreSQL
+	POSTGRESQL_MIGRATION_DIR = DATABASE_MIGRATION_DIR + "/postgresql"
 )
 
 func getDirFiles(dir string, suffix string) ([]string, error) {
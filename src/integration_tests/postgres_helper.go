@@ -14,33 +14,72 @@ import (
 )
 
 func StartPostgresContainerAndSetupSchema(config delegation_backend.PostgreSQLConfig) (*sql.DB, error) {
-	ctx := context.Background()
+	req := postgresContainerRequest(config, "postgres_integration")
+	req.NetworkMode = "integration-test_default"
+	db, _, err := startPostgresContainer(config, req)
+	if err != nil {
+		return nil, err
+	}
 
-	req := testcontainers.ContainerRequest{
+	submissions_schema := `CREATE TABLE IF NOT EXISTS submissions (
+		id SERIAL PRIMARY KEY,
+		submitted_at_date DATE NOT NULL,
+		submitted_at TIMESTAMP NOT NULL,
+		submitter TEXT NOT NULL,
+		created_at TIMESTAMP,
+		block_hash TEXT,
+		remote_addr TEXT,
+		client_ip TEXT,
+		batched BOOLEAN,
+		peer_id TEXT,
+		snark_work BYTEA,
+		graphql_control_port INT,
+		built_with_commit_sha TEXT,
+		state_hash TEXT,
+		parent TEXT,
+		height INTEGER,
+		slot INTEGER,
+		validation_error TEXT,
+		verified BOOLEAN
+	);`
+
+	if _, err = db.Exec(submissions_schema); err != nil {
+		return nil, fmt.Errorf("failed to execute SQL script: %v", err)
+	}
+
+	return db, nil
+}
+
+func postgresContainerRequest(config delegation_backend.PostgreSQLConfig, name string) testcontainers.ContainerRequest {
+	return testcontainers.ContainerRequest{
 		Image:        "postgres",
-		Name:         "postgres_integration",
+		Name:         name,
 		ExposedPorts: []string{fmt.Sprintf("%d/tcp", config.Port)},
 		Env: map[string]string{
 			"POSTGRES_DB":       config.DBName,
 			"POSTGRES_USER":     config.User,
 			"POSTGRES_PASSWORD": config.Password,
 		},
-		WaitingFor:  wait.ForListeningPort("5432/tcp"),
-		NetworkMode: "integration-test_default",
+		WaitingFor: wait.ForListeningPort("5432/tcp"),
 	}
+}
+
+// startPostgresContainer starts the PostgreSQL container and connects to it.
+func startPostgresContainer(config delegation_backend.PostgreSQLConfig, req testcontainers.ContainerRequest) (*sql.DB, testcontainers.Container, error) {
+	ctx := context.Background()
 
 	postgresContainer, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
 		ContainerRequest: req,
 		Started:          true,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to start PostgreSQL container: %v", err)
+		return nil, nil, fmt.Errorf("failed to start PostgreSQL container: %v", err)
 	}
 
 	// Get the dynamic port mapped to the PostgreSQL server
 	mappedPort, err := postgresContainer.MappedPort(ctx, "5432")
 	if err != nil {
-		return nil, fmt.Errorf("failed to get mapped port: %v", err)
+		return nil, postgresContainer, fmt.Errorf("failed to get mapped port: %v", err)
 	}
 
 	// Build the connection string to connect to the dynamically started PostgreSQL
@@ -50,50 +89,37 @@ func StartPostgresContainerAndSetupSchema(config delegation_backend.PostgreSQLCo
 	// Wait for the container to be ready and establish a database connection
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the database: %v", err)
+		return nil, postgresContainer, fmt.Errorf("failed to connect to the database: %v", err)
 	}
 
 	// wait for the PostgreSQL to be ready
 	timeout := time.After(TIMEOUT_IN_S * time.Second)
 	tick := time.Tick(5 * time.Second)
-	ready := false
-	for !ready {
+	for {
 		select {
 		case <-timeout:
-			return nil, fmt.Errorf("timeout reached while waiting for PostgreSQL to be ready")
+			return nil, postgresContainer, fmt.Errorf("timeout reached while waiting for PostgreSQL to be ready")
 		case <-tick:
 			if err = db.Ping(); err == nil {
 				log.Println("PostgreSQL is ready")
-				ready = true
+				return db, postgresContainer, nil
 			}
 		}
 	}
+}
 
-	submissions_schema := `CREATE TABLE IF NOT EXISTS submissions (
-		id SERIAL PRIMARY KEY,
-		submitted_at_date DATE NOT NULL,
-		submitted_at TIMESTAMP NOT NULL,
-		submitter TEXT NOT NULL,
-		created_at TIMESTAMP,
-		block_hash TEXT,
-		remote_addr TEXT,
-		peer_id TEXT,
-		snark_work BYTEA,
-		graphql_control_port INT,
-		built_with_commit_sha TEXT,
-		state_hash TEXT,
-		parent TEXT,
-		height INTEGER,
-		slot INTEGER,
-		validation_error TEXT,
-		verified BOOLEAN
-	);`
-
-	if _, err = db.Exec(submissions_schema); err != nil {
-		return nil, fmt.Errorf("failed to execute SQL script: %v", err)
+// StartPostgresContainerAndMigrate starts a PostgreSQL container of its own
+// with the tables of the delegation backend created by its migrations.
+// The container should be terminated by the caller.
+func StartPostgresContainerAndMigrate(config delegation_backend.PostgreSQLConfig, name string) (*sql.DB, testcontainers.Container, error) {
+	db, postgresContainer, err := startPostgresContainer(config, postgresContainerRequest(config, name))
+	if err != nil {
+		return nil, postgresContainer, err
 	}
-
-	return db, nil
+	if err := delegation_backend.PostgreSQLMigrationUp(db, POSTGRESQL_MIGRATION_DIR); err != nil {
+		return nil, postgresContainer, fmt.Errorf("failed to migrate up: %v", err)
+	}
+	return db, postgresContainer, nil
 }
 
 func WaitUntilPostgresHasSubmissions(db *sql.DB) error {
@@ -0,0 +1,115 @@
+package integration_tests
+
+import (
+	dg "block_producers_uptime/delegation_backend"
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func testPk(b byte) dg.Pk {
+	var pk dg.Pk
+	pk[0] = b
+	return pk
+}
+
+func insertAttempt(t *testing.T, db *sql.DB, pk dg.Pk, at time.Time) {
+	if _, err := db.Exec(`INSERT INTO submission_attempts (submitter, attempted_at) VALUES ($1, $2)`, pk.String(), at); err != nil {
+		t.Fatalf("Failed to insert attempt: %v", err)
+	}
+}
+
+func countAttempts(t *testing.T, db *sql.DB, pk dg.Pk) int {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM submission_attempts WHERE submitter = $1`, pk.String()).Scan(&count); err != nil {
+		t.Fatalf("Failed to count attempts: %v", err)
+	}
+	return count
+}
+
+func TestIntegration_PostgreSQLRateLimiter(t *testing.T) {
+	config := getAppConfig()
+	db, container, err := StartPostgresContainerAndMigrate(*config.PostgreSQL, "postgres_rate_limiter")
+	if container != nil {
+		defer container.Terminate(context.Background())
+	}
+	if err != nil {
+		t.Fatalf("Failed to start PostgreSQL container: %v", err)
+	}
+	defer db.Close()
+	limiter := dg.NewPostgreSQLRateLimiter(db, 3, logging.Logger("delegation backend test"))
+
+	t.Run("sliding window", func(t *testing.T) {
+		pk := testPk(1)
+		now := time.Now()
+		// Attempts older than an hour don't count and are dropped
+		insertAttempt(t, db, pk, now.Add(-61*time.Minute))
+		insertAttempt(t, db, pk, now.Add(-61*time.Minute))
+		insertAttempt(t, db, pk, now.Add(-30*time.Minute))
+		insertAttempt(t, db, pk, now.Add(-20*time.Minute))
+		if !limiter.RecordAttempt(pk) {
+			t.Fatal("expected third attempt within the hour to be allowed")
+		}
+		if limiter.RecordAttempt(pk) {
+			t.Fatal("expected fourth attempt within the hour to be refused")
+		}
+		if n := countAttempts(t, db, pk); n != 3 {
+			t.Fatalf("expected old attempts to be deleted, got %d attempts", n)
+		}
+		// The oldest attempt within the hour leaves the window in 30 minutes
+		if d := limiter.RetryAfter(pk); d < 29*time.Minute || d > 30*time.Minute {
+			t.Fatalf("unexpected retry after %v", d)
+		}
+		limiter.ForgetAttempt(pk)
+		if !limiter.RecordAttempt(pk) {
+			t.Fatal("expected forgotten attempt to be allowed again")
+		}
+	})
+
+	t.Run("retry after without attempts", func(t *testing.T) {
+		if d := limiter.RetryAfter(testPk(2)); d != 0 {
+			t.Fatalf("expected no retry after, got %v", d)
+		}
+	})
+
+	t.Run("concurrent attempts", func(t *testing.T) {
+		// Attempts are serialized by the advisory lock, so the limit
+		// isn't exceeded by attempts racing with each other
+		pk := testPk(3)
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if limiter.RecordAttempt(pk) {
+					mutex.Lock()
+					allowed++
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if allowed != 3 || countAttempts(t, db, pk) != 3 {
+			t.Fatalf("expected 3 attempts allowed, got %d", allowed)
+		}
+	})
+
+	t.Run("sweep", func(t *testing.T) {
+		pk := testPk(4)
+		insertAttempt(t, db, pk, time.Now().Add(-2*time.Hour))
+		insertAttempt(t, db, pk, time.Now())
+		swept, err := limiter.Sweep(context.Background())
+		if err != nil || swept < 1 {
+			t.Fatalf("expected old attempts to be swept, got %d: %v", swept, err)
+		}
+		if n := countAttempts(t, db, pk); n != 1 {
+			t.Fatalf("expected recent attempt to be kept, got %d attempts", n)
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package integration_tests
+
+import (
+	dg "block_producers_uptime/delegation_backend"
+	"context"
+	"testing"
+	"time"
+
+	logging "github.com/ipfs/go-log/v2"
+)
+
+func TestIntegration_PostgreSQLReplayCache(t *testing.T) {
+	config := getAppConfig()
+	db, container, err := StartPostgresContainerAndMigrate(*config.PostgreSQL, "postgres_replay_cache")
+	if container != nil {
+		defer container.Terminate(context.Background())
+	}
+	if err != nil {
+		t.Fatalf("Failed to start PostgreSQL container: %v", err)
+	}
+	defer db.Close()
+	cache := dg.NewPostgreSQLReplayCache(db, logging.Logger("delegation backend test"))
+
+	pk := testPk(1)
+	var sig, otherSig dg.Sig
+	otherSig[0] = 1
+	now := time.Now()
+	if !cache.Record(pk, sig, now.Add(time.Hour)) {
+		t.Fatal("expected first signature to be recorded")
+	}
+	if cache.Record(pk, sig, now.Add(time.Hour)) {
+		t.Fatal("expected replayed signature to be rejected")
+	}
+	if !cache.Record(pk, otherSig, now.Add(time.Hour)) || !cache.Record(testPk(2), sig, now.Add(time.Hour)) {
+		t.Fatal("expected signatures of other submissions to be recorded")
+	}
+
+	// A forgotten signature can be recorded again
+	cache.Forget(pk, sig)
+	if !cache.Record(pk, sig, now.Add(time.Hour)) {
+		t.Fatal("expected forgotten signature to be recorded again")
+	}
+
+	// An expired signature is replaced
+	expired := testPk(3)
+	if !cache.Record(expired, sig, now.Add(-time.Second)) {
+		t.Fatal("expected signature to be recorded")
+	}
+	if !cache.Record(expired, sig, now.Add(time.Hour)) {
+		t.Fatal("expected expired signature to be replaced")
+	}
+	if cache.Record(expired, sig, now.Add(time.Hour)) {
+		t.Fatal("expected replaced signature to be rejected")
+	}
+
+	// Expired signatures are deleted by Run
+	if !cache.Record(testPk(4), sig, now.Add(-time.Second)) {
+		t.Fatal("expected signature to be recorded")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	cache.Run(ctx, time.Second)
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM seen_signatures WHERE expires_at <= $1`, time.Now()).Scan(&count); err != nil {
+		t.Fatalf("Failed to count signatures: %v", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected expired signatures to be deleted, %d left", count)
+	}
+}
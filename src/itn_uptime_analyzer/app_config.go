@@ -40,8 +40,8 @@ func loadAwsCredentials(filename string, log logging.EventLogger) {
    sane and can be used to execute the program. */
 func LoadEnv(log logging.EventLogger) AppConfig {
     // The list of available options. They're defined below.
-    Options := [8]Option { NetworkName, AwsRegion, AwsAccountId, IgnoreIPs,
-		StdOut, LocalOutput, S3Output, Period }
+    Options := [9]Option { NetworkName, AwsRegion, AwsAccountId, IgnoreIPs,
+		IgnoreBatched, StdOut, LocalOutput, S3Output, Period }
     var config AppConfig
 
     configFile := os.Getenv("CONFIG_FILE")
@@ -92,6 +92,7 @@ type AppConfig struct {
     NetworkName            string         `json:"network_name"`
     Period                 PeriodConfig   `json:"period"`
     IgnoreIPs              bool           `json:"ignore_ips"`
+    IgnoreBatched          bool           `json:"ignore_batched"`
 	Output                 OutputConfig   `json:"output"`
 }
 
@@ -208,6 +209,10 @@ var (
 		cfg.IgnoreIPs = value
 	})
 
+    IgnoreBatched = boolOption("CONFIG_IGNORE_BATCHED", func (value bool, cfg *AppConfig) {
+		cfg.IgnoreBatched = value
+	})
+
 	StdOut = boolOption("CONFIG_STDOUT", func (value bool, cfg *AppConfig) {
 		cfg.Output.Stdout = value
 	})
@@ -83,16 +83,21 @@ func CreateIdentities(config AppConfig, ctx dg.AwsContext, log *logging.ZapEvent
                     log.Fatalf("Error getting creating reader for json: %v\n", err)
                 }
 
+                submissionData = dg.MetaToBeSaved{}
                 err = json.Unmarshal(objContents, &submissionData)
                 if err != nil {
                     log.Fatalf("Error unmarshaling bucket content: %v\n", err)
                 }
 
+                if config.IgnoreBatched && submissionData.Batched {
+                    continue
+                }
+
                 var remoteAddr string
                 if config.IgnoreIPs {
                     remoteAddr = ""
                 } else {
-                    remoteAddr = submissionData.RemoteAddr
+                    remoteAddr = submissionData.ClientAddr()
                 }
 
                 if (!config.IgnoreIPs && submissionData.GraphqlControlPort != 0) {
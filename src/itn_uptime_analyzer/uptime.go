@@ -71,16 +71,21 @@ func (identity Identity) GetUptime(config AppConfig, ctx dg.AwsContext, log *log
                         log.Fatalf("Error getting creating reader for json: %v\n", err)
                     }
 
+                    submissionDataToday = dg.MetaToBeSaved{}
                     err = json.Unmarshal(objContents, &submissionDataToday)
                     if err != nil {
                         log.Fatalf("Error unmarshaling bucket content: %v\n", err)
                     }
 
+                    if config.IgnoreBatched && submissionDataToday.Batched {
+                        continue
+                    }
+
                     var remoteAddr string
                     if config.IgnoreIPs {
                         remoteAddr = ""
                     } else {
-                        remoteAddr = submissionDataToday.RemoteAddr
+                        remoteAddr = submissionDataToday.ClientAddr()
                     }
 
                     if (!config.IgnoreIPs && submissionDataToday.GraphqlControlPort != 0) {